@@ -0,0 +1,142 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"shareIt/internal/protocol"
+	"shareIt/internal/ratelimit"
+	"shareIt/internal/storage"
+	"strings"
+	"time"
+)
+
+// FileName is the config file's name inside the ShareIt state directory.
+const FileName = "config.json"
+
+// Config holds the user's persistent settings. Command-line flags override
+// whatever is loaded from the file.
+type Config struct {
+	DownloadDir     string                  `json:"download_dir"`
+	CollisionPolicy storage.CollisionPolicy `json:"collision_policy"`
+	RequirePairing  bool                    `json:"require_pairing"`      // Only exchange files with paired devices
+	MaxRate         string                  `json:"max_rate"`             // Cap on all transfers together, e.g. "10MB/s"; empty for none
+	Metadata        storage.MetadataPolicy  `json:"preserve_metadata"`    // Whose permissions and times to keep: all, paired or none
+	Partials        storage.PartialPolicy   `json:"partial_files"`        // Keep or delete downloads cut off halfway
+	MaxFileSize     string                  `json:"max_file_size"`        // Largest file accepted, e.g. "4G"; empty for no limit
+	Quota           string                  `json:"download_quota"`       // Most the download directory may hold, e.g. "100G"; empty for no limit
+	StallTimeout    string                  `json:"stall_timeout"`        // Fail a transfer that makes no progress this long, e.g. "30s"
+	MaxIncoming     int                     `json:"max_incoming"`         // Incoming transfers run at once; more wait in a queue
+	MaxPeerConns    int                     `json:"max_peer_connections"` // Connections one address may have open at once
+	MaxActiveSends  int                     `json:"max_active_sends"`     // Queued sends run at once
+	Discovery       protocol.DiscoveryMode  `json:"discovery"`            // How to find peers: multicast, mdns or both
+	Interfaces      []string                `json:"interfaces"`           // Network interface names or addresses to use; empty for all
+}
+
+// Default returns the settings used when there is no config file.
+func Default() Config {
+	dir := "."
+	if home, err := os.UserHomeDir(); err == nil {
+		dir = filepath.Join(home, "Downloads", "ShareIt")
+	}
+	return Config{
+		DownloadDir:     dir,
+		CollisionPolicy: storage.CollisionRename,
+		Metadata:        storage.MetadataAll,
+		Partials:        storage.PartialKeep,
+		StallTimeout:    "30s",
+		MaxIncoming:     4,
+		MaxPeerConns:    4,
+		MaxActiveSends:  2,
+		Discovery:       protocol.DiscoveryBoth,
+	}
+}
+
+// Load reads the config file at path on top of the defaults. A missing file
+// is not an error.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return cfg, cfg.Validate()
+}
+
+// Validate checks and normalises the loaded values.
+func (c *Config) Validate() error {
+	policy, err := storage.ParseCollisionPolicy(string(c.CollisionPolicy))
+	if err != nil {
+		return err
+	}
+	c.CollisionPolicy = policy
+
+	metadata, err := storage.ParseMetadataPolicy(string(c.Metadata))
+	if err != nil {
+		return fmt.Errorf("preserve_metadata: %w", err)
+	}
+	c.Metadata = metadata
+
+	partials, err := storage.ParsePartialPolicy(string(c.Partials))
+	if err != nil {
+		return fmt.Errorf("partial_files: %w", err)
+	}
+	c.Partials = partials
+
+	discovery, err := protocol.ParseDiscoveryMode(string(c.Discovery))
+	if err != nil {
+		return fmt.Errorf("discovery: %w", err)
+	}
+	c.Discovery = discovery
+
+	var interfaces []string
+	for _, name := range c.Interfaces {
+		if name = strings.TrimSpace(name); name != "" {
+			interfaces = append(interfaces, name)
+		}
+	}
+	c.Interfaces = interfaces
+
+	if _, err := storage.ParseSize(c.MaxFileSize); err != nil {
+		return fmt.Errorf("max_file_size: %w", err)
+	}
+	if _, err := storage.ParseSize(c.Quota); err != nil {
+		return fmt.Errorf("download_quota: %w", err)
+	}
+	if d, err := time.ParseDuration(c.StallTimeout); err != nil || d < protocol.MinStallTimeout {
+		return fmt.Errorf("stall_timeout: want a duration of at least %v, e.g. 30s, not %q", protocol.MinStallTimeout, c.StallTimeout)
+	}
+
+	if c.MaxIncoming < 1 {
+		return fmt.Errorf("max_incoming must be at least 1, not %d", c.MaxIncoming)
+	}
+	if c.MaxPeerConns < 1 {
+		return fmt.Errorf("max_peer_connections must be at least 1, not %d", c.MaxPeerConns)
+	}
+	if c.MaxActiveSends < 1 {
+		return fmt.Errorf("max_active_sends must be at least 1, not %d", c.MaxActiveSends)
+	}
+
+	if _, err := ratelimit.ParseRate(c.MaxRate); err != nil {
+		return fmt.Errorf("max_rate: %w", err)
+	}
+
+	if c.DownloadDir == "" {
+		return errors.New("download_dir must not be empty")
+	}
+	dir, err := filepath.Abs(c.DownloadDir)
+	if err != nil {
+		return err
+	}
+	c.DownloadDir = dir
+	return nil
+}
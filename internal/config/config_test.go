@@ -0,0 +1,32 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateStallTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		in string
+		ok bool
+	}{
+		{"30s", true},
+		{"15s", true}, // Three keepalive intervals
+		{"14.999s", false},
+		{"5s", false},
+		{"1m", true},
+		{"", false},
+		{"soon", false},
+	} {
+		c := Default()
+		c.DownloadDir = t.TempDir()
+		c.StallTimeout = tc.in
+		err := c.Validate()
+		if (err == nil) != tc.ok {
+			t.Errorf("stall_timeout %q: got %v, want ok %t", tc.in, err, tc.ok)
+		}
+		if err != nil && !strings.HasPrefix(err.Error(), "stall_timeout:") {
+			t.Errorf("stall_timeout %q: error %q does not name the setting", tc.in, err)
+		}
+	}
+}
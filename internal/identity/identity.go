@@ -0,0 +1,47 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"shareIt/internal/protocol"
+	"strings"
+)
+
+const nodeIDFile = "node_id"
+
+// Dir returns the directory ShareIt keeps its per-device state in.
+func Dir() (string, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "shareit"), nil
+}
+
+// LoadNodeID returns this device's node ID, creating and persisting a new one
+// on first run so peers see the same ID across restarts.
+func LoadNodeID(dir string) (protocol.NodeID, error) {
+	path := filepath.Join(dir, nodeIDFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return protocol.ParseNodeID(strings.TrimSpace(string(data)))
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return protocol.NodeID{}, err
+	}
+
+	id, err := protocol.NewNodeID()
+	if err != nil {
+		return id, fmt.Errorf("generating node id: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return id, err
+	}
+	if err := os.WriteFile(path, []byte(id.String()+"\n"), 0o600); err != nil {
+		return id, err
+	}
+	return id, nil
+}
@@ -0,0 +1,179 @@
+// Package pake implements SPAKE2 (RFC 9382) over P-256, so two devices can
+// agree on a strong key from a short code a person reads off one screen and
+// types into the other.
+package pake
+
+import (
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+)
+
+// Role says which side of the exchange a State is. The side showing the
+// code is A, the side typing it in is B.
+type Role int
+
+const (
+	RoleA Role = iota
+	RoleB
+)
+
+// ErrBadShare means the peer's share is not a valid point.
+var ErrBadShare = errors.New("invalid key share")
+
+// ErrWrongCode means key confirmation failed: the two sides used different
+// codes, or someone in the middle tried to guess it.
+var ErrWrongCode = errors.New("pairing code did not match")
+
+var curve = elliptic.P256()
+
+// The P-256 M and N points from RFC 9382, section 6.
+var pointM, pointN = mustPoint("02886e2f97ace46e55ba9dd7242579f2993b64e16ef3dcab95afd497333d8fa12f"),
+	mustPoint("03d8bbd6c639c62937b04d997f38c3770719c629d7014d49a24b4f98baa1292b49")
+
+type point struct{ x, y *big.Int }
+
+func mustPoint(s string) point {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	x, y := elliptic.UnmarshalCompressed(curve, b)
+	if x == nil {
+		panic("pake: invalid constant point")
+	}
+	return point{x, y}
+}
+
+func (p point) bytes() []byte {
+	return elliptic.Marshal(curve, p.x, p.y)
+}
+
+// State is one side of an exchange in progress.
+type State struct {
+	role     Role
+	w        *big.Int // Scalar derived from the code
+	secret   *big.Int // Our ephemeral scalar
+	share    []byte   // What we send the peer
+	idA, idB []byte
+}
+
+// New starts an exchange. idA and idB name the two sides, in role order,
+// and must be the same on both; binding them in stops a relay from pairing
+// with each side separately.
+func New(role Role, code string, idA, idB []byte) (*State, error) {
+	params := curve.Params()
+	secret, err := rand.Int(rand.Reader, new(big.Int).Sub(params.N, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	secret.Add(secret, big.NewInt(1))
+
+	sum := sha256.Sum256(append([]byte("shareit pake v1\x00"), code...))
+	w := new(big.Int).Mod(new(big.Int).SetBytes(sum[:]), params.N)
+
+	// share = secret*G + w*M for A, or w*N for B.
+	blind := pointM
+	if role == RoleB {
+		blind = pointN
+	}
+	gx, gy := curve.ScalarBaseMult(secret.Bytes())
+	bx, by := curve.ScalarMult(blind.x, blind.y, w.Bytes())
+	sx, sy := curve.Add(gx, gy, bx, by)
+
+	return &State{
+		role:   role,
+		w:      w,
+		secret: secret,
+		share:  elliptic.Marshal(curve, sx, sy),
+		idA:    idA,
+		idB:    idB,
+	}, nil
+}
+
+// Share is the message to send the peer.
+func (s *State) Share() []byte {
+	return s.share
+}
+
+// Keys is the outcome of an exchange. Both sides get the same Keys only if
+// they used the same code.
+type Keys struct {
+	Shared     [32]byte // The key the two devices now share
+	transcript [32]byte
+	confirmA   []byte
+	confirmB   []byte
+}
+
+// Finish combines the peer's share with ours.
+func (s *State) Finish(peerShare []byte) (*Keys, error) {
+	px, py := elliptic.Unmarshal(curve, peerShare)
+	if px == nil {
+		return nil, ErrBadShare
+	}
+
+	// Strip the peer's blinding: K = secret * (peer - w*M or w*N).
+	blind := pointN
+	if s.role == RoleB {
+		blind = pointM
+	}
+	bx, by := curve.ScalarMult(blind.x, blind.y, s.w.Bytes())
+	by = new(big.Int).Sub(curve.Params().P, by) // Negate
+	ux, uy := curve.Add(px, py, bx, by)
+	kx, ky := curve.ScalarMult(ux, uy, s.secret.Bytes())
+	if kx.Sign() == 0 && ky.Sign() == 0 {
+		return nil, ErrBadShare
+	}
+
+	shareA, shareB := s.share, peerShare
+	if s.role == RoleB {
+		shareA, shareB = peerShare, s.share
+	}
+	h := sha256.New()
+	for _, part := range [][]byte{s.idA, s.idB, pointM.bytes(), pointN.bytes(), shareA, shareB, elliptic.Marshal(curve, kx, ky), s.w.Bytes()} {
+		binary.Write(h, binary.LittleEndian, uint64(len(part)))
+		h.Write(part)
+	}
+	k := &Keys{}
+	copy(k.transcript[:], h.Sum(nil))
+
+	shared, err := hkdf.Key(sha256.New, k.transcript[:], nil, "ShareIt pairing key", 32)
+	if err != nil {
+		return nil, err
+	}
+	copy(k.Shared[:], shared)
+	confirm, err := hkdf.Key(sha256.New, k.transcript[:], nil, "ConfirmationKeys", 64)
+	if err != nil {
+		return nil, err
+	}
+	k.confirmA, k.confirmB = confirm[:32], confirm[32:]
+	return k, nil
+}
+
+// Confirm is the MAC role sends to prove it derived the same keys.
+func (k *Keys) Confirm(role Role) [32]byte {
+	key := k.confirmA
+	if role == RoleB {
+		key = k.confirmB
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(k.transcript[:])
+	var out [32]byte
+	copy(out[:], mac.Sum(nil))
+	return out
+}
+
+// Verify checks the MAC the peer in role sent.
+func (k *Keys) Verify(role Role, mac [32]byte) error {
+	want := k.Confirm(role)
+	if !hmac.Equal(want[:], mac[:]) {
+		return ErrWrongCode
+	}
+	return nil
+}
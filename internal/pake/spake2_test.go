@@ -0,0 +1,124 @@
+package pake
+
+import (
+	"crypto/elliptic"
+	"errors"
+	"testing"
+)
+
+var idA, idB = []byte("cert of A"), []byte("cert of B")
+
+// exchange runs both sides with the given codes and identities and returns
+// the keys each derived.
+func exchange(t *testing.T, codeA, codeB string, aIDs, bIDs [2][]byte) (*Keys, *Keys) {
+	t.Helper()
+	a, err := New(RoleA, codeA, aIDs[0], aIDs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(RoleB, codeB, bIDs[0], bIDs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysA, err := a.Finish(b.Share())
+	if err != nil {
+		t.Fatalf("A finishing: %v", err)
+	}
+	keysB, err := b.Finish(a.Share())
+	if err != nil {
+		t.Fatalf("B finishing: %v", err)
+	}
+	return keysA, keysB
+}
+
+func TestExchange(t *testing.T) {
+	ids := [2][]byte{idA, idB}
+	for _, tc := range []struct {
+		name         string
+		codeA, codeB string
+		aIDs, bIDs   [2][]byte
+		agree        bool
+	}{
+		{"same code", "123456", "123456", ids, ids, true},
+		{"wrong code", "123456", "123457", ids, ids, false},
+		{"other certificate for A", "123456", "123456", [2][]byte{[]byte("relay"), idB}, ids, false},
+		{"other certificate for B", "123456", "123456", ids, [2][]byte{idA, []byte("relay")}, false},
+		{"identities swapped", "123456", "123456", ids, [2][]byte{idB, idA}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			keysA, keysB := exchange(t, tc.codeA, tc.codeB, tc.aIDs, tc.bIDs)
+			if (keysA.Shared == keysB.Shared) != tc.agree {
+				t.Errorf("shared keys equal = %t, want %t", keysA.Shared == keysB.Shared, tc.agree)
+			}
+			errA := keysA.Verify(RoleB, keysB.Confirm(RoleB))
+			errB := keysB.Verify(RoleA, keysA.Confirm(RoleA))
+			for _, err := range []error{errA, errB} {
+				if tc.agree && err != nil {
+					t.Errorf("Verify: %v", err)
+				}
+				if !tc.agree && !errors.Is(err, ErrWrongCode) {
+					t.Errorf("Verify = %v, want ErrWrongCode", err)
+				}
+			}
+		})
+	}
+}
+
+// TestConfirmIsPerRole checks that one side's confirmation cannot be
+// reflected back to it as the other side's.
+func TestConfirmIsPerRole(t *testing.T) {
+	keysA, _ := exchange(t, "123456", "123456", [2][]byte{idA, idB}, [2][]byte{idA, idB})
+	if err := keysA.Verify(RoleB, keysA.Confirm(RoleA)); !errors.Is(err, ErrWrongCode) {
+		t.Errorf("A accepted its own confirmation: %v", err)
+	}
+}
+
+// TestSharesAreFresh checks that two exchanges with the same code do not
+// reuse a share.
+func TestSharesAreFresh(t *testing.T) {
+	s1, _ := New(RoleA, "123456", idA, idB)
+	s2, _ := New(RoleA, "123456", idA, idB)
+	if string(s1.Share()) == string(s2.Share()) {
+		t.Error("two exchanges sent the same share")
+	}
+}
+
+func TestFinishRejectsBadShares(t *testing.T) {
+	b, err := New(RoleB, "123456", idA, idB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share := b.Share()
+	offCurve := append([]byte(nil), share...)
+	offCurve[len(offCurve)-1] ^= 1
+	// w*N, which B itself would blind its share with: what is left once
+	// A strips the blinding is the point at infinity.
+	blind := func() []byte {
+		a, _ := New(RoleA, "123456", idA, idB)
+		bx, by := curve.ScalarMult(pointN.x, pointN.y, a.w.Bytes())
+		return elliptic.Marshal(curve, bx, by)
+	}()
+
+	for _, tc := range []struct {
+		name  string
+		share []byte
+	}{
+		{"empty", nil},
+		{"point at infinity", []byte{0}},
+		{"truncated", share[:len(share)-1]},
+		{"off the curve", offCurve},
+		{"compressed", elliptic.MarshalCompressed(curve, pointN.x, pointN.y)},
+		{"zero coordinates", append([]byte{4}, make([]byte, 64)...)},
+		{"blinding only", blind},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := New(RoleA, "123456", idA, idB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.Finish(tc.share); !errors.Is(err, ErrBadShare) {
+				t.Errorf("Finish = %v, want ErrBadShare", err)
+			}
+		})
+	}
+}
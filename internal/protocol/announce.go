@@ -0,0 +1,223 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// AnnounceMagic starts every discovery announcement.
+var AnnounceMagic = [4]byte{'S', 'H', 'R', 'D'}
+
+// AnnounceVersion is bumped whenever the announcement layout changes.
+// Announcements of any other version are ignored.
+const AnnounceVersion uint8 = 1
+
+// MaxInfoLength bounds the username, OS and app version in an announcement,
+// in bytes. Even with the device name at MaxNameLength an announcement stays
+// well under MaxAnnouncementSize.
+const MaxInfoLength = 64
+
+// maxTXTString is the longest "key=value" string a TXT record can hold
+// (RFC 6763 section 6.1), so a long device name may fit an announcement but
+// not a TXT record.
+const maxTXTString = 255
+
+// MaxTXTNameLength is the longest device name a TXT record can carry, as
+// it shares its string with the "name=" key.
+const MaxTXTNameLength = maxTXTString - len("name=")
+
+// MaxAnnouncementSize is the most an announcement can take, so a receive
+// buffer of this size always holds a whole one.
+const MaxAnnouncementSize = 1024
+
+// DiscoveryMode picks how devices find each other on the network.
+type DiscoveryMode string
+
+const (
+	DiscoveryMulticast DiscoveryMode = "multicast" // Announcements multicast in this package's format
+	DiscoveryMDNS      DiscoveryMode = "mdns"      // DNS-SD over mDNS, as _shareit._tcp.local
+	DiscoveryBoth      DiscoveryMode = "both"
+)
+
+// ParseDiscoveryMode validates a mode name from a flag or config file.
+func ParseDiscoveryMode(s string) (DiscoveryMode, error) {
+	switch m := DiscoveryMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case DiscoveryMulticast, DiscoveryMDNS, DiscoveryBoth:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown discovery mode %q (want multicast, mdns or both)", s)
+}
+
+// Announcement is what a device multicasts so others on the network can list
+// it and connect to it. The address to connect to is the packet's source
+// with Port.
+type Announcement struct {
+	NodeID       NodeID
+	Fingerprint  [32]byte // SHA-256 of the device certificate
+	Protocol     uint16   // ProtocolVersion spoken on Port
+	Port         uint16   // TCP port for transfers
+	Capabilities Capabilities
+	DeviceName   string
+	Username     string
+	OS           string
+	AppVersion   string
+}
+
+// WriteAnnouncement writes a to w.
+func WriteAnnouncement(w io.Writer, a Announcement) error {
+	var buf [4 + 1 + 16 + 32 + 2 + 2 + 4]byte
+	copy(buf[0:4], AnnounceMagic[:])
+	buf[4] = AnnounceVersion
+	copy(buf[5:21], a.NodeID[:])
+	copy(buf[21:53], a.Fingerprint[:])
+	binary.LittleEndian.PutUint16(buf[53:55], a.Protocol)
+	binary.LittleEndian.PutUint16(buf[55:57], a.Port)
+	binary.LittleEndian.PutUint32(buf[57:61], uint32(a.Capabilities))
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+	if err := writeString(w, "device name", a.DeviceName, MaxNameLength); err != nil {
+		return err
+	}
+	if err := writeString(w, "username", a.Username, MaxInfoLength); err != nil {
+		return err
+	}
+	if err := writeString(w, "os", a.OS, MaxInfoLength); err != nil {
+		return err
+	}
+	return writeString(w, "app version", a.AppVersion, MaxInfoLength)
+}
+
+// ReadAnnouncement reads an Announcement from r. Anything that is not one,
+// or is of another AnnounceVersion, fails with ErrUnknown.
+func ReadAnnouncement(r io.Reader) (Announcement, error) {
+	d := newDecoder(r, "announcement")
+	var magic [4]byte
+	d.full("magic", magic[:])
+	if d.err == nil && magic != AnnounceMagic {
+		d.fail("magic", ErrUnknown)
+	}
+	if v := d.uint8("version"); d.err == nil && v != AnnounceVersion {
+		d.fail("version", fmt.Errorf("%w %d", ErrUnknown, v))
+	}
+	var a Announcement
+	d.full("node id", a.NodeID[:])
+	d.full("fingerprint", a.Fingerprint[:])
+	a.Protocol = d.uint16("protocol")
+	a.Port = d.uint16("port")
+	a.Capabilities = Capabilities(d.uint32("capabilities"))
+	a.DeviceName = d.text("device name", MaxNameLength)
+	a.Username = d.text("username", MaxInfoLength)
+	a.OS = d.text("os", MaxInfoLength)
+	a.AppVersion = d.text("app version", MaxInfoLength)
+	if d.err != nil {
+		return Announcement{}, d.err
+	}
+	return a, nil
+}
+
+// AnnouncementTXT encodes a as the TXT record of a DNS-SD service, one
+// "key=value" string each. The port is not included: it belongs in the
+// service's SRV record.
+func AnnouncementTXT(a Announcement) ([]string, error) {
+	for _, f := range []struct {
+		field, s string
+		max      int
+	}{
+		{"device name", a.DeviceName, MaxNameLength},
+		{"username", a.Username, MaxInfoLength},
+		{"os", a.OS, MaxInfoLength},
+		{"app version", a.AppVersion, MaxInfoLength},
+	} {
+		if len(f.s) > f.max {
+			return nil, fmt.Errorf("%s %w: %d bytes, limit is %d", f.field, ErrTooLong, len(f.s), f.max)
+		}
+	}
+	txt := []string{
+		"txtvers=" + strconv.Itoa(int(AnnounceVersion)),
+		"id=" + a.NodeID.String(),
+		"fp=" + hex.EncodeToString(a.Fingerprint[:]),
+		"proto=" + strconv.Itoa(int(a.Protocol)),
+		"caps=" + strconv.FormatUint(uint64(a.Capabilities), 10),
+		"name=" + a.DeviceName,
+		"user=" + a.Username,
+		"os=" + a.OS,
+		"ver=" + a.AppVersion,
+	}
+	for _, kv := range txt {
+		if len(kv) > maxTXTString {
+			key, _, _ := strings.Cut(kv, "=")
+			return nil, fmt.Errorf("%s %w for a TXT record: %d bytes with its key, limit is %d", key, ErrTooLong, len(kv), maxTXTString)
+		}
+	}
+	return txt, nil
+}
+
+// ParseAnnouncementTXT decodes the TXT record written by AnnouncementTXT,
+// leaving Port zero. Keys are matched without regard to case and, as DNS-SD
+// asks, only the first of a repeated key counts. Unknown keys are ignored.
+func ParseAnnouncementTXT(txt []string) (Announcement, error) {
+	values := make(map[string]string)
+	for _, kv := range txt {
+		k, v, _ := strings.Cut(kv, "=")
+		k = strings.ToLower(k)
+		if _, dup := values[k]; !dup {
+			values[k] = v
+		}
+	}
+	var a Announcement
+	var err error
+	fail := func(field string, e error) {
+		if err == nil {
+			err = &DecodeError{Message: "announcement txt", Field: field, Err: e}
+		}
+	}
+	get := func(key string, max int) string {
+		v, ok := values[key]
+		if !ok {
+			fail(key, ErrTruncated)
+			return ""
+		}
+		// The key shares the string's maxTXTString bytes.
+		if len(v) > min(max, maxTXTString-len(key)-1) {
+			fail(key, ErrTooLong)
+			return ""
+		}
+		return v
+	}
+	number := func(key string, bits int) uint64 {
+		n, perr := strconv.ParseUint(get(key, 10), 10, bits)
+		if perr != nil {
+			fail(key, ErrUnknown)
+		}
+		return n
+	}
+
+	if v := get("txtvers", 3); err == nil && v != strconv.Itoa(int(AnnounceVersion)) {
+		fail("txtvers", fmt.Errorf("%w %s", ErrUnknown, v))
+	}
+	if id, perr := ParseNodeID(get("id", 36)); perr != nil {
+		fail("id", ErrUnknown)
+	} else {
+		a.NodeID = id
+	}
+	if fp := get("fp", hex.EncodedLen(len(a.Fingerprint))); len(fp) != hex.EncodedLen(len(a.Fingerprint)) {
+		fail("fp", ErrTruncated)
+	} else if _, herr := hex.Decode(a.Fingerprint[:], []byte(fp)); herr != nil {
+		fail("fp", ErrUnknown)
+	}
+	a.Protocol = uint16(number("proto", 16))
+	a.Capabilities = Capabilities(number("caps", 32))
+	a.DeviceName = printable(get("name", MaxNameLength))
+	a.Username = printable(get("user", MaxInfoLength))
+	a.OS = printable(get("os", MaxInfoLength))
+	a.AppVersion = printable(get("ver", MaxInfoLength))
+	if err != nil {
+		return Announcement{}, err
+	}
+	return a, nil
+}
@@ -0,0 +1,194 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Limits on the variable-length fields of incoming messages. Every length a
+// peer sends is checked against them before anything is allocated.
+const (
+	MaxNameLength  = 255  // File, folder and device names, in bytes
+	MaxPathLength  = 4096 // Paths inside a manifest, in bytes
+	maxShareLength = 256  // SPAKE2 shares, in bytes
+)
+
+// Reasons a message from a peer cannot be decoded. They come wrapped in a
+// *DecodeError naming the message and field.
+var (
+	ErrTruncated = errors.New("truncated")
+	ErrTooLong   = errors.New("too long")
+	ErrNegative  = errors.New("negative")
+	ErrUnknown   = errors.New("unknown value")
+)
+
+// DecodeError says which field of an incoming message is bad. Err is one
+// of the Err values above, ErrBadMagic, or the error from the connection.
+type DecodeError struct {
+	Message string
+	Field   string
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Message, e.Field, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// decoder reads the fields of one message in order. After the first
+// failure every read returns a zero value, so a whole message can be
+// decoded before checking err once.
+type decoder struct {
+	r   io.Reader
+	msg string
+	err error
+	buf [8]byte
+}
+
+func newDecoder(r io.Reader, msg string) *decoder {
+	return &decoder{r: r, msg: msg}
+}
+
+// fail records the first error, blaming field.
+func (d *decoder) fail(field string, err error) {
+	if d.err != nil {
+		return
+	}
+	d.err = &DecodeError{Message: d.msg, Field: field, Err: truncated(err)}
+}
+
+// truncated turns running out of input partway through a message into
+// ErrTruncated and leaves other errors alone.
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
+// full reads exactly len(b) bytes into b.
+func (d *decoder) full(field string, b []byte) {
+	if d.err != nil {
+		return
+	}
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		clear(b)
+		d.fail(field, err)
+	}
+}
+
+func (d *decoder) uint8(field string) uint8 {
+	d.full(field, d.buf[:1])
+	return d.buf[0]
+}
+
+func (d *decoder) uint16(field string) uint16 {
+	d.full(field, d.buf[:2])
+	return binary.LittleEndian.Uint16(d.buf[:2])
+}
+
+func (d *decoder) uint32(field string) uint32 {
+	d.full(field, d.buf[:4])
+	return binary.LittleEndian.Uint32(d.buf[:4])
+}
+
+func (d *decoder) int64(field string) int64 {
+	d.full(field, d.buf[:8])
+	return int64(binary.LittleEndian.Uint64(d.buf[:8]))
+}
+
+// size reads a byte count or offset, which must not be negative.
+func (d *decoder) size(field string) int64 {
+	v := d.int64(field)
+	if v < 0 {
+		d.fail(field, ErrNegative)
+		return 0
+	}
+	return v
+}
+
+// string reads a string written by writeString that may be at most max
+// bytes long.
+func (d *decoder) string(field string, max int) string {
+	n := int(d.uint16(field))
+	if d.err != nil {
+		return ""
+	}
+	if n > max {
+		d.fail(field, ErrTooLong)
+		return ""
+	}
+	b := make([]byte, n)
+	d.full(field, b)
+	if d.err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// rest reads everything left of a frame payload as its last field, which
+// may be at most max bytes long.
+func (d *decoder) rest(field string, max int) string {
+	if d.err != nil {
+		return ""
+	}
+	b, err := io.ReadAll(io.LimitReader(d.r, int64(max)+1))
+	if err != nil {
+		d.fail(field, err)
+		return ""
+	}
+	if len(b) > max {
+		d.fail(field, ErrTooLong)
+		return ""
+	}
+	return string(b)
+}
+
+// end fails unless a frame payload has been read to its last byte, blaming
+// field, the last one it should hold.
+func (d *decoder) end(field string) {
+	if d.err != nil {
+		return
+	}
+	if n, _ := d.r.Read(d.buf[:1]); n > 0 {
+		d.fail(field, ErrTooLong)
+	}
+}
+
+// text reads a string like string does, for text meant to be shown to the
+// user: names, paths and messages. See printable.
+func (d *decoder) text(field string, max int) string {
+	return printable(d.string(field, max))
+}
+
+// printable drops invalid UTF-8, control and formatting characters from
+// text a peer sent, so it cannot move the cursor, recolour or rewrite what
+// the terminal shows, or hide part of a name. It never makes s longer.
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) {
+			return r
+		}
+		return -1
+	}, strings.ToValidUTF8(s, ""))
+}
+
+// writeString writes s prefixed with its length as a uint16. Anything the
+// other side's decoder would refuse is refused here first.
+func writeString(w io.Writer, field, s string, max int) error {
+	if len(s) > max {
+		return fmt.Errorf("%s %w: %d bytes, limit is %d", field, ErrTooLong, len(s), max)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
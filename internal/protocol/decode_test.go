@@ -0,0 +1,447 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// encode runs write into a buffer, failing the test if it refuses.
+func encode[T any](t testing.TB, write func(io.Writer, T) error, v T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := write(&buf, v); err != nil {
+		t.Fatalf("encoding %+v: %v", v, err)
+	}
+	return buf.Bytes()
+}
+
+// addSeeds adds a valid message and every truncation of it to the corpus.
+func addSeeds(f *testing.F, valid ...[]byte) {
+	for _, b := range valid {
+		for i := 0; i <= len(b); i++ {
+			f.Add(b[:i])
+		}
+	}
+}
+
+// checkDecode is the property every reader must have: on any input it
+// either fails with a *DecodeError, or returns a value that encodes and
+// decodes back to itself.
+func checkDecode[T any](t *testing.T, data []byte, read func(io.Reader) (T, error), write func(io.Writer, T) error) {
+	v, err := read(bytes.NewReader(data))
+	if err != nil {
+		var derr *DecodeError
+		if !errors.As(err, &derr) {
+			t.Fatalf("error is %T, want *DecodeError: %v", err, err)
+		}
+		return
+	}
+	again, err := read(bytes.NewReader(encode(t, write, v)))
+	if err != nil {
+		t.Fatalf("re-decoding %+v: %v", v, err)
+	}
+	if !reflect.DeepEqual(v, again) {
+		t.Fatalf("round trip changed %+v to %+v", v, again)
+	}
+}
+
+var mtime = time.Unix(0, 1700000000123456789)
+
+// payload adapts a parser of frame payloads to checkDecode.
+func payload[T any](parse func([]byte) (T, error), frame func(T) []byte) (func(io.Reader) (T, error), func(io.Writer, T) error) {
+	write := func(w io.Writer, v T) error {
+		_, err := w.Write(frame(v))
+		return err
+	}
+	return parser(parse), write
+}
+
+func FuzzReadHello(f *testing.F) {
+	addSeeds(f, encode(f, WriteHello, Hello{Version: ProtocolVersion, NodeID: NodeID{1, 2, 3}, Capabilities: CapGzip}))
+	f.Add([]byte("GET / HTTP/1.1\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecode(t, data, ReadHello, WriteHello)
+	})
+}
+
+func FuzzReadHelloAck(f *testing.F) {
+	addSeeds(f,
+		encode(f, WriteHelloAck, HelloAck{Status: HandshakeOK, Version: ProtocolVersion, NodeID: NodeID{4, 5}, Capabilities: CapGzip}),
+		encode(f, WriteHelloAck, HelloAck{Status: HandshakeBusy, Version: ProtocolVersion}),
+	)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecode(t, data, ReadHelloAck, WriteHelloAck)
+	})
+}
+
+func FuzzReadAuth(f *testing.F) {
+	addSeeds(f,
+		encode(f, WriteAuth, Auth{Paired: true, Proof: [32]byte{1, 2, 3}}),
+		encode(f, WriteAuth, Auth{}),
+	)
+	f.Add(append([]byte{2}, make([]byte, 32)...)) // Neither paired nor not
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecode(t, data, ReadAuth, WriteAuth)
+	})
+}
+
+func FuzzReadPairConfirm(f *testing.F) {
+	addSeeds(f, encode(f, WritePairConfirm, PairConfirm{Status: PairOK, Confirm: [32]byte{9}}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecode(t, data, ReadPairConfirm, WritePairConfirm)
+	})
+}
+
+// FuzzReadRequest also checks that a connection closed between requests is
+// io.EOF rather than a *DecodeError.
+func FuzzReadRequest(f *testing.F) {
+	addSeeds(f, encode(f, WriteRequest, RequestOffer), encode(f, WriteRequest, RequestPair))
+	f.Add([]byte{0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			if _, err := ReadRequest(bytes.NewReader(data)); err != io.EOF {
+				t.Fatalf("empty input: got %v, want io.EOF", err)
+			}
+			return
+		}
+		checkDecode(t, data, ReadRequest, WriteRequest)
+	})
+}
+
+func FuzzParseTrailer(f *testing.F) {
+	addSeeds(f, append(TrailerFrame(Trailer{SHA256: [32]byte{1, 2, 3}}), 0))
+	read, write := payload(ParseTrailer, TrailerFrame)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecode(t, data, read, write)
+	})
+}
+
+func FuzzParseStatus(f *testing.F) {
+	addSeeds(f, StatusFrame(Status{Code: StatusIOError, Message: "disk full"}))
+	f.Add(append([]byte{byte(StatusHashMismatch)}, "\x1b[2Jbad"...))
+	f.Add(append([]byte{0}, make([]byte, MaxStatusLength+1)...))
+	read, write := payload(ParseStatus, StatusFrame)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecode(t, data, read, write)
+	})
+}
+
+func FuzzReadOffer(f *testing.F) {
+	addSeeds(f,
+		encode(f, WriteOffer, Offer{Name: "a.txt", Size: 42, SenderName: "laptop", Kind: KindFile, Mode: 0o644, ModTime: mtime}),
+		encode(f, WriteOffer, Offer{Name: "photos", Size: 1 << 40, SenderName: "", Kind: KindDirectory, Mode: 0o755, ModTime: mtime}),
+	)
+	// A name length far over the limit, and a negative size.
+	f.Add([]byte{0xff, 0xff, 'x'})
+	f.Add(append([]byte{1, 0, 'a'}, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecode(t, data, ReadOffer, WriteOffer)
+	})
+}
+
+func FuzzReadAnswer(f *testing.F) {
+	addSeeds(f,
+		encode(f, WriteAnswer, Answer{Decision: DecisionAccept, Name: "a (1).txt", Offset: 1 << 20, PrefixHash: [32]byte{1, 2, 3}}),
+		encode(f, WriteAnswer, Answer{Decision: DecisionReject, Reason: ReasonNoSpace}),
+		encode(f, WriteAnswer, Answer{Decision: DecisionQueued, Position: 3}),
+	)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecode(t, data, ReadAnswer, WriteAnswer)
+	})
+}
+
+func FuzzReadStart(f *testing.F) {
+	addSeeds(f, encode(f, WriteStart, Start{Offset: 1 << 20, Codec: CodecGzip}))
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 0x80, 0}) // Negative offset
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 0, 9})    // Unknown codec
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecode(t, data, ReadStart, WriteStart)
+	})
+}
+
+func FuzzReadManifest(f *testing.F) {
+	addSeeds(f, encode(f, WriteManifest, Manifest{Entries: []ManifestEntry{
+		{Path: "sub", Mode: 0o755, ModTime: mtime, IsDir: true},
+		{Path: "sub/b.bin", Size: 1000, Mode: 0o600, ModTime: mtime},
+	}}))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff}) // Billions of entries, none sent
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecode(t, data, ReadManifest, WriteManifest)
+	})
+}
+
+func FuzzReadPairRequest(f *testing.F) {
+	addSeeds(f, encode(f, WritePairRequest, PairRequest{DeviceName: "desk", Share: bytes.Repeat([]byte{4}, 65)}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecode(t, data, ReadPairRequest, WritePairRequest)
+	})
+}
+
+func FuzzReadPairReply(f *testing.F) {
+	addSeeds(f, encode(f, WritePairReply, PairReply{Status: PairOK, DeviceName: "desk", Share: []byte{4, 5}, Confirm: [32]byte{9}}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecode(t, data, ReadPairReply, WritePairReply)
+	})
+}
+
+func FuzzReadAnnouncement(f *testing.F) {
+	addSeeds(f, encode(f, WriteAnnouncement, Announcement{
+		NodeID:       NodeID{1, 2, 3},
+		Fingerprint:  [32]byte{7},
+		Protocol:     ProtocolVersion,
+		Port:         8000,
+		Capabilities: CapGzip,
+		DeviceName:   "desk",
+		Username:     "alice",
+		OS:           "windows",
+		AppVersion:   "1.4.0",
+	}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkDecode(t, data, ReadAnnouncement, WriteAnnouncement)
+	})
+}
+
+// FuzzParseAnnouncementTXT takes the TXT strings joined by NULs.
+func FuzzParseAnnouncementTXT(f *testing.F) {
+	txt, err := AnnouncementTXT(Announcement{
+		NodeID:       NodeID{1, 2, 3},
+		Fingerprint:  [32]byte{7},
+		Protocol:     ProtocolVersion,
+		Capabilities: CapGzip,
+		DeviceName:   "desk",
+		Username:     "alice",
+		OS:           "windows",
+		AppVersion:   "1.4.0",
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(strings.Join(txt, "\x00"))
+	f.Add(strings.Join(txt[1:], "\x00"))
+	f.Add("txtvers=1\x00TXTVERS=2\x00proto=-1\x00caps=99999999999")
+	f.Fuzz(func(t *testing.T, data string) {
+		a, err := ParseAnnouncementTXT(strings.Split(data, "\x00"))
+		if err != nil {
+			var derr *DecodeError
+			if !errors.As(err, &derr) {
+				t.Fatalf("error is %T, want *DecodeError: %v", err, err)
+			}
+			return
+		}
+		txt, err := AnnouncementTXT(a)
+		if err != nil {
+			t.Fatalf("encoding %+v: %v", a, err)
+		}
+		again, err := ParseAnnouncementTXT(txt)
+		if err != nil {
+			t.Fatalf("re-decoding %+v: %v", a, err)
+		}
+		if !reflect.DeepEqual(a, again) {
+			t.Fatalf("round trip changed %+v to %+v", a, again)
+		}
+	})
+}
+
+func FuzzReadFrame(f *testing.F) {
+	var buf bytes.Buffer
+	WriteFrame(&buf, FrameData, []byte("hello"))
+	WriteFrame(&buf, FrameTrailer, make([]byte, 32))
+	addSeeds(f, buf.Bytes())
+	f.Add([]byte{byte(FrameData), 0xff, 0xff, 0xff, 0xff}) // 4 GiB payload announced
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		for {
+			fr, err := ReadFrame(r)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				var derr *DecodeError
+				if !errors.As(err, &derr) {
+					t.Fatalf("error is %T, want *DecodeError: %v", err, err)
+				}
+				return
+			}
+			if len(fr.Payload) > MaxFrameSize {
+				t.Fatalf("payload of %d bytes accepted", len(fr.Payload))
+			}
+		}
+	})
+}
+
+func TestDecodeErrors(t *testing.T) {
+	le := func(v any) []byte {
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, v)
+		return b.Bytes()
+	}
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		name  string
+		read  func(io.Reader) error
+		data  []byte
+		field string
+		want  error
+	}{
+		{"empty offer", readErr(ReadOffer), nil, "name", ErrTruncated},
+		{"long name", readErr(ReadOffer), cat(le(uint16(MaxNameLength+1)), make([]byte, MaxNameLength+1)), "name", ErrTooLong},
+		{"negative size", readErr(ReadOffer), cat(le(uint16(1)), []byte("a"), le(int64(-1))), "size", ErrNegative},
+		{"unknown kind", readErr(ReadOffer), cat(le(uint16(1)), []byte("a"), le(int64(1)), le(uint16(0)), []byte{7}), "kind", ErrUnknown},
+		{"negative offset", readErr(ReadStart), cat(le(int64(-5)), []byte{0}), "offset", ErrNegative},
+		{"too many entries", readErr(ReadManifest), le(uint32(maxManifestEntries + 1)), "entry count", ErrTooLong},
+		{"long path", readErr(ReadManifest), cat(le(uint32(1)), le(uint16(MaxPathLength+1))), "path", ErrTooLong},
+		{"huge frame", readErr(ReadFrame), cat([]byte{byte(FrameData)}, le(uint32(MaxFrameSize+1))), "length", ErrTooLong},
+		{"cut frame", readErr(ReadFrame), cat([]byte{byte(FrameData)}, le(uint32(10)), []byte("abc")), "payload", ErrTruncated},
+		{"bad magic", readErr(ReadHello), []byte("GET / HTTP/1.1\r\n\r\n..."), "magic", ErrBadMagic},
+		{"cut hello", readErr(ReadHello), cat(Magic[:], le(ProtocolVersion), []byte{1, 2}), "node id", ErrTruncated},
+		{"cut hello ack", readErr(ReadHelloAck), cat([]byte{0}, le(ProtocolVersion), make([]byte, 16)), "capabilities", ErrTruncated},
+		{"unknown request", readErr(ReadRequest), []byte{9}, "kind", ErrUnknown},
+		{"bad paired flag", readErr(ReadAuth), cat([]byte{2}, make([]byte, 32)), "paired", ErrUnknown},
+		{"cut pair confirm", readErr(ReadPairConfirm), []byte{0, 1, 2}, "confirm", ErrTruncated},
+		{"short trailer", readErr(parser(ParseTrailer)), make([]byte, 31), "sha256", ErrTruncated},
+		{"long trailer", readErr(parser(ParseTrailer)), make([]byte, 33), "sha256", ErrTooLong},
+		{"empty status", readErr(parser(ParseStatus)), nil, "code", ErrTruncated},
+		{"long status", readErr(parser(ParseStatus)), make([]byte, 1+MaxStatusLength+1), "message", ErrTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.read(bytes.NewReader(tt.data))
+			var derr *DecodeError
+			if !errors.As(err, &derr) || derr.Field != tt.field || !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v in field %q", err, tt.want, tt.field)
+			}
+		})
+	}
+}
+
+func TestWriteRefusesWhatReadRejects(t *testing.T) {
+	long := string(make([]byte, MaxNameLength+1))
+	if err := WriteOffer(io.Discard, Offer{Name: long}); !errors.Is(err, ErrTooLong) {
+		t.Errorf("long name: got %v, want ErrTooLong", err)
+	}
+	if err := WriteOffer(io.Discard, Offer{Name: "a", Size: -1}); !errors.Is(err, ErrNegative) {
+		t.Errorf("negative size: got %v, want ErrNegative", err)
+	}
+}
+
+// TestAnnouncementTXTLimit checks that no TXT string goes past 255 bytes,
+// key included, in either direction.
+func TestAnnouncementTXTLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		n    int
+		ok   bool
+	}{
+		{"fits", maxTXTString - len("name="), true},
+		{"one over", maxTXTString - len("name=") + 1, false},
+		{"MaxNameLength", MaxNameLength, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			txt, err := AnnouncementTXT(Announcement{DeviceName: strings.Repeat("a", tc.n)})
+			if !tc.ok {
+				if !errors.Is(err, ErrTooLong) {
+					t.Errorf("AnnouncementTXT = %v, want ErrTooLong", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, kv := range txt {
+				if len(kv) > maxTXTString {
+					t.Errorf("%d-byte TXT string %.10q...", len(kv), kv)
+				}
+			}
+			if _, err := ParseAnnouncementTXT(txt); err != nil {
+				t.Errorf("parsing: %v", err)
+			}
+			// The same name one byte longer is refused on the way in too.
+			for i, kv := range txt {
+				if strings.HasPrefix(kv, "name=") {
+					txt[i] += "a"
+				}
+			}
+			if _, err := ParseAnnouncementTXT(txt); !errors.Is(err, ErrTooLong) {
+				t.Errorf("parsing a %d-byte name: %v, want ErrTooLong", tc.n+1, err)
+			}
+		})
+	}
+}
+
+// parser adapts a parser of frame payloads to readErr.
+func parser[T any](parse func([]byte) (T, error)) func(io.Reader) (T, error) {
+	return func(r io.Reader) (T, error) {
+		b, _ := io.ReadAll(r)
+		return parse(b)
+	}
+}
+
+func readErr[T any](read func(io.Reader) (T, error)) func(io.Reader) error {
+	return func(r io.Reader) error {
+		_, err := read(r)
+		return err
+	}
+}
+
+// TestPeerTextIsPrintable checks that names from a peer reach the UI with
+// no way to drive the terminal.
+func TestPeerTextIsPrintable(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"a\x1b[2J\x1b[Hb.txt", "a[2J[Hb.txt"},
+		{"line\r\nbreak", "linebreak"},
+		{"invoice‮fdp.exe", "invoicefdp.exe"},
+		{"bad\xffutf8", "badutf8"},
+		{"café ü", "café ü"},
+	} {
+		data := encode(t, WriteOffer, Offer{Name: tc.in, SenderName: tc.in, Kind: KindFile, ModTime: mtime})
+		o, err := ReadOffer(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("ReadOffer(%q): %v", tc.in, err)
+		}
+		if o.Name != tc.want || o.SenderName != tc.want {
+			t.Errorf("ReadOffer(%q) = name %q, sender %q, want %q", tc.in, o.Name, o.SenderName, tc.want)
+		}
+		q, err := ReadPairRequest(bytes.NewReader(encode(t, WritePairRequest, PairRequest{DeviceName: tc.in})))
+		if err != nil || q.DeviceName != tc.want {
+			t.Errorf("ReadPairRequest(%q) = %q, %v, want %q", tc.in, q.DeviceName, err, tc.want)
+		}
+		r, err := ReadPairReply(bytes.NewReader(encode(t, WritePairReply, PairReply{DeviceName: tc.in})))
+		if err != nil || r.DeviceName != tc.want {
+			t.Errorf("ReadPairReply(%q) = %q, %v, want %q", tc.in, r.DeviceName, err, tc.want)
+		}
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	long := strings.Repeat("é", MaxStatusLength)
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		want    Status
+		err     error
+	}{
+		{"ok", StatusFrame(Status{Code: StatusOK}), Status{Code: StatusOK}, nil},
+		{"message", StatusFrame(Status{Code: StatusIOError, Message: "disk full"}), Status{Code: StatusIOError, Message: "disk full"}, nil},
+		{"control characters", []byte("\x02bad\x1b[31m\r\nhash"), Status{Code: StatusIOError, Message: "bad[31mhash"}, nil},
+		{"long message cut when sending", StatusFrame(Status{Code: StatusIOError, Message: long}), Status{Code: StatusIOError, Message: long[:MaxStatusLength]}, nil},
+		{"empty", nil, Status{}, ErrTruncated},
+		{"long message refused", append([]byte{0}, long[:MaxStatusLength+1]...), Status{}, ErrTooLong},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := ParseStatus(tc.payload)
+			if !errors.Is(err, tc.err) || s != tc.want {
+				t.Fatalf("ParseStatus = %+v, %v, want %+v, %v", s, err, tc.want, tc.err)
+			}
+		})
+	}
+}
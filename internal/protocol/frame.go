@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// FrameType tags each frame exchanged once the data stream has started.
+// From then on both directions of the connection carry only frames, so
+// either side can pause or cancel at any point.
+type FrameType uint8
+
+const (
+	FrameData      FrameType = iota + 1 // Sender to receiver: file bytes
+	FrameTrailer                        // Sender to receiver: end of data and its SHA-256
+	FrameStatus                         // Receiver to sender: verdict on the trailer
+	FramePause                          // Either way: the other side paused the transfer
+	FrameResume                         // Either way: the other side resumed it
+	FrameCancel                         // Either way: abandon the transfer; payload is the reason
+	FrameKeepalive                      // Sender to receiver: nothing to send yet, but still here
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameData:
+		return "data"
+	case FrameTrailer:
+		return "trailer"
+	case FrameStatus:
+		return "status"
+	case FramePause:
+		return "pause"
+	case FrameResume:
+		return "resume"
+	case FrameCancel:
+		return "cancel"
+	case FrameKeepalive:
+		return "keepalive"
+	default:
+		return fmt.Sprintf("frame(%d)", uint8(t))
+	}
+}
+
+const (
+	// KeepaliveInterval is how often a sender with nothing to send sends
+	// FrameKeepalive.
+	KeepaliveInterval = 5 * time.Second
+	// MinStallTimeout is the shortest stall timeout allowed. It lets two
+	// keepalives go missing before a quiet but healthy transfer is failed.
+	MinStallTimeout = 3 * KeepaliveInterval
+)
+
+// MaxFrameSize bounds a frame's payload.
+const MaxFrameSize = 256 * 1024
+
+// Frame is one tagged message on the data stream.
+type Frame struct {
+	Type    FrameType
+	Payload []byte
+}
+
+// WriteFrame writes a frame header and payload in a single write.
+func WriteFrame(w io.Writer, t FrameType, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return fmt.Errorf("%s frame too large: %d bytes", t, len(payload))
+	}
+	buf := make([]byte, 5+len(payload))
+	buf[0] = byte(t)
+	binary.LittleEndian.PutUint32(buf[1:5], uint32(len(payload)))
+	copy(buf[5:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads the next frame from r. A connection closed cleanly
+// between frames returns io.EOF and other connection errors are returned
+// as they are; a malformed or cut-off frame is a *DecodeError. The payload
+// is only allocated once its length is known to be within MaxFrameSize.
+func ReadFrame(r io.Reader) (Frame, error) {
+	var hdr [5]byte
+	if n, err := io.ReadFull(r, hdr[:]); err != nil {
+		if n == 0 || err != io.ErrUnexpectedEOF {
+			return Frame{}, err
+		}
+		return Frame{}, &DecodeError{Message: "frame", Field: "header", Err: ErrTruncated}
+	}
+	f := Frame{Type: FrameType(hdr[0])}
+	n := binary.LittleEndian.Uint32(hdr[1:5])
+	if n > MaxFrameSize {
+		return Frame{}, &DecodeError{Message: f.Type.String() + " frame", Field: "length", Err: fmt.Errorf("%w: %d bytes", ErrTooLong, n)}
+	}
+	f.Payload = make([]byte, n)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = &DecodeError{Message: f.Type.String() + " frame", Field: "payload", Err: ErrTruncated}
+		}
+		return Frame{}, err
+	}
+	return f, nil
+}
+
+// CancelReason returns the reason given in a FrameCancel payload, cut to
+// MaxStatusLength and made printable.
+func CancelReason(payload []byte) string {
+	if len(payload) > MaxStatusLength {
+		payload = payload[:MaxStatusLength]
+	}
+	return printable(string(payload))
+}
+
+// FrameWriter serialises frames written from several goroutines, such as
+// the data loop and a cancel coming from the UI.
+type FrameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewFrameWriter returns a FrameWriter writing to w.
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w}
+}
+
+// Write sends one frame.
+func (fw *FrameWriter) Write(t FrameType, payload []byte) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return WriteFrame(fw.w, t, payload)
+}
@@ -0,0 +1,240 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Magic is the first thing written on every transfer connection. Anything
+// that does not start with it is not a ShareIt peer and gets dropped.
+var Magic = [4]byte{'S', 'H', 'R', 'T'}
+
+// ProtocolVersion is bumped whenever the wire format changes in a way older
+// builds cannot understand. Peers must speak exactly the same version.
+const ProtocolVersion uint16 = 12
+
+// NodeID identifies a ShareIt instance across connections.
+type NodeID [16]byte
+
+// NewNodeID returns a random (version 4) UUID.
+func NewNodeID() (NodeID, error) {
+	var id NodeID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, err
+	}
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id, nil
+}
+
+// ParseNodeID parses the canonical 8-4-4-4-12 form produced by String.
+func ParseNodeID(s string) (NodeID, error) {
+	var id NodeID
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return id, fmt.Errorf("invalid node id %q", s)
+	}
+	raw := s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+	if _, err := hex.Decode(id[:], []byte(raw)); err != nil {
+		return id, fmt.Errorf("invalid node id %q: %w", s, err)
+	}
+	return id, nil
+}
+
+func (id NodeID) String() string {
+	h := hex.EncodeToString(id[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// Capabilities is a bitset of optional protocol features a peer supports.
+// Bits are allocated as optional features are added; the features used on a
+// connection are the intersection of both sides.
+type Capabilities uint32
+
+const (
+	CapGzip Capabilities = 1 << iota // Can decode gzip-compressed data streams
+)
+
+// String names the features in c, e.g. "gzip", or "none".
+func (c Capabilities) String() string {
+	var names []string
+	if c.Has(CapGzip) {
+		names = append(names, "gzip")
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Has reports whether every bit in c2 is set in c.
+func (c Capabilities) Has(c2 Capabilities) bool {
+	return c&c2 == c2
+}
+
+// Hello is the opening frame sent by the connecting side.
+type Hello struct {
+	Version      uint16
+	NodeID       NodeID
+	Capabilities Capabilities
+}
+
+// HandshakeStatus is the receiver's verdict on a Hello.
+type HandshakeStatus uint8
+
+const (
+	HandshakeOK HandshakeStatus = iota
+	HandshakeVersionMismatch
+	HandshakeBusy // The receiver has too many connections open; try again later
+)
+
+func (s HandshakeStatus) String() string {
+	switch s {
+	case HandshakeOK:
+		return "ok"
+	case HandshakeVersionMismatch:
+		return "incompatible protocol version"
+	case HandshakeBusy:
+		return "busy"
+	default:
+		return fmt.Sprintf("unknown status %d", uint8(s))
+	}
+}
+
+// HelloAck is the receiver's answer to a Hello. It always carries the
+// receiver's own version so the sender can say what it was talking to.
+type HelloAck struct {
+	Status       HandshakeStatus
+	Version      uint16
+	NodeID       NodeID
+	Capabilities Capabilities
+}
+
+// ErrBadMagic is returned, wrapped in a *DecodeError, when a connection
+// does not start with Magic.
+var ErrBadMagic = errors.New("not a shareit connection (bad magic)")
+
+// ErrBusy is returned by both sides of a handshake the receiver turned away
+// because it had too many connections open.
+var ErrBusy = errors.New("peer busy, try again later")
+
+// VersionError reports a handshake between incompatible protocol versions.
+type VersionError struct {
+	Local  uint16
+	Remote uint16
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("incompatible protocol version: local v%d, remote v%d", e.Local, e.Remote)
+}
+
+// WriteHello writes the magic bytes followed by h.
+func WriteHello(w io.Writer, h Hello) error {
+	var buf [4 + 2 + 16 + 4]byte
+	copy(buf[0:4], Magic[:])
+	binary.LittleEndian.PutUint16(buf[4:6], h.Version)
+	copy(buf[6:22], h.NodeID[:])
+	binary.LittleEndian.PutUint32(buf[22:26], uint32(h.Capabilities))
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// ReadHello reads a Hello, failing with ErrBadMagic if the stream is not
+// ours.
+func ReadHello(r io.Reader) (Hello, error) {
+	d := newDecoder(r, "hello")
+	var magic [4]byte
+	d.full("magic", magic[:])
+	if d.err == nil && magic != Magic {
+		d.fail("magic", ErrBadMagic)
+	}
+	var h Hello
+	h.Version = d.uint16("version")
+	d.full("node id", h.NodeID[:])
+	h.Capabilities = Capabilities(d.uint32("capabilities"))
+	if d.err != nil {
+		return Hello{}, d.err
+	}
+	return h, nil
+}
+
+// WriteHelloAck writes the receiver's answer to a Hello.
+func WriteHelloAck(w io.Writer, a HelloAck) error {
+	var buf [1 + 2 + 16 + 4]byte
+	buf[0] = byte(a.Status)
+	binary.LittleEndian.PutUint16(buf[1:3], a.Version)
+	copy(buf[3:19], a.NodeID[:])
+	binary.LittleEndian.PutUint32(buf[19:23], uint32(a.Capabilities))
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// ReadHelloAck reads the receiver's answer to a Hello. A status this build
+// does not know is left for ClientHandshake to refuse.
+func ReadHelloAck(r io.Reader) (HelloAck, error) {
+	d := newDecoder(r, "hello ack")
+	a := HelloAck{
+		Status:  HandshakeStatus(d.uint8("status")),
+		Version: d.uint16("version"),
+	}
+	d.full("node id", a.NodeID[:])
+	a.Capabilities = Capabilities(d.uint32("capabilities"))
+	if d.err != nil {
+		return HelloAck{}, d.err
+	}
+	return a, nil
+}
+
+// ClientHandshake performs the connecting side of the handshake and returns
+// the peer's answer. A *VersionError is returned if the peer refused us.
+func ClientHandshake(rw io.ReadWriter, local Hello) (HelloAck, error) {
+	if err := WriteHello(rw, local); err != nil {
+		return HelloAck{}, fmt.Errorf("sending hello: %w", err)
+	}
+	ack, err := ReadHelloAck(rw)
+	if err != nil {
+		return HelloAck{}, fmt.Errorf("reading hello ack: %w", err)
+	}
+	if ack.Status == HandshakeVersionMismatch || ack.Version != local.Version {
+		return ack, &VersionError{Local: local.Version, Remote: ack.Version}
+	}
+	if ack.Status == HandshakeBusy {
+		return ack, ErrBusy
+	}
+	if ack.Status != HandshakeOK {
+		return ack, fmt.Errorf("handshake refused: %s", ack.Status)
+	}
+	return ack, nil
+}
+
+// ServerHandshake performs the accepting side of the handshake. Connections
+// with a different protocol version are told so before a *VersionError is
+// returned, so the sender can report it instead of seeing a reset. If
+// local.Status is HandshakeBusy the peer is turned away with it and ErrBusy
+// is returned.
+func ServerHandshake(rw io.ReadWriter, local HelloAck) (Hello, error) {
+	hello, err := ReadHello(rw)
+	if err != nil {
+		return Hello{}, err
+	}
+	if local.Status != HandshakeBusy {
+		local.Status = HandshakeOK
+	}
+	if hello.Version != local.Version {
+		local.Status = HandshakeVersionMismatch
+	}
+	if err := WriteHelloAck(rw, local); err != nil {
+		return hello, fmt.Errorf("sending hello ack: %w", err)
+	}
+	if local.Status == HandshakeVersionMismatch {
+		return hello, &VersionError{Local: local.Version, Remote: hello.Version}
+	}
+	if local.Status == HandshakeBusy {
+		return hello, ErrBusy
+	}
+	return hello, nil
+}
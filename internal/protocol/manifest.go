@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// OfferKind says what an Offer describes.
+type OfferKind uint8
+
+const (
+	KindFile OfferKind = iota
+	KindDirectory
+)
+
+// maxManifestEntries bounds how many entries a directory offer may list.
+const maxManifestEntries = 1 << 20
+
+// ManifestEntry describes one file or directory inside an offered directory.
+// Path is relative to the offered directory and always uses '/'.
+type ManifestEntry struct {
+	Path    string
+	Size    int64
+	Mode    uint32 // Permission bits (fs.FileMode & fs.ModePerm)
+	ModTime time.Time
+	IsDir   bool
+}
+
+// Manifest follows a KindDirectory Offer and lists the whole tree. File data
+// is then streamed in manifest order, with directories contributing none.
+type Manifest struct {
+	Entries []ManifestEntry
+}
+
+// WriteManifest writes m to w.
+func WriteManifest(w io.Writer, m Manifest) error {
+	if len(m.Entries) > maxManifestEntries {
+		return fmt.Errorf("manifest has %d entries, limit is %d", len(m.Entries), maxManifestEntries)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(m.Entries))); err != nil {
+		return err
+	}
+	for _, e := range m.Entries {
+		if err := writeString(w, "path", e.Path, MaxPathLength); err != nil {
+			return err
+		}
+		if e.Size < 0 {
+			return fmt.Errorf("manifest entry %q size %w: %d", e.Path, ErrNegative, e.Size)
+		}
+		var isDir uint8
+		if e.IsDir {
+			isDir = 1
+		}
+		fields := []any{e.Size, e.Mode, e.ModTime.UnixNano(), isDir}
+		for _, f := range fields {
+			if err := binary.Write(w, binary.LittleEndian, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadManifest reads a Manifest from r. Entries are allocated as they
+// arrive, so a bogus count costs no more memory than the entries really sent.
+func ReadManifest(r io.Reader) (Manifest, error) {
+	var m Manifest
+	d := newDecoder(r, "manifest")
+	n := d.uint32("entry count")
+	if d.err == nil && n > maxManifestEntries {
+		d.fail("entry count", fmt.Errorf("%w: %d entries, limit is %d", ErrTooLong, n, maxManifestEntries))
+	}
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		e := ManifestEntry{
+			Path:    d.text("path", MaxPathLength),
+			Size:    d.size("size"),
+			Mode:    d.uint32("mode"),
+			ModTime: time.Unix(0, d.int64("mtime")),
+			IsDir:   d.uint8("is dir") != 0,
+		}
+		m.Entries = append(m.Entries, e)
+	}
+	if d.err != nil {
+		return Manifest{}, d.err
+	}
+	return m, nil
+}
@@ -0,0 +1,230 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Offer is sent after the handshake to ask the receiver to take a file or a
+// directory. Nothing is written on the receiving side until it has been
+// answered. For a directory, Size is the total of all files in it and a
+// Manifest follows immediately. Mode and ModTime are those of the file or
+// top-level directory itself.
+type Offer struct {
+	Name       string
+	Size       int64
+	SenderName string
+	Kind       OfferKind
+	Mode       uint32 // Permission bits (fs.FileMode & fs.ModePerm)
+	ModTime    time.Time
+}
+
+// Decision is the receiver's verdict on an Offer.
+type Decision uint8
+
+const (
+	DecisionReject Decision = iota
+	DecisionAccept
+	DecisionQueued // Not yet: the receiver is at its limit and answers again later
+)
+
+func (d Decision) String() string {
+	switch d {
+	case DecisionReject:
+		return "rejected"
+	case DecisionAccept:
+		return "accepted"
+	case DecisionQueued:
+		return "queued"
+	default:
+		return fmt.Sprintf("unknown decision %d", uint8(d))
+	}
+}
+
+// RejectReason says why an Offer was rejected, so the sender can show it.
+type RejectReason uint8
+
+const (
+	ReasonDeclined   RejectReason = iota // The user said no or did not answer
+	ReasonNotAllowed                     // The receiver does not take files from this device
+	ReasonInvalid                        // Unusable name or manifest
+	ReasonExists                         // Already there and the receiver skips existing files
+	ReasonTooLarge                       // A file is over the receiver's size limit
+	ReasonQuota                          // The download directory would go over its quota
+	ReasonNoSpace                        // Not enough free disk space
+	ReasonError                          // The receiver could not prepare the download
+	ReasonBusy                           // The receiver's queue is full; try again later
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case ReasonDeclined:
+		return "declined"
+	case ReasonNotAllowed:
+		return "not accepted from this device"
+	case ReasonInvalid:
+		return "invalid offer"
+	case ReasonExists:
+		return "already exists"
+	case ReasonTooLarge:
+		return "file too large"
+	case ReasonQuota:
+		return "download quota exceeded"
+	case ReasonNoSpace:
+		return "not enough disk space"
+	case ReasonError:
+		return "receiver error"
+	case ReasonBusy:
+		return "receiver busy"
+	default:
+		return fmt.Sprintf("reason(%d)", uint8(r))
+	}
+}
+
+// Answer is the receiver's reply to an Offer. Name is what the file will be
+// saved as, which differs from the offered name if the user renamed it.
+// Reason is only meaningful for a rejection.
+//
+// While the receiver is running as many transfers as it allows, it answers
+// DecisionQueued with the offer's Position in its queue, as often as the
+// position changes and at least every few seconds, before the final Answer.
+//
+// If the receiver already holds the start of the file from an interrupted
+// transfer, Offset is how many bytes it has and PrefixHash is their SHA-256.
+// The sender checks the hash against its own copy and replies with Start.
+type Answer struct {
+	Decision   Decision
+	Reason     RejectReason
+	Position   uint16 // 1 for the next offer to go ahead
+	Name       string
+	Offset     int64
+	PrefixHash [32]byte
+}
+
+// Start is the sender's reply to an accepted Answer: the byte offset the data
+// stream begins at, which is either 0 or the Answer's Offset, and how the
+// data is encoded. The sender only picks a Codec the receiver advertised.
+type Start struct {
+	Offset int64
+	Codec  Codec
+}
+
+// Codec is how the bytes in Data frames are encoded.
+type Codec uint8
+
+const (
+	CodecNone Codec = iota // Raw file bytes
+	CodecGzip              // One gzip stream, flushed at the end of every frame
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	default:
+		return fmt.Sprintf("codec(%d)", uint8(c))
+	}
+}
+
+// WriteOffer writes o to w.
+func WriteOffer(w io.Writer, o Offer) error {
+	if o.Size < 0 {
+		return fmt.Errorf("offer size %w: %d", ErrNegative, o.Size)
+	}
+	if err := writeString(w, "name", o.Name, MaxNameLength); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, o.Size); err != nil {
+		return err
+	}
+	if err := writeString(w, "sender name", o.SenderName, MaxNameLength); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{byte(o.Kind)}); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, o.Mode); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, o.ModTime.UnixNano())
+}
+
+// ReadOffer reads an Offer from r.
+func ReadOffer(r io.Reader) (Offer, error) {
+	d := newDecoder(r, "offer")
+	o := Offer{
+		Name:       d.text("name", MaxNameLength),
+		Size:       d.size("size"),
+		SenderName: d.text("sender name", MaxNameLength),
+		Kind:       OfferKind(d.uint8("kind")),
+	}
+	if d.err == nil && o.Kind != KindFile && o.Kind != KindDirectory {
+		d.fail("kind", fmt.Errorf("%w %d", ErrUnknown, o.Kind))
+	}
+	o.Mode = d.uint32("mode")
+	o.ModTime = time.Unix(0, d.int64("mtime"))
+	if d.err != nil {
+		return Offer{}, d.err
+	}
+	return o, nil
+}
+
+// WriteAnswer writes a to w.
+func WriteAnswer(w io.Writer, a Answer) error {
+	if _, err := w.Write([]byte{byte(a.Decision), byte(a.Reason)}); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, a.Position); err != nil {
+		return err
+	}
+	if err := writeString(w, "name", a.Name, MaxNameLength); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, a.Offset); err != nil {
+		return err
+	}
+	_, err := w.Write(a.PrefixHash[:])
+	return err
+}
+
+// ReadAnswer reads an Answer from r.
+func ReadAnswer(r io.Reader) (Answer, error) {
+	d := newDecoder(r, "answer")
+	a := Answer{
+		Decision: Decision(d.uint8("decision")),
+		Reason:   RejectReason(d.uint8("reason")),
+		Position: d.uint16("position"),
+		Name:     d.text("name", MaxNameLength),
+		Offset:   d.size("offset"),
+	}
+	d.full("prefix hash", a.PrefixHash[:])
+	if d.err != nil {
+		return Answer{}, d.err
+	}
+	return a, nil
+}
+
+// WriteStart writes s to w.
+func WriteStart(w io.Writer, s Start) error {
+	return binary.Write(w, binary.LittleEndian, s)
+}
+
+// ReadStart reads a Start from r.
+func ReadStart(r io.Reader) (Start, error) {
+	d := newDecoder(r, "start")
+	s := Start{
+		Offset: d.size("offset"),
+		Codec:  Codec(d.uint8("codec")),
+	}
+	if d.err == nil && s.Codec != CodecNone && s.Codec != CodecGzip {
+		d.fail("codec", fmt.Errorf("%w %d", ErrUnknown, s.Codec))
+	}
+	if d.err != nil {
+		return Start{}, d.err
+	}
+	return s, nil
+}
@@ -0,0 +1,186 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// RequestKind is sent before each request on a connection and says what
+// follows it.
+type RequestKind uint8
+
+const (
+	RequestOffer RequestKind = iota + 1 // An Offer
+	RequestPair                         // A PairRequest
+)
+
+// WriteRequest writes k to w.
+func WriteRequest(w io.Writer, k RequestKind) error {
+	_, err := w.Write([]byte{byte(k)})
+	return err
+}
+
+// ReadRequest reads a RequestKind from r. A connection closed cleanly
+// before it returns io.EOF.
+func ReadRequest(r io.Reader) (RequestKind, error) {
+	d := newDecoder(r, "request")
+	k := RequestKind(d.uint8("kind"))
+	if errors.Is(d.err, ErrTruncated) {
+		return 0, io.EOF // Nothing was read, so nothing was cut short
+	}
+	if d.err == nil && k != RequestOffer && k != RequestPair {
+		d.fail("kind", fmt.Errorf("%w %d", ErrUnknown, k))
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return k, nil
+}
+
+// Auth follows the handshake in both directions. A peer we have paired with
+// proves it still holds the pairing key; Proof is zero otherwise.
+type Auth struct {
+	Paired bool
+	Proof  [32]byte
+}
+
+// WriteAuth writes a to w.
+func WriteAuth(w io.Writer, a Auth) error {
+	var buf [33]byte
+	if a.Paired {
+		buf[0] = 1
+	}
+	copy(buf[1:], a.Proof[:])
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// ReadAuth reads an Auth from r.
+func ReadAuth(r io.Reader) (Auth, error) {
+	d := newDecoder(r, "auth")
+	paired := d.uint8("paired")
+	if d.err == nil && paired > 1 {
+		d.fail("paired", fmt.Errorf("%w %d", ErrUnknown, paired))
+	}
+	a := Auth{Paired: paired == 1}
+	d.full("proof", a.Proof[:])
+	if d.err != nil {
+		return Auth{}, d.err
+	}
+	return a, nil
+}
+
+// PairRequest asks the receiving device to pair. The initiator shows a code
+// to its user; Share is its SPAKE2 share derived from that code.
+type PairRequest struct {
+	DeviceName string
+	Share      []byte
+}
+
+// PairStatus is how far a pairing got.
+type PairStatus uint8
+
+const (
+	PairOK        PairStatus = iota // The codes matched
+	PairDeclined                    // The user would not enter a code
+	PairWrongCode                   // Key confirmation failed
+)
+
+func (s PairStatus) String() string {
+	switch s {
+	case PairOK:
+		return "paired"
+	case PairDeclined:
+		return "declined"
+	case PairWrongCode:
+		return "wrong code"
+	default:
+		return fmt.Sprintf("unknown pair status %d", uint8(s))
+	}
+}
+
+// PairReply carries the responder's share and its key confirmation once its
+// user has typed the code in. Share and Confirm are empty unless Status is
+// PairOK.
+type PairReply struct {
+	Status     PairStatus
+	DeviceName string
+	Share      []byte
+	Confirm    [32]byte
+}
+
+// PairConfirm is the initiator's key confirmation, or its verdict on the
+// responder's if that failed.
+type PairConfirm struct {
+	Status  PairStatus
+	Confirm [32]byte
+}
+
+// WritePairRequest writes q to w.
+func WritePairRequest(w io.Writer, q PairRequest) error {
+	if err := writeString(w, "device name", q.DeviceName, MaxNameLength); err != nil {
+		return err
+	}
+	return writeString(w, "share", string(q.Share), maxShareLength)
+}
+
+// ReadPairRequest reads a PairRequest from r.
+func ReadPairRequest(r io.Reader) (PairRequest, error) {
+	d := newDecoder(r, "pair request")
+	q := PairRequest{
+		DeviceName: d.text("device name", MaxNameLength),
+		Share:      []byte(d.string("share", maxShareLength)),
+	}
+	if d.err != nil {
+		return PairRequest{}, d.err
+	}
+	return q, nil
+}
+
+// WritePairReply writes a to w.
+func WritePairReply(w io.Writer, a PairReply) error {
+	if _, err := w.Write([]byte{byte(a.Status)}); err != nil {
+		return err
+	}
+	if err := writeString(w, "device name", a.DeviceName, MaxNameLength); err != nil {
+		return err
+	}
+	if err := writeString(w, "share", string(a.Share), maxShareLength); err != nil {
+		return err
+	}
+	_, err := w.Write(a.Confirm[:])
+	return err
+}
+
+// ReadPairReply reads a PairReply from r.
+func ReadPairReply(r io.Reader) (PairReply, error) {
+	d := newDecoder(r, "pair reply")
+	a := PairReply{
+		Status:     PairStatus(d.uint8("status")),
+		DeviceName: d.text("device name", MaxNameLength),
+		Share:      []byte(d.string("share", maxShareLength)),
+	}
+	d.full("confirm", a.Confirm[:])
+	if d.err != nil {
+		return PairReply{}, d.err
+	}
+	return a, nil
+}
+
+// WritePairConfirm writes c to w.
+func WritePairConfirm(w io.Writer, c PairConfirm) error {
+	return binary.Write(w, binary.LittleEndian, c)
+}
+
+// ReadPairConfirm reads a PairConfirm from r.
+func ReadPairConfirm(r io.Reader) (PairConfirm, error) {
+	d := newDecoder(r, "pair confirm")
+	c := PairConfirm{Status: PairStatus(d.uint8("status"))}
+	d.full("confirm", c.Confirm[:])
+	if d.err != nil {
+		return PairConfirm{}, d.err
+	}
+	return c, nil
+}
@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Trailer follows the file data and carries the SHA-256 of the whole file,
+// including any prefix the receiver already held from a resumed transfer.
+type Trailer struct {
+	SHA256 [32]byte
+}
+
+// StatusCode is the receiver's verdict on a completed transfer.
+type StatusCode uint8
+
+const (
+	StatusOK StatusCode = iota
+	StatusHashMismatch
+	StatusIOError
+)
+
+func (c StatusCode) String() string {
+	switch c {
+	case StatusOK:
+		return "verified"
+	case StatusHashMismatch:
+		return "hash mismatch"
+	case StatusIOError:
+		return "i/o error"
+	default:
+		return fmt.Sprintf("unknown status %d", uint8(c))
+	}
+}
+
+// Status is sent by the receiver once it has checked a Trailer. Message
+// carries extra detail for the sender's UI and may be empty; it is at most
+// MaxStatusLength bytes.
+type Status struct {
+	Code    StatusCode
+	Message string
+}
+
+// Err returns nil for StatusOK and a descriptive error otherwise.
+func (s Status) Err() error {
+	if s.Code == StatusOK {
+		return nil
+	}
+	if s.Message != "" {
+		return fmt.Errorf("%s: %s", s.Code, s.Message)
+	}
+	return fmt.Errorf("%s", s.Code)
+}
+
+// TrailerFrame encodes t as the payload of a FrameTrailer.
+func TrailerFrame(t Trailer) []byte {
+	return t.SHA256[:]
+}
+
+// ParseTrailer decodes the payload of a FrameTrailer.
+func ParseTrailer(payload []byte) (Trailer, error) {
+	d := newDecoder(bytes.NewReader(payload), "trailer")
+	var t Trailer
+	d.full("sha256", t.SHA256[:])
+	d.end("sha256")
+	if d.err != nil {
+		return Trailer{}, d.err
+	}
+	return t, nil
+}
+
+// MaxStatusLength bounds a Status message, in bytes.
+const MaxStatusLength = 512
+
+// StatusFrame encodes s as the payload of a FrameStatus, cutting a message
+// over MaxStatusLength short.
+func StatusFrame(s Status) []byte {
+	msg := s.Message
+	if len(msg) > MaxStatusLength {
+		msg = strings.ToValidUTF8(msg[:MaxStatusLength], "")
+	}
+	return append([]byte{byte(s.Code)}, msg...)
+}
+
+// ParseStatus decodes the payload of a FrameStatus. The message is made
+// printable, as for other text from a peer.
+func ParseStatus(payload []byte) (Status, error) {
+	d := newDecoder(bytes.NewReader(payload), "status")
+	s := Status{
+		Code:    StatusCode(d.uint8("code")),
+		Message: printable(d.rest("message", MaxStatusLength)),
+	}
+	if d.err != nil {
+		return Status{}, d.err
+	}
+	return s, nil
+}
@@ -0,0 +1,121 @@
+// Package ratelimit caps how fast transfers move bytes with a token bucket.
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minBurst lets at least one 64 KiB chunk through without waiting, however
+// low the rate.
+const minBurst = 64 * 1024
+
+// Limiter is a token bucket that any number of transfers can share. A rate
+// of 0 means unlimited. The zero value and a nil *Limiter are unlimited.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64   // Bytes per second
+	tokens float64 // Goes negative when a write borrows against the future
+	last   time.Time
+}
+
+// New returns a limiter allowing rate bytes per second.
+func New(rate int64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the limit, taking effect for the next Wait.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.rate > 0 {
+		l.refill(now)
+	} else {
+		l.tokens = 0
+	}
+	l.last = now
+	l.rate = max(rate, 0)
+}
+
+// Rate returns the limit in bytes per second, 0 if unlimited.
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Wait blocks until n more bytes fit under the limit, or done is closed.
+func (l *Limiter) Wait(n int, done <-chan struct{}) {
+	if l == nil {
+		return
+	}
+	wait := l.reserve(n, time.Now())
+	if wait <= 0 {
+		return
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-done:
+	}
+}
+
+// reserve takes n tokens at time now and returns how long the caller must
+// wait before they are earned.
+func (l *Limiter) reserve(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	l.refill(now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// refill adds the tokens earned since the last call. The caller holds l.mu.
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	burst := max(float64(l.rate)/8, minBurst)
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+}
+
+// ParseRate reads a rate such as "500K", "10MB/s" or "1.5m". Units are
+// powers of 1024; a bare number is bytes per second. "0", "" and
+// "unlimited" mean no limit.
+func ParseRate(s string) (int64, error) {
+	t := strings.ToUpper(strings.TrimSpace(s))
+	if t == "" || t == "0" || t == "UNLIMITED" {
+		return 0, nil
+	}
+	t = strings.TrimSuffix(t, "/S")
+	t = strings.TrimSuffix(t, "B")
+	mult := 1.0
+	if n := len(t); n > 0 {
+		if i := strings.IndexByte("KMG", t[n-1]); i >= 0 {
+			mult = float64(int64(1) << (10 * (i + 1)))
+			t = t[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate %q (want e.g. 500K or 10MB/s)", s)
+	}
+	return int64(v * mult), nil
+}
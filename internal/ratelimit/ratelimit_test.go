@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	kib = 1024
+	mib = 1024 * kib
+)
+
+func TestReserve(t *testing.T) {
+	type step struct {
+		at   time.Duration // Since the limiter was created
+		n    int
+		wait time.Duration
+	}
+	for _, tc := range []struct {
+		name  string
+		rate  int64
+		steps []step
+	}{
+		{"unlimited", 0, []step{{0, 1 << 30, 0}, {0, 1 << 30, 0}}},
+		{"fresh limiter has no tokens", mib, []step{{0, 64 * kib, 62500 * time.Microsecond}}},
+		{"burst after idle", mib, []step{{10 * time.Second, 128 * kib, 0}, {10 * time.Second, 64 * kib, 62500 * time.Microsecond}}},
+		{"idle time saves at most a burst", mib, []step{{time.Hour, 192 * kib, 62500 * time.Microsecond}}},
+		{"burst is at least minBurst", kib, []step{{time.Hour, minBurst, 0}, {time.Hour, kib, time.Second}}},
+		{"refill pays off debt", mib, []step{{0, 512 * kib, 500 * time.Millisecond}, {500 * time.Millisecond, 512 * kib, 500 * time.Millisecond}}},
+		{"debt adds up", mib, []step{{0, mib, time.Second}, {0, mib, 2 * time.Second}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := New(tc.rate)
+			start := l.last
+			for i, s := range tc.steps {
+				if got := l.reserve(s.n, start.Add(s.at)); got != s.wait {
+					t.Fatalf("step %d: reserving %d bytes at %v waits %v, want %v", i, s.n, s.at, got, s.wait)
+				}
+			}
+		})
+	}
+}
+
+// TestWaitUnderBothLimits checks that a transfer held to the global limit
+// and its own moves at the lower of the two.
+func TestWaitUnderBothLimits(t *testing.T) {
+	const total, chunk = 128 * kib, 16 * kib
+	for _, tc := range []struct {
+		name        string
+		global, own int64
+		want        time.Duration
+	}{
+		{"own limit lower", 2 * mib, 512 * kib, 250 * time.Millisecond},
+		{"global limit lower", 512 * kib, 2 * mib, 250 * time.Millisecond},
+		{"global unlimited", 0, 512 * kib, 250 * time.Millisecond},
+		{"nil own limit", 512 * kib, -1, 250 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			global := New(tc.global)
+			var own *Limiter
+			if tc.own >= 0 {
+				own = New(tc.own)
+			}
+			start := time.Now()
+			for range total / chunk {
+				global.Wait(chunk, nil)
+				own.Wait(chunk, nil)
+			}
+			// Timers only ever fire late, so the lower bound is tight.
+			if elapsed := time.Since(start); elapsed < tc.want || elapsed > 4*tc.want {
+				t.Errorf("moving %d bytes took %v, want about %v", total, elapsed, tc.want)
+			}
+		})
+	}
+}
+
+func TestWaitReturnsOnDone(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		close func(done chan struct{})
+	}{
+		{"already done", func(done chan struct{}) { close(done) }},
+		{"done while waiting", func(done chan struct{}) { time.AfterFunc(20*time.Millisecond, func() { close(done) }) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := New(kib)
+			done := make(chan struct{})
+			tc.close(done)
+			start := time.Now()
+			l.Wait(mib, done) // About 17 minutes at this rate
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("Wait returned after %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"unlimited", 0, true},
+		{"1000", 1000, true},
+		{"500K", 500 * kib, true},
+		{"10MB/s", 10 * mib, true},
+		{"1.5m", 3 * mib / 2, true},
+		{" 2 G ", 2 << 30, true},
+		{"-1K", 0, false},
+		{"fast", 0, false},
+		{"10T", 0, false},
+	} {
+		got, err := ParseRate(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d (ok %t)", tc.in, got, err, tc.want, tc.ok)
+		}
+	}
+}
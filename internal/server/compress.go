@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"shareIt/internal/protocol"
+)
+
+// localCapabilities are the optional features this build supports.
+const localCapabilities = protocol.CapGzip
+
+// sampleSize is how much of a source is test-compressed to decide whether
+// compressing the rest is worth the CPU.
+const sampleSize = 64 * 1024
+
+// minSavings is the fraction a sample must shrink by for compression to be
+// used. Video, images and archives rarely get there.
+const minSavings = 0.1
+
+// compressible reports whether the first block of r shrinks enough under
+// gzip. An empty or unreadable source is never compressed.
+func compressible(r io.Reader) bool {
+	sample, err := io.ReadAll(io.LimitReader(r, sampleSize))
+	if err != nil || len(sample) == 0 {
+		return false
+	}
+	var out bytes.Buffer
+	fw, _ := flate.NewWriter(&out, flate.BestSpeed) // Only fails on a bad level
+	fw.Write(sample)
+	fw.Close()
+	return float64(out.Len()) < float64(len(sample))*(1-minSavings)
+}
+
+// compressor turns the chunks of one transfer into a single gzip stream,
+// flushed after every chunk so each Data frame can be decoded on arrival.
+type compressor struct {
+	buf bytes.Buffer
+	zw  *gzip.Writer
+}
+
+func newCompressor() *compressor {
+	c := &compressor{}
+	c.zw, _ = gzip.NewWriterLevel(&c.buf, gzip.BestSpeed) // Only fails on a bad level
+	return c
+}
+
+// compress returns the wire bytes for chunk. They are only valid until the
+// next call.
+func (c *compressor) compress(chunk []byte) ([]byte, error) {
+	c.buf.Reset()
+	if _, err := c.zw.Write(chunk); err != nil {
+		return nil, err
+	}
+	if err := c.zw.Flush(); err != nil {
+		return nil, err
+	}
+	return c.buf.Bytes(), nil
+}
+
+// close ends the stream and returns its last bytes, the gzip footer.
+func (c *compressor) close() ([]byte, error) {
+	c.buf.Reset()
+	if err := c.zw.Close(); err != nil {
+		return nil, err
+	}
+	return c.buf.Bytes(), nil
+}
+
+// gzipReader decodes a gzip data stream. The header is only read on the
+// first Read, so a cancel before any data arrives is handled like any other.
+type gzipReader struct {
+	r  io.Reader
+	zr *gzip.Reader
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	if g.zr == nil {
+		zr, err := gzip.NewReader(g.r)
+		if err != nil {
+			return 0, err
+		}
+		// The Trailer frame follows; there is never a second member.
+		zr.Multistream(false)
+		g.zr = zr
+	}
+	return g.zr.Read(p)
+}
+
+// end checks that the gzip stream, including its checksum, ends exactly
+// after the last byte of the offered data.
+func (g *gzipReader) end() error {
+	var extra [1]byte
+	n, err := g.Read(extra[:])
+	if n > 0 {
+		return errors.New("sender sent more data than it offered")
+	}
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
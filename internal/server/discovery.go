@@ -1,11 +1,19 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os/user"
+	"runtime"
+	"shareIt/internal/protocol"
 	"shareIt/internal/utils"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -17,41 +25,241 @@ import (
 
 const (
 	multicastAddr    = "239.0.0.1:9999"
-	messagePrefix    = "SHAREIT_DISCOVERY"
 	announceInterval = 2 * time.Second
 	peerTimeout      = 5 * time.Second
 )
 
-// AnnounceService remains the same as your version.
-func AnnounceService(myAddr string) {
-	message := fmt.Sprintf("%s|%s", messagePrefix, myAddr)
-	addr, err := net.ResolveUDPAddr("udp4", multicastAddr)
-	if err != nil {
-		log.Fatalf("Error resolving multicast address: %v", err)
+// discovered holds the peers found by every discovery mechanism.
+var discovered = newPeerTable()
+
+// mechanisms names the ways of finding peers that are running.
+var mechanisms struct {
+	sync.Mutex
+	names []string
+}
+
+// stops holds how to stop each discovery mechanism that is running.
+var stops struct {
+	sync.Mutex
+	funcs []func()
+}
+
+// StopDiscovery stops discovery on shutdown, letting peers know we are
+// leaving where the mechanism has a way to say so.
+func StopDiscovery() {
+	stops.Lock()
+	defer stops.Unlock()
+	for _, stop := range stops.funcs {
+		stop()
+	}
+	stops.funcs = nil
+}
+
+// discoveryStarted tells the UI that peers are now also found by name.
+func discoveryStarted(p *tea.Program, name string) {
+	mechanisms.Lock()
+	if !slices.Contains(mechanisms.names, name) {
+		mechanisms.names = append(mechanisms.names, name)
+		slices.Sort(mechanisms.names)
+	}
+	names := slices.Clone(mechanisms.names)
+	mechanisms.Unlock()
+	p.Send(utils.DiscoveryStatusMsg{Mechanisms: names})
+}
+
+// StartDiscovery announces this device, taking transfers on port, and
+// reports the peers it finds to p, using the mechanisms mode names.
+func StartDiscovery(p *tea.Program, port int, mode protocol.DiscoveryMode) {
+	ifaces := localInterfaces()
+	if len(ifaces) == 0 {
+		log.Printf("Warning: no usable network interface with an IPv4 address; discovery will find nothing")
+	}
+	for _, li := range ifaces {
+		for _, a := range li.addrs {
+			log.Printf("Using interface %s, address %s", li.Name, a)
+		}
 	}
-	conn, err := net.DialUDP("udp4", nil, addr)
+
+	if mode == protocol.DiscoveryMulticast || mode == protocol.DiscoveryBoth {
+		go ListenForPeers(p, port)
+	}
+	if mode == protocol.DiscoveryMDNS || mode == protocol.DiscoveryBoth {
+		go runMDNS(p, port)
+	}
+
+	// Goroutine to periodically prune stale peers that have timed out.
+	go func() {
+		for {
+			time.Sleep(peerTimeout)
+			if discovered.prune() {
+				p.Send(utils.PeersUpdatedMsg{Peers: discovered.list()})
+			}
+		}
+	}()
+}
+
+// localAnnouncement describes this device, taking transfers on port.
+func localAnnouncement(port int) protocol.Announcement {
+	a := protocol.Announcement{
+		NodeID:       opts.NodeID,
+		Protocol:     protocol.ProtocolVersion,
+		Port:         uint16(port),
+		Capabilities: localCapabilities,
+		DeviceName:   clip(opts.DeviceName, protocol.MaxNameLength),
+		Username:     clip(localUsername(), protocol.MaxInfoLength),
+		OS:           runtime.GOOS,
+		AppVersion:   clip(opts.AppVersion, protocol.MaxInfoLength),
+	}
+	// Peers learn our certificate fingerprint up front, so a changed key
+	// shows up before anyone tries to send.
+	hex.Decode(a.Fingerprint[:], []byte(localFingerprint()))
+	return a
+}
+
+// localUsername is the name of the user running ShareIt, without any
+// Windows domain.
+func localUsername() string {
+	u, err := user.Current()
 	if err != nil {
-		log.Fatalf("Error dialing multicast address: %v", err)
+		return ""
+	}
+	name := u.Username
+	if i := strings.LastIndexByte(name, '\\'); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// clip cuts s to at most n bytes without splitting a character.
+func clip(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
+
+// AnnounceService announces this device, taking transfers on port, to
+// group each announceInterval, or with broadcast set to the broadcast
+// address of each subnet at group's port. It sends from every local address
+// in turn, each out of its own interface, so every network we are on hears
+// of us from an address it can reach us at.
+func AnnounceService(port int, group *net.UDPAddr, broadcast bool) {
+	var message bytes.Buffer
+	if err := protocol.WriteAnnouncement(&message, localAnnouncement(port)); err != nil {
+		log.Fatalf("Error building announcement: %v", err)
 	}
-	defer conn.Close()
 
-	log.Printf("Starting to announce my address (%s) on %s", myAddr, multicastAddr)
+	log.Printf("Starting to announce port %d", port)
+	conns := make(map[string]*ipv4.PacketConn) // By local address; nil if it cannot be used
 	for {
-		_, err := conn.Write([]byte(message))
-		if err != nil {
-			log.Printf("Error sending announcement: %v", err)
+		live := make(map[string]bool)
+		for _, li := range localInterfaces() {
+			if broadcast && (li.Flags&net.FlagBroadcast) == 0 || !broadcast && (li.Flags&net.FlagMulticast) == 0 {
+				continue
+			}
+			for _, ipnet := range li.addrs {
+				local := ipnet.IP.String()
+				live[local] = true
+				conn, ok := conns[local]
+				if !ok {
+					conn = announceConn(li, ipnet.IP, broadcast)
+					conns[local] = conn
+				}
+				dst := group
+				if broadcast {
+					dst = &net.UDPAddr{IP: broadcastIP(ipnet), Port: group.Port}
+				}
+				if conn == nil || dst.IP == nil {
+					continue
+				}
+				if _, err := conn.WriteTo(message.Bytes(), nil, dst); err != nil {
+					log.Printf("Error sending announcement from %s to %s: %v", local, dst, err)
+				}
+			}
+		}
+		// Let go of addresses we no longer have.
+		for local, conn := range conns {
+			if !live[local] {
+				if conn != nil {
+					conn.Close()
+				}
+				delete(conns, local)
+			}
 		}
 		time.Sleep(announceInterval)
 	}
 }
 
-// ListenForPeers is updated to allow multiple listeners on the same port.
-func ListenForPeers(p *tea.Program, myAddr string) {
+// announceConn opens a socket for announcing from ip, out of li, or returns
+// nil if it cannot.
+func announceConn(li localInterface, ip net.IP, broadcast bool) *ipv4.PacketConn {
+	l, err := net.ListenPacket("udp4", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		log.Printf("Cannot announce from %s on %s: %v", ip, li.Name, err)
+		return nil
+	}
+	conn := ipv4.NewPacketConn(l)
+	if !broadcast {
+		if err := conn.SetMulticastInterface(&li.Interface); err != nil {
+			log.Printf("Cannot announce from %s on %s: %v", ip, li.Name, err)
+			conn.Close()
+			return nil
+		}
+	}
+	log.Printf("Announcing from %s on %s", ip, li.Name)
+	return conn
+}
+
+// ListenForPeers announces this device on multicastAddr and lists the peers
+// whose announcements arrive there. Our own announcement, for port, is not
+// listed. If no interface can join the group, it falls back to announcing by
+// broadcast on every subnet instead; the socket picks those up as well, as it
+// listens on all addresses.
+func ListenForPeers(p *tea.Program, port int) {
 	addr, err := net.ResolveUDPAddr("udp4", multicastAddr)
 	if err != nil {
 		log.Fatalf("Error resolving UDP addr for listener: %v", err)
 	}
+	packetConn, joined, err := listenMulticast(addr)
+	if err != nil {
+		log.Fatalf("Error listening for packets: %v", err)
+	}
+	defer packetConn.Close()
 
+	go AnnounceService(port, addr, !joined)
+	if joined {
+		discoveryStarted(p, "multicast")
+		log.Printf("Listening for peer announcements on %s", multicastAddr)
+	} else {
+		discoveryStarted(p, "broadcast")
+		log.Printf("Could not join multicast group on any suitable interface; using UDP broadcast on port %d instead", addr.Port)
+	}
+
+	// Main loop to listen for announcements.
+	buffer := make([]byte, protocol.MaxAnnouncementSize)
+	for {
+		n, _, src, err := packetConn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading from packet conn: %v", err)
+			continue
+		}
+		a, err := protocol.ReadAnnouncement(bytes.NewReader(buffer[:n]))
+		if err != nil {
+			continue // Not ours, or from an incompatible build
+		}
+		if udp, ok := src.(*net.UDPAddr); ok {
+			heardAnnouncement(p, a, udp.IP, port, 0)
+		}
+	}
+}
+
+// listenMulticast listens on group's port, sharing it with any other
+// program that does the same, and joins group on every usable interface
+// that can. joined is false if none could.
+func listenMulticast(group *net.UDPAddr) (conn *ipv4.PacketConn, joined bool, err error) {
 	// THE FIX: Use ListenConfig to set socket options before binding.
 	lc := net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
@@ -68,116 +276,82 @@ func ListenForPeers(p *tea.Program, myAddr string) {
 	}
 
 	// Use the ListenConfig to create the packet listener.
-	l, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf("0.0.0.0:%d", addr.Port))
+	l, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf("0.0.0.0:%d", group.Port))
 	if err != nil {
-		log.Fatalf("Error listening for packets: %v", err)
+		return nil, false, err
 	}
-	defer l.Close()
 
 	packetConn := ipv4.NewPacketConn(l)
-
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		log.Fatalf("Error getting network interfaces: %v", err)
-	}
-
-	var joined bool
-	for _, iface := range interfaces {
-		if (iface.Flags&net.FlagUp) == 0 || (iface.Flags&net.FlagMulticast) == 0 || (iface.Flags&net.FlagLoopback) != 0 {
+	for _, li := range localInterfaces() {
+		if (li.Flags & net.FlagMulticast) == 0 {
 			continue
 		}
-		if err := packetConn.JoinGroup(&iface, addr); err == nil {
-			log.Printf("Successfully joined multicast group on interface: %s", iface.Name)
+		if err := packetConn.JoinGroup(&li.Interface, group); err == nil {
+			log.Printf("Successfully joined multicast group %s on interface: %s", group.IP, li.Name)
 			joined = true
 			// We join on all suitable interfaces instead of just the first.
 		}
 	}
 
-	if !joined {
-		log.Printf("Warning: Could not join multicast group on any suitable interface. Discovery may not work.")
-	}
-
 	if err := packetConn.SetMulticastLoopback(true); err != nil {
 		log.Printf("Warning: could not enable multicast loopback: %v", err)
 	}
+	return packetConn, joined, nil
+}
 
-	log.Printf("Listening for peer announcements on %s", multicastAddr)
-	peers := make(map[string]time.Time)
-	var mu sync.Mutex
-
-	// Goroutine to periodically prune stale peers that have timed out.
-	go func() {
-		for {
-			time.Sleep(peerTimeout)
-			mu.Lock()
-			var changed bool
-			for peer, lastSeen := range peers {
-				if time.Since(lastSeen) > peerTimeout {
-					delete(peers, peer)
-					changed = true
-					log.Printf("Peer timed out and was removed: %s", peer)
-				}
-			}
-			if changed {
-				var currentPeers []string
-				for peer := range peers {
-					currentPeers = append(currentPeers, peer)
-				}
-				p.Send(utils.PeersUpdatedMsg{Peers: currentPeers})
-			}
-			mu.Unlock()
-		}
-	}()
-
-	// Main loop to listen for announcements.
-	buffer := make([]byte, 1024)
-	for {
-		n, _, _, err := packetConn.ReadFrom(buffer)
-		if err != nil {
-			log.Printf("Error reading from packet conn: %v", err)
-			continue
-		}
-
-		message := string(buffer[:n])
-		log.Printf("Received multicast message: \"%s\"", message)
+// heardAnnouncement lists the peer behind announcement a, which arrived from
+// ip, unless it is our own for port. Peers announce only their port; the
+// address is wherever the announcement came from, which is one we can reach
+// whatever other networks the peer is on. If the user picked interfaces,
+// announcements from outside their subnets are ignored. The peer is kept for
+// ttl, or until it misses a few announceIntervals if that is longer.
+func heardAnnouncement(p *tea.Program, a protocol.Announcement, ip net.IP, port int, ttl time.Duration) {
+	if a.NodeID == opts.NodeID && int(a.Port) == port {
+		return
+	}
+	if len(opts.Interfaces) > 0 && !onLocalNetwork(localInterfaces(), ip) {
+		return
+	}
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(a.Port)))
+	nodeID := a.NodeID.String()
+	checkAnnouncedKey(p, addr, nodeID, hex.EncodeToString(a.Fingerprint[:]))
+	details := utils.PeerDetails{
+		Name:       a.DeviceName,
+		Username:   a.Username,
+		OS:         a.OS,
+		AppVersion: a.AppVersion,
+		Features:   a.Capabilities.String(),
+		Compatible: a.Protocol == protocol.ProtocolVersion,
+	}
+	if discovered.heard(nodeID, addr, details, ttl) {
+		p.Send(utils.PeersUpdatedMsg{Peers: discovered.list()})
+	}
+}
 
-		if strings.HasPrefix(message, messagePrefix) {
-			parts := strings.Split(message, "|")
-			if len(parts) == 2 {
-				peerAddr := parts[1]
-				log.Printf("Discovered a potential peer: %s", peerAddr)
+// heardGoodbye drops the peer behind announcement a, which arrived from ip
+// saying it is leaving.
+func heardGoodbye(a protocol.Announcement, ip net.IP) {
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(a.Port)))
+	discovered.leaving(a.NodeID.String(), addr)
+}
 
-				if peerAddr == myAddr {
-					log.Printf("Ignoring own announcement from %s", myAddr)
-					continue
-				}
+// keyWarned remembers which announced fingerprints we already warned about.
+var keyWarned sync.Map // Address+fingerprint to struct{}
 
-				mu.Lock()
-				_, exists := peers[peerAddr]
-				peers[peerAddr] = time.Now()
-				if !exists {
-					log.Printf("New peer found: %s. Sending update to TUI.", peerAddr)
-					var currentPeers []string
-					for peer := range peers {
-						currentPeers = append(currentPeers, peer)
-					}
-					p.Send(utils.PeersUpdatedMsg{Peers: currentPeers})
-				}
-				mu.Unlock()
-			}
-		}
+// checkAnnouncedKey records the fingerprint a peer announces and warns if it
+// is not the one pinned for its node ID. Nothing is pinned from discovery
+// alone; that waits for a real TLS connection.
+func checkAnnouncedKey(p *tea.Program, addr, nodeID, fingerprint string) {
+	announced.Store(addr, announcement{nodeID: nodeID, fingerprint: fingerprint})
+	if opts.Trust == nil {
+		return
 	}
-}
-
-// GetOutboundIP remains the same.
-func GetOutboundIP() (string, error) {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		return "", err
+	pinned, ok := opts.Trust.Pinned(nodeID)
+	if !ok || pinned == fingerprint {
+		return
+	}
+	if _, seen := keyWarned.LoadOrStore(addr+"|"+fingerprint, struct{}{}); !seen {
+		log.Printf("WARNING: %s (node %s) announces certificate %s, which is not the one pinned for it", addr, nodeID, fingerprint)
+		p.Send(utils.PeerKeyChangedMsg{Addr: addr, NodeID: nodeID})
 	}
-	defer conn.Close()
-
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP.String(), nil
 }
-
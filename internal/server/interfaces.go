@@ -0,0 +1,108 @@
+package server
+
+import (
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// localInterface is a network interface discovery may use, with the IPv4
+// addresses on it that it may use.
+type localInterface struct {
+	net.Interface
+	addrs []*net.IPNet // Masks are 4 bytes long
+}
+
+// localInterfaces returns the interfaces that are up and have an IPv4
+// address, narrowed down to Options.Interfaces if set. Loopback is left out
+// unless it is picked by name or address.
+func localInterfaces() []localInterface {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("Error getting network interfaces: %v", err)
+		return nil
+	}
+	var usable []localInterface
+	for _, iface := range interfaces {
+		if (iface.Flags & net.FlagUp) == 0 {
+			continue
+		}
+		whole := selected(iface.Name) || len(opts.Interfaces) == 0 && (iface.Flags&net.FlagLoopback) == 0
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		li := localInterface{Interface: iface}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			if whole || selected(ipnet.IP.String()) {
+				li.addrs = append(li.addrs, &net.IPNet{IP: ipnet.IP.To4(), Mask: mask4(ipnet.Mask)})
+			}
+		}
+		if len(li.addrs) > 0 {
+			usable = append(usable, li)
+		}
+	}
+	return usable
+}
+
+// selected reports whether the user picked name, an interface name or
+// address, in Options.Interfaces.
+func selected(name string) bool {
+	return slices.ContainsFunc(opts.Interfaces, func(s string) bool { return strings.EqualFold(s, name) })
+}
+
+// mask4 returns the IPv4 part of a mask that may be in 16-byte form.
+func mask4(mask net.IPMask) net.IPMask {
+	if len(mask) == net.IPv6len {
+		return mask[12:]
+	}
+	return mask
+}
+
+// broadcastIP is the broadcast address of ipnet's subnet, or nil for a /31
+// or /32, which have no one to broadcast to.
+func broadcastIP(ipnet *net.IPNet) net.IP {
+	if ones, bits := ipnet.Mask.Size(); bits != 8*net.IPv4len || ones > 30 {
+		return nil
+	}
+	ip := make(net.IP, net.IPv4len)
+	for i := range ip {
+		ip[i] = ipnet.IP[i] | ^ipnet.Mask[i]
+	}
+	return ip
+}
+
+// onLocalNetwork reports whether ip is on the subnet of one of the
+// addresses in ifaces.
+func onLocalNetwork(ifaces []localInterface, ip net.IP) bool {
+	for _, li := range ifaces {
+		for _, a := range li.addrs {
+			if a.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// listenAddrs returns the local addresses to take transfers on at port:
+// all of them, unless the user picked interfaces, and then only the
+// addresses of those, so nothing on any other network can even connect.
+func listenAddrs(port int) []string {
+	if len(opts.Interfaces) == 0 {
+		return []string{net.JoinHostPort("0.0.0.0", strconv.Itoa(port))}
+	}
+	var addrs []string
+	for _, li := range localInterfaces() {
+		for _, a := range li.addrs {
+			addrs = append(addrs, net.JoinHostPort(a.IP.String(), strconv.Itoa(port)))
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestListenAddrs(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		interfaces []string
+		want       []string
+	}{
+		{"all", nil, []string{"0.0.0.0:9000"}},
+		{"picked", []string{"127.0.0.1"}, []string{"127.0.0.1:9000"}},
+		{"missing", []string{"192.0.2.250"}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withOptions(t, Options{Interfaces: tc.interfaces})
+			if got := listenAddrs(9000); !slices.Equal(got, tc.want) {
+				t.Errorf("listening on %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"shareIt/internal/protocol"
+	"shareIt/internal/utils"
+	"slices"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const (
+	// maxConnections caps incoming connections of every kind. Past it new
+	// ones are closed without a word, so a flood cannot use up goroutines
+	// or file descriptors.
+	maxConnections = 256
+	// maxQueued is how many offers may wait for a free transfer slot before
+	// further ones are turned away as busy.
+	maxQueued = 32
+	// Used when Options leaves the limits unset.
+	defaultMaxIncoming  = 4
+	defaultMaxPeerConns = 4
+)
+
+// maxIncoming is how many incoming transfers may run at once.
+func maxIncoming() int {
+	if opts.MaxIncoming > 0 {
+		return opts.MaxIncoming
+	}
+	return defaultMaxIncoming
+}
+
+// maxPeerConns is how many connections one address may have open at once.
+func maxPeerConns() int {
+	if opts.MaxPeerConns > 0 {
+		return opts.MaxPeerConns
+	}
+	return defaultMaxPeerConns
+}
+
+// connCounter counts open incoming connections, in total and per remote host.
+type connCounter struct {
+	mu     sync.Mutex
+	total  int
+	byHost map[string]int
+}
+
+// admit counts a new connection from host. It reports false if the
+// connection should be dropped at once, and busy if it may only be told
+// that the host already has too many open. Every admitted connection must be
+// released.
+func (c *connCounter) admit(host string) (busy, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.total >= maxConnections {
+		return false, false
+	}
+	if c.byHost == nil {
+		c.byHost = make(map[string]int)
+	}
+	c.total++
+	c.byHost[host]++
+	return c.byHost[host] > maxPeerConns(), true
+}
+
+func (c *connCounter) release(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total--
+	if c.byHost[host]--; c.byHost[host] == 0 {
+		delete(c.byHost, host)
+	}
+}
+
+// remoteHost is the address conn came from, without the port.
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// turnAway answers a connection's handshake with HandshakeBusy and hangs up.
+func turnAway(conn net.Conn) {
+	defer conn.Close()
+	setDeadline(conn, handshakeTimeout)
+	protocol.ServerHandshake(conn, protocol.HelloAck{
+		Status:       protocol.HandshakeBusy,
+		Version:      protocol.ProtocolVersion,
+		NodeID:       opts.NodeID,
+		Capabilities: localCapabilities,
+	})
+}
+
+// errQueueFull is returned by acquire when too many offers are already
+// waiting for a slot.
+var errQueueFull = errors.New("too many offers waiting")
+
+// transferSlots lets a limited number of incoming transfers run at once.
+// Offers past that wait their turn in the order they arrived.
+type transferSlots struct {
+	mu      sync.Mutex
+	running int
+	queue   []*queuedOffer
+}
+
+// queuedOffer is an offer waiting for a slot.
+type queuedOffer struct {
+	granted bool          // A finished transfer handed over its slot
+	wake    chan struct{} // Poked whenever the queue moves
+}
+
+// incoming holds the slots for transfers to this device.
+var incoming transferSlots
+
+// acquire takes a slot for an offer of label from peer, first waiting in
+// line if none is free. While it waits, the sender is sent a queued Answer
+// whenever its place changes and every protocol.KeepaliveInterval, and the offer is
+// shown in DOWNLOADS. The returned release must be called once the transfer
+// is over; an error means no slot was taken.
+func (s *transferSlots) acquire(conn net.Conn, p *tea.Program, label, peer string) (release func(), err error) {
+	s.mu.Lock()
+	if s.running < maxIncoming() && len(s.queue) == 0 {
+		s.running++
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	if len(s.queue) >= maxQueued {
+		s.mu.Unlock()
+		return nil, errQueueFull
+	}
+	q := &queuedOffer{wake: make(chan struct{}, 1)}
+	s.queue = append(s.queue, q)
+	s.mu.Unlock()
+
+	id := utils.NewTransferID()
+	row := utils.TransferQueuedMsg{ID: id, Filename: label, Direction: "Receiving", Peer: peer}
+	defer func() {
+		// The row makes way for the transfer's own, or goes away with it.
+		row.Position = 0
+		p.Send(row)
+	}()
+	tick := time.NewTicker(protocol.KeepaliveInterval)
+	defer tick.Stop()
+	last, due := 0, true
+	for {
+		s.mu.Lock()
+		granted, pos := q.granted, slices.Index(s.queue, q)+1
+		s.mu.Unlock()
+		if granted {
+			pos = 0 // Tells the sender an answer follows
+		}
+		if pos != last || due {
+			setDeadline(conn, handshakeTimeout)
+			if err := protocol.WriteAnswer(conn, protocol.Answer{Decision: protocol.DecisionQueued, Position: uint16(pos)}); err != nil {
+				s.leave(q)
+				return nil, err
+			}
+			if pos != last && pos > 0 {
+				row.Position = pos
+				p.Send(row)
+			}
+			last, due = pos, false
+		}
+		if granted {
+			return s.release, nil
+		}
+		select {
+		case <-q.wake:
+		case <-tick.C:
+			due = true
+		}
+	}
+}
+
+// release hands a finished transfer's slot to the first offer in line.
+func (s *transferSlots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		s.running--
+		return
+	}
+	next := s.queue[0]
+	next.granted = true
+	s.queue = s.queue[1:]
+	next.poke()
+	s.wakeAll()
+}
+
+// leave takes an offer whose sender went away out of line, passing on the
+// slot if it had just been given one.
+func (s *transferSlots) leave(q *queuedOffer) {
+	s.mu.Lock()
+	if q.granted {
+		s.mu.Unlock()
+		s.release()
+		return
+	}
+	defer s.mu.Unlock()
+	if i := slices.Index(s.queue, q); i >= 0 {
+		s.queue = slices.Delete(s.queue, i, i+1)
+		s.wakeAll()
+	}
+}
+
+// wakeAll pokes everyone still in line. s.mu must be held.
+func (s *transferSlots) wakeAll() {
+	for _, q := range s.queue {
+		q.poke()
+	}
+}
+
+func (q *queuedOffer) poke() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"shareIt/internal/protocol"
+	"testing"
+	"time"
+)
+
+func TestConnCounter(t *testing.T) {
+	withOptions(t, Options{MaxPeerConns: 2})
+	var c connCounter
+	type step struct {
+		release  bool
+		host     string
+		busy, ok bool
+	}
+	for i, s := range []step{
+		{host: "a", ok: true},
+		{host: "a", ok: true},
+		{host: "a", busy: true, ok: true}, // Admitted, but only to be told so
+		{host: "b", ok: true},             // Other hosts are unaffected
+		{release: true, host: "a"},
+		{release: true, host: "a"},
+		{host: "a", ok: true},
+		{release: true, host: "a"},
+		{release: true, host: "a"},
+		{release: true, host: "b"},
+	} {
+		if s.release {
+			c.release(s.host)
+			continue
+		}
+		if busy, ok := c.admit(s.host); busy != s.busy || ok != s.ok {
+			t.Fatalf("step %d: admit(%s) = %t, %t, want %t, %t", i, s.host, busy, ok, s.busy, s.ok)
+		}
+	}
+	if c.total != 0 || len(c.byHost) != 0 {
+		t.Fatalf("after releasing everything: total %d, by host %v", c.total, c.byHost)
+	}
+
+	// Past maxConnections even a new host is dropped outright.
+	for i := range maxConnections {
+		c.admit(net.IPv4(10, 0, byte(i>>8), byte(i)).String())
+	}
+	if busy, ok := c.admit("a"); busy || ok {
+		t.Errorf("admit over the cap = %t, %t, want false, false", busy, ok)
+	}
+	if c.total != maxConnections || c.byHost["a"] != 0 {
+		t.Errorf("a dropped connection was counted: total %d, a %d", c.total, c.byHost["a"])
+	}
+}
+
+// waiter is an offer queued for a slot, with the positions its sender was
+// told arriving on positions.
+type waiter struct {
+	sender    net.Conn
+	positions chan uint16
+	result    chan error
+	release   func()
+}
+
+func queueOffer(t *testing.T, s *transferSlots) *waiter {
+	t.Helper()
+	sender, receiver := net.Pipe()
+	t.Cleanup(func() { sender.Close() })
+	w := &waiter{sender: sender, positions: make(chan uint16, 8), result: make(chan error, 1)}
+	go func() {
+		for {
+			a, err := protocol.ReadAnswer(sender)
+			if err != nil {
+				return
+			}
+			w.positions <- a.Position
+		}
+	}()
+	p := runProgram(t, nil)
+	go func() {
+		var err error
+		w.release, err = s.acquire(receiver, p, "a.bin", "peer")
+		w.result <- err
+	}()
+	return w
+}
+
+// next waits for the next position the sender is told.
+func (w *waiter) next(t *testing.T) uint16 {
+	t.Helper()
+	select {
+	case pos := <-w.positions:
+		return pos
+	case <-time.After(time.Second):
+		t.Fatal("not told a position")
+		return 0
+	}
+}
+
+// expect waits for the sender to be told each of positions in turn.
+func (w *waiter) expect(t *testing.T, positions ...uint16) {
+	t.Helper()
+	for _, want := range positions {
+		if got := w.next(t); got != want {
+			t.Fatalf("told position %d, want %d", got, want)
+		}
+	}
+}
+
+// granted waits for the offer to be given a slot.
+func (w *waiter) granted(t *testing.T) {
+	t.Helper()
+	w.expect(t, 0)
+	if err := <-w.result; err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+}
+
+func (s *transferSlots) check(t *testing.T, running, queued int) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running != running || len(s.queue) != queued {
+		t.Errorf("%d running and %d queued, want %d and %d", s.running, len(s.queue), running, queued)
+	}
+}
+
+func TestTransferSlots(t *testing.T) {
+	withOptions(t, Options{MaxIncoming: 1})
+
+	t.Run("queue moves up", func(t *testing.T) {
+		var s transferSlots
+		first, err := s.acquire(nil, nil, "a.bin", "peer") // A free slot never touches the connection
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := queueOffer(t, &s)
+		b.expect(t, 1)
+		c := queueOffer(t, &s)
+		c.expect(t, 2)
+		s.check(t, 1, 2)
+
+		first()
+		b.granted(t)
+		c.expect(t, 1)
+		s.check(t, 1, 1)
+
+		b.release()
+		c.granted(t)
+		c.release()
+		s.check(t, 0, 0)
+	})
+
+	t.Run("sender leaves", func(t *testing.T) {
+		var s transferSlots
+		first, _ := s.acquire(nil, nil, "a.bin", "peer")
+		b := queueOffer(t, &s)
+		b.expect(t, 1)
+		c := queueOffer(t, &s)
+		c.expect(t, 2)
+
+		// b's sender hangs up, so the slot it is handed passes on to c.
+		b.sender.Close()
+		first()
+		if err := <-b.result; err == nil {
+			t.Fatal("acquire succeeded for a sender that left")
+		}
+		// c may or may not be told it is first in line before it is let in.
+		pos := c.next(t)
+		if pos == 1 {
+			pos = c.next(t)
+		}
+		if pos != 0 {
+			t.Fatalf("told position %d, want 0", pos)
+		}
+		if err := <-c.result; err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+		c.release()
+		s.check(t, 0, 0)
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		var s transferSlots
+		s.running = 1
+		for range maxQueued {
+			s.queue = append(s.queue, &queuedOffer{wake: make(chan struct{}, 1)})
+		}
+		if _, err := s.acquire(nil, nil, "a.bin", "peer"); !errors.Is(err, errQueueFull) {
+			t.Errorf("acquire = %v, want errQueueFull", err)
+		}
+		s.check(t, 1, maxQueued)
+	})
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"io/fs"
+	"log"
+	"path/filepath"
+	"shareIt/internal/protocol"
+)
+
+// buildManifest walks root and lists every directory and regular file under
+// it, returning the manifest and the total size of the files. Symlinks and
+// special files are skipped rather than followed.
+func buildManifest(root string) (protocol.Manifest, int64, error) {
+	var m protocol.Manifest
+	var total int64
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			log.Printf("Skipping %s: not a regular file", path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		e := protocol.ManifestEntry{
+			Path:    filepath.ToSlash(rel),
+			Mode:    uint32(info.Mode().Perm()),
+			ModTime: info.ModTime(),
+			IsDir:   d.IsDir(),
+		}
+		if !e.IsDir {
+			e.Size = info.Size()
+			total += e.Size
+		}
+		m.Entries = append(m.Entries, e)
+		return nil
+	})
+	return m, total, err
+}
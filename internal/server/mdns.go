@@ -0,0 +1,514 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"shareIt/internal/protocol"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	mdnsAddr = "224.0.0.251:5353"
+	// mdnsService is the DNS-SD service type ShareIt advertises and browses.
+	mdnsService = "_shareit._tcp.local."
+	// mdnsServices is where DNS-SD lists every service type on the link.
+	mdnsServices = "_services._dns-sd._udp.local."
+	mdnsTTL      = 120 // Seconds; peers heard over mDNS are kept this long
+	// cacheFlush in a record's class says it replaces any cached records
+	// of its name and type (RFC 6762 section 10.2).
+	cacheFlush = 1 << 15
+	// maxMDNSMessage is the largest mDNS message (RFC 6762 section 17).
+	maxMDNSMessage = 9000
+	// The browser's first two queries are a second apart, and the gap
+	// doubles after each (section 5.2), up to half the time a peer heard
+	// over mDNS is kept, so one whose announcements were all lost still
+	// turns up before it would have expired.
+	minBrowseInterval = time.Second
+	maxBrowseInterval = mdnsTTL * time.Second / 2
+)
+
+// mdnsConn is the socket on the mDNS port, shared by the responder and the
+// browser.
+type mdnsConn struct {
+	*ipv4.PacketConn
+	group *net.UDPAddr
+	done  chan struct{} // Closed by close
+
+	mu     sync.Mutex // Held while switching the outgoing interface
+	closed bool
+}
+
+// multicast sends b to the mDNS group out of every usable interface, so all
+// of our networks hear it, each from an address of its own. Once the socket
+// is closed it does nothing.
+func (c *mdnsConn) multicast(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.send(b)
+	}
+}
+
+// close multicasts goodbye, the last message to go out, and closes the
+// socket.
+func (c *mdnsConn) close(goodbye []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.send(goodbye)
+	c.closed = true
+	close(c.done)
+	c.PacketConn.Close()
+}
+
+// send is multicast without the check. c.mu must be held.
+func (c *mdnsConn) send(b []byte) {
+	for _, li := range localInterfaces() {
+		if (li.Flags & net.FlagMulticast) == 0 {
+			continue
+		}
+		if err := c.SetMulticastInterface(&li.Interface); err != nil {
+			continue
+		}
+		if _, err := c.WriteTo(b, nil, c.group); err != nil {
+			log.Printf("Error sending mDNS message on %s: %v", li.Name, err)
+		}
+	}
+}
+
+// mdnsResponder answers queries for this device's DNS-SD service.
+type mdnsResponder struct {
+	service  dnsmessage.Name // mdnsService
+	instance dnsmessage.Name // <node id>-<port>._shareit._tcp.local.
+	host     dnsmessage.Name // <node id>.local.
+	port     uint16
+	txt      []string // What localAnnouncement says, as a TXT record
+}
+
+// newMDNSResponder returns a responder for this device taking transfers on
+// port. A TXT string holds less than an announcement, so a device name too
+// long for one is cut short rather than keeping the device off mDNS.
+func newMDNSResponder(port int) (*mdnsResponder, error) {
+	a := localAnnouncement(port)
+	a.DeviceName = clip(a.DeviceName, protocol.MaxTXTNameLength)
+	txt, err := protocol.AnnouncementTXT(a)
+	if err != nil {
+		return nil, err
+	}
+	return &mdnsResponder{
+		service:  dnsmessage.MustNewName(mdnsService),
+		instance: dnsmessage.MustNewName(fmt.Sprintf("%s-%d.%s", opts.NodeID, port, mdnsService)),
+		host:     dnsmessage.MustNewName(opts.NodeID.String() + ".local."),
+		port:     uint16(port),
+		txt:      txt,
+	}, nil
+}
+
+// runMDNS advertises this device, taking transfers on port, as a DNS-SD
+// service and browses for others. It shares one socket on the mDNS port for
+// both, so it runs alongside any mDNS responder the system already has.
+func runMDNS(p *tea.Program, port int) {
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		log.Printf("Error resolving mDNS address: %v", err)
+		return
+	}
+	r, err := newMDNSResponder(port)
+	if err != nil {
+		log.Printf("Error building mDNS TXT record: %v", err)
+		return
+	}
+	pc, joined, err := listenMulticast(group)
+	if err != nil {
+		log.Printf("mDNS discovery is unavailable: %v", err)
+		return
+	}
+	defer pc.Close()
+	conn := &mdnsConn{PacketConn: pc, group: group, done: make(chan struct{})}
+	if !joined {
+		log.Printf("mDNS discovery is unavailable: could not join %s on any interface", group.IP)
+		return
+	}
+
+	log.Printf("Advertising and browsing for %s on %s", mdnsService, mdnsAddr)
+	discoveryStarted(p, "mDNS")
+	stops.Lock()
+	stops.funcs = append(stops.funcs, func() { conn.close(r.unsolicited(0)) })
+	stops.Unlock()
+	b := newMDNSBrowser(conn)
+	go b.run()
+	go r.announce(conn)
+
+	buffer := make([]byte, maxMDNSMessage)
+	for {
+		n, _, src, err := conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading mDNS message: %v", err)
+			continue
+		}
+		udp, ok := src.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buffer[:n]); err != nil {
+			continue
+		}
+		if msg.Response {
+			b.heard(msg)
+			heardMDNSResponse(p, msg, udp.IP, port)
+			continue
+		}
+		// Queries from anything but the mDNS port come from plain DNS
+		// resolvers, which only listen for a direct reply (section 6.7).
+		legacy := udp.Port != group.Port
+		reply := r.answer(msg, legacy)
+		switch {
+		case reply == nil:
+		case legacy:
+			if _, err := conn.WriteTo(reply, nil, udp); err != nil {
+				log.Printf("Error sending mDNS answer: %v", err)
+			}
+		default:
+			conn.multicast(reply)
+		}
+	}
+}
+
+// mdnsBrowser asks for every ShareIt service on the link, less often the
+// longer it runs, and again for each service it knows before that service's
+// records expire. The answers are multicast, so they reach the loop in
+// runMDNS, which hands them to heard.
+type mdnsBrowser struct {
+	conn    *mdnsConn
+	service dnsmessage.Name
+	wake    chan struct{} // Poked when a service is first heard of
+
+	mu    sync.Mutex
+	known map[string]knownService // By lower-case instance name
+}
+
+// knownService is a service instance another responder told us about.
+type knownService struct {
+	instance dnsmessage.Name
+	ttl      time.Duration
+	heard    time.Time
+}
+
+func newMDNSBrowser(conn *mdnsConn) *mdnsBrowser {
+	return &mdnsBrowser{
+		conn:    conn,
+		service: dnsmessage.MustNewName(mdnsService),
+		wake:    make(chan struct{}, 1),
+		known:   make(map[string]knownService),
+	}
+}
+
+// run sends queries until conn is closed: browsing ones starting
+// minBrowseInterval apart and doubling up to maxBrowseInterval, and in
+// between any needed to renew a known service.
+func (b *mdnsBrowser) run() {
+	interval, next := minBrowseInterval, time.Now()
+	var last time.Time // Of the last query sent
+	timer := time.NewTimer(0)
+	for {
+		b.mu.Lock()
+		due := next
+		for _, k := range b.known {
+			if at, ok := k.renewAt(last); ok && at.Before(due) {
+				due = at
+			}
+		}
+		b.mu.Unlock()
+		timer.Reset(time.Until(due))
+		select {
+		case <-timer.C:
+		case <-b.wake:
+			timer.Stop()
+			continue // Work out when it needs renewing
+		case <-b.conn.done:
+			timer.Stop()
+			return
+		}
+
+		now := time.Now()
+		if query, err := b.query(now); err != nil {
+			log.Printf("Error building mDNS query: %v", err)
+		} else {
+			b.conn.multicast(query)
+		}
+		last = now
+		if !now.Before(next) {
+			next = now.Add(interval)
+			interval = min(2*interval, maxBrowseInterval)
+		}
+	}
+}
+
+// renewAt is when to next ask about k so its records are renewed before
+// they expire: at 80, 85, 90 and 95% of their TTL (section 5.2), counting
+// only times after the last query.
+func (k knownService) renewAt(last time.Time) (time.Time, bool) {
+	for _, percent := range []time.Duration{80, 85, 90, 95} {
+		if at := k.heard.Add(k.ttl * percent / 100); at.After(last) {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// query builds a question for every ShareIt service, listing as known
+// answers the ones we heard of that have over half their TTL left, so their
+// responders can stay quiet (section 7.1). Expired services are forgotten.
+func (b *mdnsBrowser) query(now time.Time) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{
+			Name:  b.service,
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	b.mu.Lock()
+	for name, k := range b.known {
+		left := k.ttl - now.Sub(k.heard)
+		if left <= 0 {
+			delete(b.known, name)
+			continue
+		}
+		if left <= k.ttl/2 {
+			continue
+		}
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: b.service, Class: dnsmessage.ClassINET, TTL: uint32(left / time.Second)},
+			Body:   &dnsmessage.PTRResource{PTR: k.instance},
+		})
+	}
+	b.mu.Unlock()
+	return msg.Pack()
+}
+
+// heard notes the ShareIt services a response points to. A service heard
+// of for the first time wakes run to schedule its renewal.
+func (b *mdnsBrowser) heard(msg dnsmessage.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, rr := range append(msg.Answers, msg.Additionals...) {
+		ptr, ok := rr.Body.(*dnsmessage.PTRResource)
+		if !ok || !strings.EqualFold(rr.Header.Name.String(), mdnsService) {
+			continue
+		}
+		name := strings.ToLower(ptr.PTR.String())
+		if rr.Header.TTL == 0 {
+			delete(b.known, name) // Goodbye
+			continue
+		}
+		_, seen := b.known[name]
+		b.known[name] = knownService{
+			instance: ptr.PTR,
+			ttl:      time.Duration(rr.Header.TTL) * time.Second,
+			heard:    time.Now(),
+		}
+		if !seen {
+			select {
+			case b.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// answer builds the reply to query, or returns nil if none of its questions
+// are about us. A reply to a legacy query repeats its ID and questions.
+func (r *mdnsResponder) answer(query dnsmessage.Message, legacy bool) []byte {
+	var answers, additionals []dnsmessage.Resource
+	for _, q := range query.Questions {
+		all := q.Type == dnsmessage.TypeALL
+		switch name := q.Name.String(); {
+		case strings.EqualFold(name, mdnsServices) && (all || q.Type == dnsmessage.TypePTR):
+			answers = append(answers, r.record(q.Name, &dnsmessage.PTRResource{PTR: r.service}, false, legacy))
+		case strings.EqualFold(name, r.service.String()) && (all || q.Type == dnsmessage.TypePTR):
+			if r.known(query) {
+				continue
+			}
+			answers = append(answers, r.record(r.service, &dnsmessage.PTRResource{PTR: r.instance}, false, legacy))
+			additionals = append(additionals, r.srv(legacy), r.txtRecord(legacy))
+			additionals = append(additionals, r.addresses(legacy)...)
+		case strings.EqualFold(name, r.instance.String()):
+			if all || q.Type == dnsmessage.TypeSRV {
+				answers = append(answers, r.srv(legacy))
+				additionals = append(additionals, r.addresses(legacy)...)
+			}
+			if all || q.Type == dnsmessage.TypeTXT {
+				answers = append(answers, r.txtRecord(legacy))
+			}
+		case strings.EqualFold(name, r.host.String()) && (all || q.Type == dnsmessage.TypeA):
+			answers = append(answers, r.addresses(legacy)...)
+		}
+	}
+	if len(answers) == 0 {
+		return nil
+	}
+	reply := dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, Authoritative: true},
+		Answers:     answers,
+		Additionals: additionals,
+	}
+	if legacy {
+		reply.ID = query.ID
+		reply.Questions = query.Questions
+	}
+	b, err := reply.Pack()
+	if err != nil {
+		log.Printf("Error building mDNS answer: %v", err)
+		return nil
+	}
+	return b
+}
+
+// announce multicasts our records unasked, so browsers hear of us without
+// having to ask: twice, a second apart, on start (section 8.3), and again
+// whenever our addresses change. It returns once conn is closed.
+func (r *mdnsResponder) announce(conn *mdnsConn) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	var last []byte // What was last announced
+	left := 0       // Times it is still to be sent
+	for {
+		if msg := r.unsolicited(mdnsTTL); msg != nil && !bytes.Equal(msg, last) {
+			last, left = msg, 2
+		}
+		if left > 0 {
+			conn.multicast(last)
+			left--
+		}
+		select {
+		case <-tick.C:
+		case <-conn.done:
+			return
+		}
+	}
+}
+
+// unsolicited builds a response holding every record of our service, with
+// ttl seconds to live, or nil if it cannot. A ttl of zero says goodbye
+// (section 10.1).
+func (r *mdnsResponder) unsolicited(ttl uint32) []byte {
+	answers := []dnsmessage.Resource{
+		r.record(r.service, &dnsmessage.PTRResource{PTR: r.instance}, false, false),
+		r.srv(false),
+		r.txtRecord(false),
+	}
+	answers = append(answers, r.addresses(false)...)
+	for i := range answers {
+		answers[i].Header.TTL = ttl
+	}
+	msg := dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: answers,
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		log.Printf("Error building mDNS announcement: %v", err)
+		return nil
+	}
+	return b
+}
+
+// known reports whether query already lists our service with at least half
+// its TTL left, in which case we need not answer it (section 7.1).
+func (r *mdnsResponder) known(query dnsmessage.Message) bool {
+	for _, rr := range query.Answers {
+		ptr, ok := rr.Body.(*dnsmessage.PTRResource)
+		if ok && rr.Header.TTL >= mdnsTTL/2 &&
+			strings.EqualFold(rr.Header.Name.String(), r.service.String()) &&
+			strings.EqualFold(ptr.PTR.String(), r.instance.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *mdnsResponder) srv(legacy bool) dnsmessage.Resource {
+	return r.record(r.instance, &dnsmessage.SRVResource{Port: r.port, Target: r.host}, true, legacy)
+}
+
+func (r *mdnsResponder) txtRecord(legacy bool) dnsmessage.Resource {
+	return r.record(r.instance, &dnsmessage.TXTResource{TXT: r.txt}, true, legacy)
+}
+
+// addresses returns an A record for each of our usable IPv4 addresses.
+// Browsers of our own connect to the address the answer came from instead,
+// but other DNS-SD clients need these.
+func (r *mdnsResponder) addresses(legacy bool) []dnsmessage.Resource {
+	var records []dnsmessage.Resource
+	for _, li := range localInterfaces() {
+		for _, ipnet := range li.addrs {
+			var a dnsmessage.AResource
+			copy(a.A[:], ipnet.IP)
+			records = append(records, r.record(r.host, &a, true, legacy))
+		}
+	}
+	return records
+}
+
+// record wraps body in a resource for name. unique records set cacheFlush,
+// except in legacy replies, which also get the short TTL section 6.7 asks for.
+func (r *mdnsResponder) record(name dnsmessage.Name, body dnsmessage.ResourceBody, unique, legacy bool) dnsmessage.Resource {
+	h := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: mdnsTTL}
+	if legacy {
+		h.TTL = 10
+	} else if unique {
+		h.Class |= cacheFlush
+	}
+	return dnsmessage.Resource{Header: h, Body: body}
+}
+
+// heardMDNSResponse lists the ShareIt peers described in an mDNS response
+// from ip, and drops those saying goodbye. A service counts only if its SRV
+// and TXT records arrive together, as our responder sends them.
+func heardMDNSResponse(p *tea.Program, msg dnsmessage.Message, ip net.IP, port int) {
+	srv := make(map[string]dnsmessage.Resource)
+	txt := make(map[string][]string)
+	for _, rr := range append(msg.Answers, msg.Additionals...) {
+		name := strings.ToLower(rr.Header.Name.String())
+		if !strings.HasSuffix(name, "."+mdnsService) {
+			continue
+		}
+		switch body := rr.Body.(type) {
+		case *dnsmessage.SRVResource:
+			srv[name] = rr
+		case *dnsmessage.TXTResource:
+			txt[name] = body.TXT
+		}
+	}
+	for name, rr := range srv {
+		t, ok := txt[name]
+		if !ok {
+			continue
+		}
+		a, err := protocol.ParseAnnouncementTXT(t)
+		if err != nil {
+			continue // Not ours, or from an incompatible build
+		}
+		a.Port = rr.Body.(*dnsmessage.SRVResource).Port
+		if rr.Header.TTL == 0 {
+			heardGoodbye(a, ip)
+			continue
+		}
+		heardAnnouncement(p, a, ip, port, time.Duration(rr.Header.TTL)*time.Second)
+	}
+}
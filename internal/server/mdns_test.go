@@ -0,0 +1,164 @@
+package server
+
+import (
+	"net"
+	"shareIt/internal/protocol"
+	"shareIt/internal/utils"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ptr is the PTR record a responder gives for instance, with ttl seconds
+// left.
+func ptr(instance string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(mdnsService), Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(instance + "." + mdnsService)},
+	}
+}
+
+// TestMDNSKnownAnswers checks that the browser lists the services it knows
+// while they have over half their TTL left, and that a responder named in
+// that list stays quiet.
+func TestMDNSKnownAnswers(t *testing.T) {
+	b := newMDNSBrowser(nil)
+	b.heard(dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true},
+		Answers: []dnsmessage.Resource{ptr("fresh", mdnsTTL), ptr("stale", mdnsTTL), ptr("gone", mdnsTTL), ptr("leaving", mdnsTTL)},
+	})
+	b.heard(dnsmessage.Message{Header: dnsmessage.Header{Response: true}, Answers: []dnsmessage.Resource{ptr("leaving", 0)}})
+	now := time.Now()
+	age := func(instance string, d time.Duration) {
+		k := b.known[instance+"."+mdnsService]
+		k.heard = now.Add(-d)
+		b.known[instance+"."+mdnsService] = k
+	}
+	age("stale", mdnsTTL*time.Second*6/10)
+	age("gone", mdnsTTL*time.Second+time.Second)
+
+	packed, err := b.query(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var query dnsmessage.Message
+	if err := query.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, rr := range query.Answers {
+		listed = append(listed, rr.Body.(*dnsmessage.PTRResource).PTR.String())
+	}
+	if want := []string{"fresh." + mdnsService}; !slices.Equal(listed, want) {
+		t.Errorf("query lists %q as known, want %q", listed, want)
+	}
+	if _, ok := b.known["gone."+mdnsService]; ok {
+		t.Error("an expired service is still known")
+	}
+
+	for _, tc := range []struct {
+		instance string
+		answered bool
+	}{
+		{"fresh", false}, // Listed as known
+		{"stale", true},  // Known, but about to need renewing
+		{"other", true},  // Not known at all
+	} {
+		r := &mdnsResponder{
+			service:  dnsmessage.MustNewName(mdnsService),
+			instance: dnsmessage.MustNewName(tc.instance + "." + mdnsService),
+			host:     dnsmessage.MustNewName(tc.instance + ".local."),
+		}
+		if answered := r.answer(query, false) != nil; answered != tc.answered {
+			t.Errorf("%s answered %t, want %t", tc.instance, answered, tc.answered)
+		}
+	}
+}
+
+func TestMDNSRenewAt(t *testing.T) {
+	heard := time.Now()
+	k := knownService{ttl: 100 * time.Second, heard: heard}
+	last := heard
+	for _, want := range []time.Duration{80, 85, 90, 95} {
+		at, ok := k.renewAt(last)
+		if !ok || at != heard.Add(want*time.Second) {
+			t.Fatalf("after %v: renew at %v, %t, want %v", last.Sub(heard), at.Sub(heard), ok, want*time.Second)
+		}
+		last = at
+	}
+	if at, ok := k.renewAt(last); ok {
+		t.Errorf("renewing again at %v after the last try", at.Sub(heard))
+	}
+}
+
+// TestMDNSLongDeviceName checks that a device name too long for a TXT
+// string is cut short, on a character boundary, rather than keeping the
+// device off mDNS.
+func TestMDNSLongDeviceName(t *testing.T) {
+	name := strings.Repeat("é", protocol.MaxNameLength/2) // Over MaxTXTNameLength
+	withOptions(t, Options{DeviceName: name})
+	r, err := newMDNSResponder(9000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := protocol.ParseAnnouncementTXT(r.txt)
+	if err != nil {
+		t.Fatalf("parsing our own TXT record: %v", err)
+	}
+	if want := strings.Repeat("é", protocol.MaxTXTNameLength/2); a.DeviceName != want {
+		t.Errorf("advertised as %d bytes %q, want the first %d bytes", len(a.DeviceName), a.DeviceName, len(want))
+	}
+}
+
+// TestMDNSGoodbye checks that what we announce unasked carries every record
+// of our service, and that a peer hearing it sent with TTL zero drops us.
+func TestMDNSGoodbye(t *testing.T) {
+	id, err := protocol.NewNodeID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withOptions(t, Options{NodeID: id, DeviceName: "laptop"})
+	r, err := newMDNSResponder(9000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ttl := range []uint32{mdnsTTL, 0} {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(r.unsolicited(ttl)); err != nil {
+			t.Fatal(err)
+		}
+		var types []dnsmessage.Type
+		for _, rr := range msg.Answers {
+			types = append(types, rr.Header.Type)
+			if rr.Header.TTL != ttl {
+				t.Errorf("%v record has TTL %d, want %d", rr.Header.Type, rr.Header.TTL, ttl)
+			}
+		}
+		for _, want := range []dnsmessage.Type{dnsmessage.TypePTR, dnsmessage.TypeSRV, dnsmessage.TypeTXT} {
+			if !slices.Contains(types, want) {
+				t.Errorf("announced %v, want a %v record too", types, want)
+			}
+		}
+		if ttl != 0 {
+			continue
+		}
+
+		addr := "10.0.0.2:9000"
+		discovered.heard(id.String(), addr, utils.PeerDetails{}, mdnsTTL*time.Second)
+		t.Cleanup(func() {
+			discovered.mu.Lock()
+			delete(discovered.devices, id.String())
+			discovered.mu.Unlock()
+		})
+		heardMDNSResponse(nil, msg, net.IPv4(10, 0, 0, 2), 0)
+		discovered.mu.Lock()
+		expires := discovered.devices[id.String()].expires[addr]
+		discovered.mu.Unlock()
+		if expires.After(time.Now().Add(time.Second)) {
+			t.Errorf("said goodbye, but kept for another %v", time.Until(expires).Round(time.Second))
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"shareIt/internal/pake"
+	"shareIt/internal/protocol"
+	"shareIt/internal/trust"
+	"shareIt/internal/utils"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// pairingCodeDigits is how long the code a user reads out is. SPAKE2 allows
+// one guess per attempt, so six digits is plenty.
+const pairingCodeDigits = 6
+
+// authLabel names the TLS exporter pairing proofs are bound to.
+const authLabel = "EXPORTER-shareit-pairing"
+
+var nextPairID atomic.Uint64
+
+// session is what a connection has established about the peer.
+type session struct {
+	nodeID      protocol.NodeID
+	addr        string
+	fingerprint string
+	keyChanged  bool // Its certificate differs from the pin; only pairing is allowed
+	paired      bool // It proved it holds our pairing key
+}
+
+// ErrWrongPeer fails a connection on which a device other than the one the
+// user picked answered. Announcements prove nothing, so any device can
+// claim any node ID in them.
+var ErrWrongPeer = errors.New("a different device answered")
+
+// greet runs our side of the handshake on conn, dialled to addr for the
+// device nodeID, and authenticates the device if it is the one expected.
+func greet(conn net.Conn, nodeID, addr string, p *tea.Program) (protocol.HelloAck, *session, error) {
+	ack, err := protocol.ClientHandshake(conn, localHello())
+	if err != nil {
+		return ack, nil, err
+	}
+	if ack.NodeID.String() != nodeID {
+		return ack, nil, fmt.Errorf("%w: %s is node %s, not %s", ErrWrongPeer, addr, ack.NodeID, nodeID)
+	}
+	sess, err := authenticate(conn, ack.NodeID, addr, true, p)
+	return ack, sess, err
+}
+
+// authenticate follows the handshake on both sides. It checks the peer's
+// certificate against its pin, then each side proves it holds the pairing
+// key if the two are paired. A changed certificate is not an error here
+// since pairing again is how the user accepts it; mayTransfer refuses it.
+func authenticate(conn net.Conn, id protocol.NodeID, addr string, dialled bool, p *tea.Program) (*session, error) {
+	fp, err := checkPeer(conn, id, addr, dialled, p)
+	if err != nil && !errors.Is(err, trust.ErrKeyChanged) {
+		return nil, err
+	}
+	s := &session{nodeID: id, addr: addr, fingerprint: fp, keyChanged: err != nil}
+
+	state := conn.(*tls.Conn).ConnectionState()
+	ekm, err := state.ExportKeyingMaterial(authLabel, nil, 32)
+	if err != nil {
+		return nil, err
+	}
+	var local protocol.Auth
+	dev, known := pairedDevice(id)
+	if known {
+		local = protocol.Auth{Paired: true, Proof: pairingProof(dev.Key, ekm, dialled)}
+	}
+	// Both sides write first; the frames are tiny so neither blocks.
+	if err := protocol.WriteAuth(conn, local); err != nil {
+		return nil, err
+	}
+	remote, err := protocol.ReadAuth(conn)
+	if err != nil {
+		return nil, err
+	}
+	if known && remote.Paired {
+		want := pairingProof(dev.Key, ekm, !dialled)
+		s.paired = hmac.Equal(want[:], remote.Proof[:])
+	}
+	return s, nil
+}
+
+// pairingProof shows we hold key on this very TLS session. The dialling and
+// listening sides use different proofs so one cannot be reflected back.
+func pairingProof(key, ekm []byte, dialled bool) [32]byte {
+	mac := hmac.New(sha256.New, key)
+	if dialled {
+		mac.Write([]byte("client"))
+	} else {
+		mac.Write([]byte("server"))
+	}
+	mac.Write(ekm)
+	var out [32]byte
+	copy(out[:], mac.Sum(nil))
+	return out
+}
+
+// mayTransfer says whether files may go to or come from the peer.
+func (s *session) mayTransfer() error {
+	switch {
+	case s.keyChanged:
+		return trust.ErrKeyChanged
+	case s.paired:
+		return nil
+	}
+	if _, ok := pairedDevice(s.nodeID); ok {
+		return trust.ErrPairingFailed
+	}
+	if opts.RequirePairing {
+		return trust.ErrNotPaired
+	}
+	return nil
+}
+
+// pairedDevice looks up the pairing record for a node.
+func pairedDevice(id protocol.NodeID) (trust.Device, bool) {
+	if opts.Devices == nil {
+		return trust.Device{}, false
+	}
+	return opts.Devices.Get(id.String())
+}
+
+// PairedName returns the name of the paired device announcing from addr.
+func PairedName(addr string) (string, bool) {
+	a, ok := announced.Load(addr)
+	if !ok || opts.Devices == nil {
+		return "", false
+	}
+	dev, ok := opts.Devices.Get(a.(announcement).nodeID)
+	if !ok || dev.Fingerprint != a.(announcement).fingerprint {
+		return "", false
+	}
+	return dev.Name, true
+}
+
+// remember stores a finished pairing and accepts the peer's certificate.
+func (s *session) remember(name string, key [32]byte) error {
+	if opts.Devices == nil {
+		return errors.New("no trusted devices file")
+	}
+	err := opts.Devices.Add(s.nodeID.String(), trust.Device{
+		Name:        name,
+		Fingerprint: s.fingerprint,
+		Key:         key[:],
+		PairedAt:    time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if s.keyChanged && opts.Trust != nil {
+		if err := opts.Trust.Repin(s.nodeID.String(), s.fingerprint); err != nil {
+			return err
+		}
+	}
+	s.keyChanged = false
+	s.paired = true
+	return nil
+}
+
+// newPairingCode returns a random decimal code.
+func newPairingCode() (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(pairingCodeDigits), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", pairingCodeDigits, n), nil
+}
+
+// normalizeCode drops the spaces and dashes people type between digits.
+func normalizeCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// PairWith pairs with the device nodeID at addr. It shows a code for the
+// user to type in on that device and reports the outcome with a
+// PairingDoneMsg.
+func PairWith(nodeID, addr string, p *tea.Program) error {
+	name, err := pairWith(nodeID, addr, p)
+	if err != nil {
+		log.Printf("Pairing with %s failed: %v", addr, err)
+	} else {
+		log.Printf("Paired with %s (%s)", name, addr)
+	}
+	p.Send(utils.PairingDoneMsg{Addr: addr, Name: name, Err: err})
+	return err
+}
+
+func pairWith(nodeID, addr string, p *tea.Program) (string, error) {
+	code, err := newPairingCode()
+	if err != nil {
+		return "", err
+	}
+	conn, err := dialPeer(addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	setDeadline(conn, handshakeTimeout)
+	_, sess, err := greet(conn, nodeID, addr, p)
+	if err != nil {
+		return "", err
+	}
+
+	// Both certificates go into the exchange, so a relay holding two TLS
+	// sessions cannot complete it.
+	state, err := pake.New(pake.RoleA, code, []byte(localFingerprint()), []byte(sess.fingerprint))
+	if err != nil {
+		return "", err
+	}
+	if err := protocol.WriteRequest(conn, protocol.RequestPair); err != nil {
+		return "", err
+	}
+	if err := protocol.WritePairRequest(conn, protocol.PairRequest{DeviceName: opts.DeviceName, Share: state.Share()}); err != nil {
+		return "", err
+	}
+	p.Send(utils.PairingCodeMsg{Addr: addr, Code: code})
+
+	// The other user has offerTimeout to type the code in.
+	conn.SetReadDeadline(time.Now().Add(answerTimeout))
+	reply, err := protocol.ReadPairReply(conn)
+	if err != nil {
+		return "", fmt.Errorf("no reply: %w", unresponsive(err))
+	}
+	setDeadline(conn, handshakeTimeout)
+	if reply.Status != protocol.PairOK {
+		return "", fmt.Errorf("peer %s", reply.Status)
+	}
+	keys, err := state.Finish(reply.Share)
+	if err == nil {
+		err = keys.Verify(pake.RoleB, reply.Confirm)
+	}
+	if err != nil {
+		protocol.WritePairConfirm(conn, protocol.PairConfirm{Status: protocol.PairWrongCode})
+		return "", err
+	}
+	if err := protocol.WritePairConfirm(conn, protocol.PairConfirm{Status: protocol.PairOK, Confirm: keys.Confirm(pake.RoleA)}); err != nil {
+		return "", err
+	}
+	return reply.DeviceName, sess.remember(reply.DeviceName, keys.Shared)
+}
+
+// respondPairing handles a pairing request: it asks the user for the code
+// the other device shows and runs our side of the exchange. An error means
+// the connection is no longer usable.
+func respondPairing(conn net.Conn, sess *session, p *tea.Program) error {
+	req, err := protocol.ReadPairRequest(conn)
+	if err != nil {
+		return fmt.Errorf("reading pair request: %w", err)
+	}
+	log.Printf("%s (%s) wants to pair", req.DeviceName, sess.addr)
+
+	code := normalizeCode(askPairingCode(p, req.DeviceName, sess.addr))
+	setDeadline(conn, handshakeTimeout)
+	if code == "" {
+		log.Printf("Declined pairing with %s", sess.addr)
+		return protocol.WritePairReply(conn, protocol.PairReply{Status: protocol.PairDeclined})
+	}
+
+	state, err := pake.New(pake.RoleB, code, []byte(sess.fingerprint), []byte(localFingerprint()))
+	if err != nil {
+		return err
+	}
+	keys, err := state.Finish(req.Share)
+	if err != nil {
+		return err
+	}
+	err = protocol.WritePairReply(conn, protocol.PairReply{
+		Status:     protocol.PairOK,
+		DeviceName: opts.DeviceName,
+		Share:      state.Share(),
+		Confirm:    keys.Confirm(pake.RoleB),
+	})
+	if err != nil {
+		return err
+	}
+
+	confirm, err := protocol.ReadPairConfirm(conn)
+	if err != nil {
+		return fmt.Errorf("reading pair confirmation: %w", err)
+	}
+	err = pake.ErrWrongCode
+	if confirm.Status == protocol.PairOK {
+		err = keys.Verify(pake.RoleA, confirm.Confirm)
+	}
+	if err == nil {
+		err = sess.remember(req.DeviceName, keys.Shared)
+	}
+	if err != nil {
+		log.Printf("Pairing with %s failed: %v", sess.addr, err)
+	} else {
+		log.Printf("Paired with %s (%s)", req.DeviceName, sess.addr)
+	}
+	for _, addr := range announcedAddrs(sess.nodeID.String(), sess.addr) {
+		p.Send(utils.PairingDoneMsg{Addr: addr, Name: req.DeviceName, Err: err})
+	}
+	return nil
+}
+
+// askPairingCode shows a pairing request in the TUI and waits for the code
+// the user types in. It returns "" if they decline or do not answer in time.
+func askPairingCode(p *tea.Program, from, addr string) string {
+	id := nextPairID.Add(1)
+	reply := make(chan string, 1)
+	p.Send(utils.PairingRequestMsg{ID: id, From: from, Addr: addr, Reply: reply})
+
+	select {
+	case code := <-reply:
+		return code
+	case <-time.After(offerTimeout):
+		log.Printf("Pairing request from %s timed out", addr)
+		p.Send(utils.PairingExpiredMsg{ID: id})
+		return ""
+	}
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"shareIt/internal/protocol"
+	"testing"
+)
+
+// TestGreetChecksNodeID checks that a device answering under another node
+// ID than the one picked is refused before anything else is said to it.
+func TestGreetChecksNodeID(t *testing.T) {
+	picked, err := protocol.NewNodeID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor, err := protocol.NewNodeID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	go func() {
+		defer peer.Close()
+		protocol.ServerHandshake(peer, protocol.HelloAck{Version: protocol.ProtocolVersion, NodeID: impostor})
+	}()
+
+	if _, _, err := greet(conn, picked.String(), "10.0.0.2:9000", nil); !errors.Is(err, ErrWrongPeer) {
+		t.Errorf("greeting %s answering for %s: %v, want %v", impostor, picked, err, ErrWrongPeer)
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"cmp"
+	"log"
+	"shareIt/internal/utils"
+	"slices"
+	"sync"
+	"time"
+)
+
+// peerTable holds the devices discovery has heard from, keyed by node ID so
+// a device that changes networks stays the same peer.
+type peerTable struct {
+	mu      sync.Mutex
+	devices map[string]*knownDevice
+	arrived chan struct{} // Closed, and replaced, when a device is first heard from
+}
+
+// knownDevice is one discovered device and every address it announces from.
+type knownDevice struct {
+	details utils.PeerDetails
+	addrs   []string             // In the order they were first heard
+	seen    map[string]time.Time // Last announcement from each address
+	expires map[string]time.Time // When each address is forgotten unless heard again
+}
+
+func newPeerTable() *peerTable {
+	return &peerTable{devices: make(map[string]*knownDevice), arrived: make(chan struct{})}
+}
+
+// arrivals returns a channel that is closed once a device not listed now is
+// heard from.
+func (t *peerTable) arrivals() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.arrived
+}
+
+// heard records an announcement from the device nodeID at addr, which
+// holds for ttl or peerTimeout, whichever is longer. It reports whether the
+// list of peers changed.
+func (t *peerTable) heard(nodeID, addr string, details utils.PeerDetails, ttl time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dev, ok := t.devices[nodeID]
+	if !ok {
+		dev = &knownDevice{seen: make(map[string]time.Time), expires: make(map[string]time.Time)}
+		t.devices[nodeID] = dev
+		close(t.arrived)
+		t.arrived = make(chan struct{})
+		log.Printf("New peer found: %s (%s) at %s", nodeID, details.Name, addr)
+	}
+	now := time.Now()
+	_, known := dev.seen[addr]
+	dev.seen[addr] = now
+	if until := now.Add(max(ttl, peerTimeout)); until.After(dev.expires[addr]) {
+		dev.expires[addr] = until
+	}
+	if !known {
+		dev.addrs = append(dev.addrs, addr)
+		if ok {
+			log.Printf("Peer %s (%s) is now also at %s", nodeID, details.Name, addr)
+		}
+	}
+	changed := !known || dev.details != details
+	dev.details = details
+	return changed
+}
+
+// leaving has the device nodeID forgotten at addr a second from now, as
+// RFC 6762 section 10.1 asks of a goodbye, unless it is heard there again.
+func (t *peerTable) leaving(nodeID, addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dev, ok := t.devices[nodeID]
+	if !ok {
+		return
+	}
+	if _, ok := dev.expires[addr]; ok {
+		dev.expires[addr] = time.Now().Add(time.Second)
+	}
+}
+
+// prune forgets addresses whose announcements have run out, and devices
+// left with none. It reports whether the list of peers changed.
+func (t *peerTable) prune() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	var changed bool
+	for id, dev := range t.devices {
+		dev.addrs = slices.DeleteFunc(dev.addrs, func(addr string) bool {
+			if !now.After(dev.expires[addr]) {
+				return false
+			}
+			delete(dev.seen, addr)
+			delete(dev.expires, addr)
+			announced.Delete(addr)
+			log.Printf("Peer %s (%s) is no longer at %s", id, dev.details.Name, addr)
+			changed = true
+			return true
+		})
+		if len(dev.addrs) == 0 {
+			delete(t.devices, id)
+			log.Printf("Peer timed out and was removed: %s (%s)", id, dev.details.Name)
+		}
+	}
+	return changed
+}
+
+// addrs returns where to reach the device nodeID, most recently heard
+// first, if it is still around.
+func (t *peerTable) addrs(nodeID string) ([]string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dev, ok := t.devices[nodeID]
+	if !ok {
+		return nil, false
+	}
+	return dev.recent(), true
+}
+
+// recent returns the device's addresses, most recently heard first. The
+// caller holds the table's lock.
+func (d *knownDevice) recent() []string {
+	addrs := slices.Clone(d.addrs)
+	slices.SortStableFunc(addrs, func(a, b string) int {
+		return d.seen[b].Compare(d.seen[a])
+	})
+	return addrs
+}
+
+// list returns the peers sorted by name, then node ID.
+func (t *peerTable) list() []utils.Peer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peers := make([]utils.Peer, 0, len(t.devices))
+	for id, dev := range t.devices {
+		addrs := dev.recent()
+		peers = append(peers, utils.Peer{
+			NodeID:      id,
+			Addr:        addrs[0],
+			Addrs:       addrs,
+			PeerDetails: dev.details,
+		})
+	}
+	slices.SortFunc(peers, func(a, b utils.Peer) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.NodeID, b.NodeID))
+	})
+	return peers
+}
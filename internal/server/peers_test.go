@@ -0,0 +1,125 @@
+package server
+
+import (
+	"shareIt/internal/utils"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPeerTableMergesAddresses(t *testing.T) {
+	table := newPeerTable()
+	laptop := utils.PeerDetails{Name: "laptop"}
+	for i, s := range []struct {
+		nodeID, addr string
+		details      utils.PeerDetails
+		changed      bool
+	}{
+		{"n1", "10.0.0.2:9000", laptop, true},
+		{"n1", "10.0.0.2:9000", laptop, false},                                // Heard again, nothing new
+		{"n1", "192.168.1.5:9000", laptop, true},                              // Same device on another network
+		{"n1", "10.0.0.2:9000", utils.PeerDetails{Name: "renamed"}, true},     // Says something new
+		{"n2", "10.0.0.3:9000", utils.PeerDetails{Name: "desktop"}, true},     // Another device
+		{"n1", "192.168.1.5:9000", utils.PeerDetails{Name: "renamed"}, false}, // Heard there again
+	} {
+		if changed := table.heard(s.nodeID, s.addr, s.details, 0); changed != s.changed {
+			t.Errorf("step %d: heard %s at %s: changed %t, want %t", i, s.nodeID, s.addr, changed, s.changed)
+		}
+	}
+
+	peers := table.list()
+	if len(peers) != 2 {
+		t.Fatalf("%d peers, want 2: %+v", len(peers), peers)
+	}
+	// Sorted by name: desktop, then renamed.
+	n1 := peers[1]
+	if n1.NodeID != "n1" || n1.Name != "renamed" {
+		t.Fatalf("second peer is %s (%s), want n1 (renamed)", n1.NodeID, n1.Name)
+	}
+	if !slices.Equal(n1.Addrs, []string{"10.0.0.2:9000", "192.168.1.5:9000"}) &&
+		!slices.Equal(n1.Addrs, []string{"192.168.1.5:9000", "10.0.0.2:9000"}) {
+		t.Errorf("n1 at %q, want both its addresses", n1.Addrs)
+	}
+
+	// Whichever address was heard from last is tried first.
+	seen := table.devices["n1"].seen
+	for _, want := range [][]string{
+		{"192.168.1.5:9000", "10.0.0.2:9000"},
+		{"10.0.0.2:9000", "192.168.1.5:9000"},
+	} {
+		seen[want[0]], seen[want[1]] = time.Now(), time.Now().Add(-time.Minute)
+		if p := table.list()[1]; p.Addr != want[0] || !slices.Equal(p.Addrs, want) {
+			t.Errorf("n1 at %s %q, want %s %q", p.Addr, p.Addrs, want[0], want)
+		}
+		if addrs, ok := table.addrs("n1"); !ok || !slices.Equal(addrs, want) {
+			t.Errorf("addrs(n1) = %q, %t, want %q", addrs, ok, want)
+		}
+	}
+	if _, ok := table.addrs("n3"); ok {
+		t.Error("addrs found a device never heard from")
+	}
+}
+
+func TestPeerTableExpires(t *testing.T) {
+	table := newPeerTable()
+	table.heard("n1", "10.0.0.2:9000", utils.PeerDetails{}, 0)
+	table.heard("n1", "192.168.1.5:9000", utils.PeerDetails{}, 0)
+	table.heard("n2", "10.0.0.3:9000", utils.PeerDetails{}, 0)
+	// age makes an address look last heard d ago.
+	age := func(nodeID, addr string, d time.Duration) {
+		dev := table.devices[nodeID]
+		dev.seen[addr] = time.Now().Add(-d)
+		dev.expires[addr] = dev.seen[addr].Add(peerTimeout)
+	}
+
+	if table.prune() {
+		t.Error("prune changed a table heard from just now")
+	}
+
+	// One of n1's addresses goes quiet; n1 stays, reachable at the other.
+	age("n1", "10.0.0.2:9000", peerTimeout+time.Second)
+	age("n2", "10.0.0.3:9000", peerTimeout-time.Second)
+	if !table.prune() {
+		t.Error("prune did not report an address going")
+	}
+	if addrs, ok := table.addrs("n1"); !ok || !slices.Equal(addrs, []string{"192.168.1.5:9000"}) {
+		t.Errorf("n1 left at %q, want only 192.168.1.5:9000", addrs)
+	}
+	if _, ok := table.addrs("n2"); !ok {
+		t.Error("n2 expired before peerTimeout")
+	}
+
+	// Heard again at the old address, it comes back.
+	if !table.heard("n1", "10.0.0.2:9000", utils.PeerDetails{}, 0) {
+		t.Error("an address heard again after expiring was not reported")
+	}
+
+	// A device with no address left is gone.
+	age("n2", "10.0.0.3:9000", peerTimeout+time.Second)
+	if !table.prune() {
+		t.Error("prune did not report a device going")
+	}
+	if _, ok := table.addrs("n2"); ok {
+		t.Error("n2 is still listed after its only address expired")
+	}
+	if peers := table.list(); len(peers) != 1 || peers[0].NodeID != "n1" {
+		t.Errorf("list = %+v, want only n1", peers)
+	}
+
+	// One saying goodbye goes a second later.
+	table.heard("n1", "10.0.0.2:9000", utils.PeerDetails{}, 2*time.Minute)
+	table.leaving("n1", "10.0.0.2:9000")
+	if expires := table.devices["n1"].expires["10.0.0.2:9000"]; expires.After(time.Now().Add(time.Second)) {
+		t.Errorf("n1 kept for %v after saying goodbye, want a second", time.Until(expires).Round(time.Second))
+	}
+	table.leaving("n5", "10.0.0.5:9000") // Never heard of: nothing to do
+
+	// One heard over mDNS is kept as long as its records last, however
+	// often it is heard without.
+	table.heard("n3", "10.0.0.4:9000", utils.PeerDetails{}, 2*time.Minute)
+	table.heard("n3", "10.0.0.4:9000", utils.PeerDetails{}, 0)
+	table.devices["n3"].seen["10.0.0.4:9000"] = time.Now().Add(-time.Minute)
+	if table.prune(); !slices.Contains(table.devices["n3"].addrs, "10.0.0.4:9000") {
+		t.Error("n3 expired before its TTL")
+	}
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"shareIt/internal/storage"
+	"shareIt/internal/utils"
+	"slices"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// QueueFileName is the send queue's file name inside the ShareIt state
+// directory.
+const QueueFileName = "send_queue.json"
+
+// ErrPeerGone fails a queued send to a peer discovery no longer sees.
+var ErrPeerGone = errors.New("peer is no longer on the network")
+
+// peerWaitTimeout is how long a send waits for discovery to find its peers,
+// as it does when a restart brings back the queue before any of them has
+// been heard from. After that it goes to the peers found, and fails for
+// the rest.
+const peerWaitTimeout = 30 * time.Second
+
+// QueuedSend is a file or folder waiting to be sent to one or more peers.
+type QueuedSend struct {
+	ID    utils.TransferID `json:"-"` // Handed out afresh on every load
+	Path  string           `json:"path"`
+	Peers []string         `json:"peers"` // Node IDs, looked up when the send starts
+}
+
+// SendQueue runs sends a few at a time, in the order the user arranged, so
+// they do not all compete for bandwidth. Sends that have not finished are
+// kept on disk and started again after a restart; a file that was halfway
+// there resumes where it stopped.
+type SendQueue struct {
+	path      string
+	maxActive int
+
+	mu        sync.Mutex
+	program   *tea.Program // Nil until Start
+	running   []QueuedSend
+	waiting   []QueuedSend                   // Next to start first
+	deadlines map[utils.TransferID]time.Time // When each send waiting for its peers stops waiting
+
+	peers    *peerTable                     // Where the peers are looked up
+	peerWait time.Duration                  // peerWaitTimeout, unless a test stands in
+	send     func(*tea.Program, QueuedSend) // sendQueued, unless a test stands in
+}
+
+// LoadSendQueue reads the queue saved at path. A missing file is an empty
+// queue. Sends that were running when it was saved go back to the front.
+// At most maxActive sends run at once, each to all of its peers.
+func LoadSendQueue(path string, maxActive int) (*SendQueue, error) {
+	q := &SendQueue{
+		path:      path,
+		maxActive: max(maxActive, 1),
+		deadlines: make(map[utils.TransferID]time.Time),
+		peers:     discovered,
+		peerWait:  peerWaitTimeout,
+		send:      sendQueued,
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &q.waiting); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i := range q.waiting {
+		q.waiting[i].ID = utils.NewTransferID()
+	}
+	return q, nil
+}
+
+// Start runs the queue, reporting every send to p. Nothing is sent before
+// it is called.
+func (q *SendQueue) Start(p *tea.Program) {
+	q.mu.Lock()
+	q.program = p
+	q.mu.Unlock()
+	go q.watch()
+}
+
+// watch starts whatever can start now, and looks again each time discovery
+// finds another device, which may be one a waiting send is for.
+func (q *SendQueue) watch() {
+	for {
+		arrived := q.peers.arrivals()
+		q.changed()
+		<-arrived
+	}
+}
+
+// Add puts a send to the peers with nodeIDs at the back of the queue.
+func (q *SendQueue) Add(path string, nodeIDs []string) {
+	q.mu.Lock()
+	q.waiting = append(q.waiting, QueuedSend{ID: utils.NewTransferID(), Path: path, Peers: nodeIDs})
+	q.mu.Unlock()
+	q.changed()
+}
+
+// Waiting returns the sends that have not started yet, next first.
+func (q *SendQueue) Waiting() []QueuedSend {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return slices.Clone(q.waiting)
+}
+
+// Move shifts a waiting send delta places towards the back of the queue
+// (towards the front if negative), stopping at either end.
+func (q *SendQueue) Move(id utils.TransferID, delta int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := q.find(id)
+	if i < 0 {
+		return
+	}
+	j := min(max(i+delta, 0), len(q.waiting)-1)
+	s := q.waiting[i]
+	q.waiting = slices.Insert(slices.Delete(q.waiting, i, i+1), j, s)
+	q.save()
+}
+
+// Bump moves a waiting send to the front of the queue, so it is the next to
+// start.
+func (q *SendQueue) Bump(id utils.TransferID) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if i := q.find(id); i > 0 {
+		s := q.waiting[i]
+		q.waiting = slices.Insert(slices.Delete(q.waiting, i, i+1), 0, s)
+		q.save()
+	}
+}
+
+// Remove drops a send that has not started yet.
+func (q *SendQueue) Remove(id utils.TransferID) {
+	q.mu.Lock()
+	if i := q.find(id); i >= 0 {
+		q.waiting = slices.Delete(q.waiting, i, i+1)
+		delete(q.deadlines, id)
+		q.save()
+	}
+	q.mu.Unlock()
+}
+
+// find returns the index of the waiting send with id, or -1. q.mu must be
+// held.
+func (q *SendQueue) find(id utils.TransferID) int {
+	return slices.IndexFunc(q.waiting, func(s QueuedSend) bool { return s.ID == id })
+}
+
+// changed starts as many waiting sends as there is room for, saves the
+// queue and tells the UI.
+func (q *SendQueue) changed() {
+	q.update(nil)
+}
+
+// update applies f, if not nil, to the queue, then does what changed does,
+// all under one lock so no one sees the queue in between. The message goes
+// out on its own goroutine: Add is called from the UI's Update, which is
+// what would have to receive it.
+func (q *SendQueue) update(f func()) {
+	q.mu.Lock()
+	if f != nil {
+		f()
+	}
+	p := q.program
+	if p == nil {
+		q.save()
+		q.mu.Unlock()
+		return
+	}
+	var started []QueuedSend
+	now := time.Now()
+	for i := 0; len(q.running) < q.maxActive && i < len(q.waiting); {
+		s := q.waiting[i]
+		if !q.ready(s, now) {
+			i++ // Let the sends behind it go first
+			continue
+		}
+		q.waiting = slices.Delete(q.waiting, i, i+1)
+		delete(q.deadlines, s.ID)
+		q.running = append(q.running, s)
+		started = append(started, s)
+	}
+	q.save()
+	q.mu.Unlock()
+
+	for _, s := range started {
+		go q.run(p, s)
+	}
+	go p.Send(utils.SendQueueMsg{})
+}
+
+// ready reports whether s can start: once discovery has found all of its
+// peers, or once it has waited peerWait for them. q.mu must be held.
+func (q *SendQueue) ready(s QueuedSend, now time.Time) bool {
+	if !slices.ContainsFunc(s.Peers, func(id string) bool {
+		_, ok := q.peers.addrs(id)
+		return !ok
+	}) {
+		return true
+	}
+	deadline, ok := q.deadlines[s.ID]
+	if !ok {
+		deadline = now.Add(q.peerWait)
+		q.deadlines[s.ID] = deadline
+		time.AfterFunc(q.peerWait, q.changed)
+	}
+	return !now.Before(deadline)
+}
+
+// run sends s and makes room for the next one.
+func (q *SendQueue) run(p *tea.Program, s QueuedSend) {
+	q.send(p, s)
+	q.update(func() {
+		q.running = slices.DeleteFunc(q.running, func(r QueuedSend) bool { return r.ID == s.ID })
+	})
+}
+
+// sendQueued sends s to wherever its peers are now, which may not be where
+// they were when it was queued. Failures are reported to the UI, by
+// SendToPeers for the peers found.
+func sendQueued(p *tea.Program, s QueuedSend) {
+	var peers []Target
+	for _, id := range s.Peers {
+		addrs, ok := discovered.addrs(id)
+		if !ok {
+			reportFailure(p, utils.NewTransferID(), s.Path, filepath.Base(s.Path), id, OpConnect, ErrPeerGone)
+			continue
+		}
+		peers = append(peers, Target{NodeID: id, Addrs: addrs})
+	}
+	if len(peers) > 0 {
+		SendToPeers(s.Path, peers, p)
+	}
+}
+
+// save writes the unfinished sends to disk, running ones first. q.mu must
+// be held. Failing to save only costs the queue on the next restart.
+func (q *SendQueue) save() {
+	sends := append(slices.Clone(q.running), q.waiting...)
+	if sends == nil {
+		sends = []QueuedSend{}
+	}
+	if err := storage.WriteJSON(q.path, sends); err != nil {
+		log.Printf("Could not save the send queue: %v", err)
+	}
+}
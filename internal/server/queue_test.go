@@ -0,0 +1,218 @@
+package server
+
+import (
+	"path/filepath"
+	"shareIt/internal/utils"
+	"slices"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// paths returns the paths of sends in order.
+func paths(sends []QueuedSend) []string {
+	var out []string
+	for _, s := range sends {
+		out = append(out, s.Path)
+	}
+	return out
+}
+
+// newQueue returns a queue saved in a temporary directory, with sends of
+// a, b, c and d waiting, each to the peer node-<path>, which is on the
+// network.
+func newQueue(t *testing.T, maxActive int) *SendQueue {
+	t.Helper()
+	q, err := LoadSendQueue(filepath.Join(t.TempDir(), QueueFileName), maxActive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.peers = newPeerTable()
+	for _, path := range []string{"a", "b", "c", "d"} {
+		q.peers.heard("node-"+path, "10.0.0.2:9000", utils.PeerDetails{}, time.Hour)
+		q.Add(path, []string{"node-" + path})
+	}
+	return q
+}
+
+func TestSendQueueReorder(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		op    string
+		path  string // Of the send to act on; "x" is not in the queue
+		delta int
+		want  []string
+	}{
+		{"move back", "move", "b", 1, []string{"a", "c", "b", "d"}},
+		{"move forward", "move", "c", -1, []string{"a", "c", "b", "d"}},
+		{"move past the back", "move", "b", 10, []string{"a", "c", "d", "b"}},
+		{"move past the front", "move", "c", -5, []string{"c", "a", "b", "d"}},
+		{"move unknown", "move", "x", 1, []string{"a", "b", "c", "d"}},
+		{"bump", "bump", "d", 0, []string{"d", "a", "b", "c"}},
+		{"bump the first", "bump", "a", 0, []string{"a", "b", "c", "d"}},
+		{"bump unknown", "bump", "x", 0, []string{"a", "b", "c", "d"}},
+		{"remove", "remove", "b", 0, []string{"a", "c", "d"}},
+		{"remove unknown", "remove", "x", 0, []string{"a", "b", "c", "d"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := newQueue(t, 1)
+			var id utils.TransferID
+			if i := slices.IndexFunc(q.Waiting(), func(s QueuedSend) bool { return s.Path == tc.path }); i >= 0 {
+				id = q.Waiting()[i].ID
+			}
+			switch tc.op {
+			case "move":
+				q.Move(id, tc.delta)
+			case "bump":
+				q.Bump(id)
+			case "remove":
+				q.Remove(id)
+			}
+			if got := paths(q.Waiting()); !slices.Equal(got, tc.want) {
+				t.Errorf("queue is %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// blockSends makes q hand each send it starts to started and hold it until
+// finish is sent to. Once the test is over every send is let through.
+func blockSends(t *testing.T, q *SendQueue) (started chan QueuedSend, finish chan struct{}) {
+	started, finish = make(chan QueuedSend, 8), make(chan struct{})
+	q.send = func(p *tea.Program, s QueuedSend) {
+		started <- s
+		<-finish
+	}
+	t.Cleanup(func() {
+		close(finish)
+		// Let the queue run dry before its directory goes.
+		for {
+			q.mu.Lock()
+			n := len(q.running) + len(q.waiting)
+			q.mu.Unlock()
+			if n == 0 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	return started, finish
+}
+
+func TestSendQueueActiveCap(t *testing.T) {
+	q := newQueue(t, 2)
+	started, finish := blockSends(t, q)
+	q.Start(runProgram(t, nil))
+
+	next := func() string {
+		t.Helper()
+		select {
+		case s := <-started:
+			return s.Path
+		case <-time.After(time.Second):
+			t.Fatal("no send started")
+			return ""
+		}
+	}
+	if got := []string{next(), next()}; !slices.Contains(got, "a") || !slices.Contains(got, "b") {
+		t.Fatalf("started %q first, want a and b", got)
+	}
+	select {
+	case s := <-started:
+		t.Fatalf("%s started with two already running", s.Path)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := paths(q.Waiting()); !slices.Equal(got, []string{"c", "d"}) {
+		t.Errorf("waiting %q, want c and d", got)
+	}
+
+	finish <- struct{}{}
+	if got := next(); got != "c" {
+		t.Errorf("%s started when a send finished, want c", got)
+	}
+}
+
+func TestSendQueuePersists(t *testing.T) {
+	q := newQueue(t, 1)
+	started, _ := blockSends(t, q)
+	q.Move(q.Waiting()[3].ID, -2) // a d b c
+	q.Start(runProgram(t, nil))
+	<-started
+
+	// What a restart now would find: the send that was running goes back to
+	// the front, ahead of the rest in the order the user left them.
+	loaded, err := LoadSendQueue(q.path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sends := loaded.Waiting()
+	if got := paths(sends); !slices.Equal(got, []string{"a", "d", "b", "c"}) {
+		t.Fatalf("loaded %q, want a, d, b, c", got)
+	}
+	ids := make(map[utils.TransferID]bool)
+	for _, s := range sends {
+		if want := []string{"node-" + s.Path}; !slices.Equal(s.Peers, want) {
+			t.Errorf("%s is for %q, want %q", s.Path, s.Peers, want)
+		}
+		if s.ID == 0 || ids[s.ID] {
+			t.Errorf("%s loaded with ID %d, want a fresh one", s.Path, s.ID)
+		}
+		ids[s.ID] = true
+	}
+
+	// A missing file is an empty queue.
+	empty, err := LoadSendQueue(filepath.Join(t.TempDir(), QueueFileName), 1)
+	if err != nil || len(empty.Waiting()) != 0 {
+		t.Errorf("loading a missing queue = %v, %v, want it empty", paths(empty.Waiting()), err)
+	}
+}
+
+// TestSendQueueWaitsForPeers checks that sends loaded before discovery has
+// found their peers wait for them, each starting once its peer turns up or
+// when it has waited long enough.
+func TestSendQueueWaitsForPeers(t *testing.T) {
+	saved, err := LoadSendQueue(filepath.Join(t.TempDir(), QueueFileName), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved.Add("a", []string{"node-a"})
+	saved.Add("b", []string{"node-b"})
+
+	q, err := LoadSendQueue(saved.path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.peers = newPeerTable()
+	q.peerWait = 300 * time.Millisecond
+	started, _ := blockSends(t, q)
+	begin := time.Now()
+	q.Start(runProgram(t, nil))
+
+	next := func() string {
+		t.Helper()
+		select {
+		case s := <-started:
+			return s.Path
+		case <-time.After(time.Second):
+			t.Fatal("no send started")
+			return ""
+		}
+	}
+	select {
+	case s := <-started:
+		t.Fatalf("%s started before its peer was found", s.Path)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.peers.heard("node-a", "10.0.0.2:9000", utils.PeerDetails{}, 0)
+	if got := next(); got != "a" {
+		t.Fatalf("%s started when node-a turned up, want a", got)
+	}
+	if got := next(); got != "b" {
+		t.Fatalf("%s started, want b once it gave up waiting", got)
+	}
+	if waited := time.Since(begin); waited < q.peerWait {
+		t.Errorf("b started after %v, before waiting %v for its peer", waited, q.peerWait)
+	}
+}
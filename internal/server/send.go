@@ -0,0 +1,674 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"shareIt/internal/protocol"
+	"shareIt/internal/ratelimit"
+	"shareIt/internal/utils"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// chunkSize is how much of the source is read at a time and handed to
+// every peer.
+const chunkSize = 64 * 1024
+
+// peerQueue is how many chunks a peer may fall behind the reader before the
+// reader waits for it.
+const peerQueue = 16
+
+// source is a file or directory tree about to be offered to peers.
+type source struct {
+	path     string
+	name     string // Name offered to peers
+	label    string // Name shown in progress rows; folders get a trailing '/'
+	kind     protocol.OfferKind
+	size     int64
+	manifest protocol.Manifest
+	mode     uint32
+	modTime  time.Time
+
+	compressible bool // The start of the data shrinks under gzip
+}
+
+// openSource stats filePath and, for a folder, builds its manifest.
+func openSource(filePath string) (*source, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	src := &source{
+		path:    filePath,
+		name:    filepath.Base(filePath),
+		kind:    protocol.KindFile,
+		size:    info.Size(),
+		mode:    uint32(info.Mode().Perm()),
+		modTime: info.ModTime(),
+	}
+	if abs, err := filepath.Abs(filePath); err == nil {
+		src.name = filepath.Base(abs) // So "." is sent under its real name
+	}
+	src.label = src.name
+
+	// A folder is offered as a manifest of its tree, then every file's bytes
+	// are streamed in manifest order.
+	if info.IsDir() {
+		src.kind = protocol.KindDirectory
+		src.label = src.name + "/"
+		if src.manifest, src.size, err = buildManifest(filePath); err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := src.open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	src.compressible = compressible(r)
+	return src, nil
+}
+
+// open returns a reader over exactly the bytes that go on the wire.
+func (s *source) open() (io.ReadCloser, error) {
+	if s.kind == protocol.KindDirectory {
+		return &treeReader{root: s.path, entries: s.manifest.Entries}, nil
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// peerSend is one peer's share of a send.
+type peerSend struct {
+	addr     string
+	conn     net.Conn
+	handle   *utils.TransferHandle
+	frames   *protocol.FrameWriter
+	start    int64 // Bytes the peer already holds and is not sent again
+	progress *utils.ProgressWriter
+	comp     *compressor // Nil unless the stream is gzipped
+	chunks   chan []byte
+	err      error // First write error; the peer is skipped from then on
+
+	peerCancelled atomic.Bool
+	status        chan statusResult // The peer's verdict, sent once by readControl
+	watch         *watchdog
+}
+
+// statusResult is the peer's Status, or why it never arrived.
+type statusResult struct {
+	status protocol.Status
+	err    error
+}
+
+// cancelTimeout bounds how long a cancel waits to reach a peer that has
+// stopped reading.
+const cancelTimeout = 5 * time.Second
+
+// SendOp is the stage of a send that failed.
+type SendOp string
+
+const (
+	OpRead      SendOp = "reading source"
+	OpConnect   SendOp = "connecting"
+	OpHandshake SendOp = "handshake"
+	OpOffer     SendOp = "offering"
+	OpTransfer  SendOp = "sending data"
+	OpVerify    SendOp = "verifying"
+)
+
+// SendError says why sending a file or folder to one peer failed.
+type SendError struct {
+	Path string
+	Peer string
+	Op   SendOp
+	Err  error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Target is a peer to send to: the device the user picked, and the
+// addresses to try it at, in order.
+type Target struct {
+	NodeID string
+	Addrs  []string
+}
+
+// SendToPeers offers a file or folder to every peer at once and streams it
+// to all that accept, reading the source only once. Each peer succeeds or
+// fails on its own; a slow or paused peer only holds the others back once
+// it is peerQueue chunks behind.
+//
+// Every failure is reported to the UI as a TransferFailedMsg and returned
+// as a *SendError, joined if several peers failed. A peer declining is not
+// a failure.
+func SendToPeers(filePath string, peers []Target, p *tea.Program) error {
+	src, err := openSource(filePath)
+	if err != nil {
+		// There is nothing to offer anyone; fail every row at once.
+		var errs []error
+		for _, peer := range peers {
+			errs = append(errs, reportFailure(p, utils.NewTransferID(), filePath, filepath.Base(filePath), peer.Addrs[0], OpRead, err))
+		}
+		return errors.Join(errs...)
+	}
+
+	// Offer to everyone in parallel. The stream starts once all have answered.
+	sessions := make([]*peerSend, len(peers))
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sessions[i], errs[i] = offerTo(src, peer, p)
+		}()
+	}
+	wg.Wait()
+
+	var active []*peerSend
+	for _, ps := range sessions {
+		if ps != nil {
+			active = append(active, ps)
+		}
+	}
+	if len(active) == 0 {
+		return errors.Join(errs...)
+	}
+
+	sum, readErr := stream(src, active)
+
+	// Every peer checks the digest on its own; wait for all verdicts.
+	var mu sync.Mutex
+	for _, ps := range active {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer ps.conn.Close()
+			defer ps.watch.stop()
+			op, err := finishSend(ps, sum, readErr)
+			if err != nil {
+				err = reportFailure(p, ps.handle.ID, src.path, src.label, ps.addr, op, err)
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return
+			}
+			log.Printf("Finished sending %s to %s: verified", src.name, ps.addr)
+			p.Send(utils.TransferDoneMsg{ID: ps.handle.ID, Filename: src.label, Direction: "Sending", Peer: ps.addr})
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// reportFailure logs a failed send, tells the UI and returns the failure as
+// a *SendError.
+func reportFailure(p *tea.Program, id utils.TransferID, path, label, peer string, op SendOp, err error) error {
+	serr := &SendError{Path: path, Peer: peer, Op: op, Err: err}
+	log.Printf("Sending %s to %s failed: %v", path, peer, serr)
+	p.Send(utils.TransferFailedMsg{ID: id, Filename: label, Path: path, Peer: peer, Err: serr})
+	return serr
+}
+
+// offerTo connects to peer at the first of its addresses where it answers
+// and offers src. It returns a nil peerSend if the peer could not be reached
+// or declined, having already told the UI why; only the former is an error.
+func offerTo(src *source, peer Target, p *tea.Program) (*peerSend, error) {
+	addr := peer.Addrs[0]
+	h := utils.NewTransferHandle()
+	p.Send(utils.TransferStartedMsg{ID: h.ID, Filename: src.label, Direction: "Sending", Peer: addr, Handle: h})
+	fail := func(op SendOp, err error) (*peerSend, error) {
+		if h.Cancelled() {
+			err = utils.ErrCancelled
+		}
+		return nil, reportFailure(p, h.ID, src.path, src.label, addr, op, err)
+	}
+
+	// An address where some other device answers is tried no further than
+	// one where nothing does.
+	var conn *tls.Conn
+	var ack protocol.HelloAck
+	var sess *session
+	op, err := OpConnect, errors.New("no address to connect to")
+	for _, a := range peer.Addrs {
+		if h.Cancelled() {
+			break
+		}
+		addr = a
+		if conn, err = dialPeer(addr); err != nil {
+			op = OpConnect
+			log.Printf("Could not connect to %s: %v", addr, err)
+			continue
+		}
+		// Until the data stream starts there is nothing to tell the peer; just hang up.
+		c := conn
+		h.OnCancel(func() { c.Close() })
+		setDeadline(conn, handshakeTimeout)
+		if ack, sess, err = greet(conn, peer.NodeID, addr, p); err == nil {
+			err = sess.mayTransfer()
+		}
+		if err == nil {
+			break
+		}
+		conn.Close()
+		op, err = OpHandshake, unresponsive(err)
+		log.Printf("Handshake with %s failed: %v", addr, err)
+	}
+	if err != nil {
+		return fail(op, err)
+	}
+	log.Printf("Handshake with %s ok (node %s, v%d, paired: %t)", addr, ack.NodeID, ack.Version, sess.paired)
+
+	err = protocol.WriteRequest(conn, protocol.RequestOffer)
+	if err == nil {
+		err = protocol.WriteOffer(conn, protocol.Offer{
+			Name:       src.name,
+			Size:       src.size,
+			SenderName: opts.DeviceName,
+			Kind:       src.kind,
+			Mode:       src.mode,
+			ModTime:    src.modTime,
+		})
+	}
+	if err == nil && src.kind == protocol.KindDirectory {
+		err = protocol.WriteManifest(conn, src.manifest)
+	}
+	if err != nil {
+		conn.Close()
+		return fail(OpOffer, unresponsive(err))
+	}
+
+	// Block until the receiving user has made up their mind, after our turn
+	// comes up if the receiver has us queued.
+	var answer protocol.Answer
+	for {
+		conn.SetReadDeadline(time.Now().Add(answerTimeout))
+		answer, err = protocol.ReadAnswer(conn)
+		if err != nil || answer.Decision != protocol.DecisionQueued {
+			break
+		}
+		p.Send(utils.TransferQueuedMsg{ID: h.ID, Filename: src.label, Direction: "Sending", Peer: addr, Position: int(answer.Position)})
+	}
+	if err != nil {
+		conn.Close()
+		return fail(OpOffer, fmt.Errorf("no answer: %w", unresponsive(err)))
+	}
+	if answer.Decision != protocol.DecisionAccept {
+		conn.Close()
+		log.Printf("%s declined %s: %s", addr, src.name, answer.Reason)
+		var reason string
+		if answer.Reason != protocol.ReasonDeclined {
+			reason = answer.Reason.String()
+		}
+		p.Send(utils.TransferDeclinedMsg{ID: h.ID, Filename: src.label, Peer: addr, Reason: reason})
+		return nil, nil
+	}
+	log.Printf("%s accepted %s as %s", addr, src.name, answer.Name)
+
+	// The peer already has the start of this file; skip it if it matches ours.
+	var start int64
+	if src.kind == protocol.KindFile && answer.Offset > 0 && answer.Offset < src.size {
+		if sum, err := hashFilePrefix(sha256.New(), src.path, answer.Offset); err == nil && sum == answer.PrefixHash {
+			start = answer.Offset
+		} else {
+			log.Printf("Cannot resume %s on %s, partial copy differs; sending from the start", src.name, addr)
+		}
+	}
+	// Only compress what the peer can decode and what is worth it.
+	codec := protocol.CodecNone
+	if src.compressible && ack.Capabilities.Has(protocol.CapGzip) {
+		codec = protocol.CodecGzip
+	}
+	setDeadline(conn, handshakeTimeout)
+	if err := protocol.WriteStart(conn, protocol.Start{Offset: start, Codec: codec}); err != nil {
+		conn.Close()
+		return fail(OpOffer, unresponsive(err))
+	}
+	// From here on the stall detector takes over.
+	conn.SetDeadline(time.Time{})
+
+	progressWriter := utils.NewProgressWriter(h.ID, src.size, src.label, "Sending", addr, p)
+	progressWriter.SetOffset(start)
+	var comp *compressor
+	if codec == protocol.CodecGzip {
+		comp = newCompressor()
+		progressWriter.SetCodec(codec.String())
+	}
+	ps := &peerSend{
+		addr:     addr,
+		conn:     conn,
+		handle:   h,
+		frames:   protocol.NewFrameWriter(conn),
+		start:    start,
+		progress: progressWriter,
+		comp:     comp,
+		chunks:   make(chan []byte, peerQueue),
+		status:   make(chan statusResult, 1),
+	}
+	h.OnCancel(ps.cancel)
+	ps.watch = watch(h, conn)
+	go ps.readControl(p)
+	return ps, nil
+}
+
+// cancel tells the peer we are abandoning the transfer and hangs up. The
+// deadline also unblocks a data write stuck on a peer that stopped reading.
+func (ps *peerSend) cancel() {
+	ps.conn.SetWriteDeadline(time.Now().Add(cancelTimeout))
+	ps.frames.Write(protocol.FrameCancel, []byte(utils.ErrCancelled.Error()))
+	ps.conn.Close()
+}
+
+// readControl reads the frames the peer sends back while we stream: pause
+// and resume notices, a cancel, and finally its Status.
+func (ps *peerSend) readControl(p *tea.Program) {
+	for {
+		f, err := protocol.ReadFrame(ps.conn)
+		if err != nil {
+			ps.status <- statusResult{err: ps.watch.err(err)}
+			return
+		}
+		switch f.Type {
+		case protocol.FramePause, protocol.FrameResume:
+			ps.watch.setPeerPaused(f.Type == protocol.FramePause)
+			p.Send(utils.TransferPausedMsg{ID: ps.handle.ID, Paused: f.Type == protocol.FramePause})
+		case protocol.FrameCancel:
+			log.Printf("%s cancelled the transfer: %s", ps.addr, protocol.CancelReason(f.Payload))
+			ps.peerCancelled.Store(true)
+			ps.conn.Close()
+		case protocol.FrameStatus:
+			status, err := protocol.ParseStatus(f.Payload)
+			ps.status <- statusResult{status: status, err: err}
+			return
+		default:
+			ps.status <- statusResult{err: fmt.Errorf("unexpected %s frame from receiver", f.Type)}
+			ps.conn.Close()
+			return
+		}
+	}
+}
+
+// stream reads src once and hands every chunk to each peer's writer. It
+// returns the SHA-256 of the whole source and any error reading it.
+func stream(src *source, peers []*peerSend) ([32]byte, error) {
+	var sum [32]byte
+	var wg sync.WaitGroup
+	for _, ps := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ps.write()
+		}()
+	}
+	defer wg.Wait()
+	defer func() {
+		for _, ps := range peers {
+			close(ps.chunks)
+		}
+	}()
+
+	r, err := src.open()
+	if err != nil {
+		return sum, err
+	}
+	defer r.Close()
+
+	hasher := sha256.New()
+	// Send exactly the size we offered, even if a file grows meanwhile.
+	limited := io.LimitReader(r, src.size)
+	var sent int64
+	for {
+		// Each chunk gets its own buffer since peers consume it concurrently.
+		buf := make([]byte, chunkSize)
+		n, err := io.ReadFull(limited, buf)
+		if n > 0 {
+			chunk := buf[:n]
+			hasher.Write(chunk)
+			sent += int64(n)
+			for _, ps := range peers {
+				ps.chunks <- chunk
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return sum, err
+		}
+	}
+	if sent != src.size {
+		return sum, fmt.Errorf("%s shrank while sending (%d of %d bytes)", src.name, sent, src.size)
+	}
+	copy(sum[:], hasher.Sum(nil))
+	return sum, nil
+}
+
+// write sends every chunk to the peer, skipping the bytes it already holds.
+// After the first error it keeps draining so the reader never blocks on it.
+// While it has nothing to send, because the reader is held up by a slower
+// peer, it sends keepalives so this peer does not think it stalled.
+func (ps *peerSend) write() {
+	skip := ps.start
+	keepalive := time.NewTicker(protocol.KeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		var chunk []byte
+		select {
+		case c, ok := <-ps.chunks:
+			if !ok {
+				return
+			}
+			chunk = c
+		case <-keepalive.C:
+			if ps.err == nil && !ps.handle.Paused() {
+				ps.send(protocol.FrameKeepalive, nil)
+			}
+			continue
+		}
+		if ps.err != nil {
+			continue
+		}
+		if skip >= int64(len(chunk)) {
+			skip -= int64(len(chunk))
+			continue
+		}
+		chunk = chunk[skip:]
+		skip = 0
+		if err := waitIfPaused(ps.handle, ps.frames); err != nil {
+			ps.err = err
+			continue
+		}
+		payload := chunk
+		if ps.comp != nil {
+			var err error
+			if payload, err = ps.comp.compress(chunk); err != nil {
+				ps.err = err
+				continue
+			}
+		}
+		// The limits apply to what actually crosses the network.
+		if err := throttle(ps.handle, len(payload)); err != nil {
+			ps.err = err
+			continue
+		}
+		if ps.send(protocol.FrameData, payload); ps.err != nil {
+			continue
+		}
+		ps.progress.AddWire(len(payload))
+		ps.progress.Write(chunk)
+	}
+}
+
+// send writes one frame, recording the first failure in ps.err.
+func (ps *peerSend) send(t protocol.FrameType, payload []byte) {
+	ps.watch.begin()
+	err := ps.frames.Write(t, payload)
+	ps.watch.end()
+	if err != nil {
+		ps.err = ps.watch.err(err)
+	}
+}
+
+// globalLimit caps all sends and receives together.
+var globalLimit = ratelimit.New(0)
+
+// SetMaxRate sets the global limit in bytes per second; 0 lifts it.
+func SetMaxRate(rate int64) {
+	globalLimit.SetRate(rate)
+}
+
+// MaxRate returns the global limit in bytes per second, 0 if unlimited.
+func MaxRate() int64 {
+	return globalLimit.Rate()
+}
+
+// throttle holds a transfer about to move n bytes to both the global limit
+// and its own.
+func throttle(h *utils.TransferHandle, n int) error {
+	globalLimit.Wait(n, h.Done())
+	h.Limit().Wait(n, h.Done())
+	if h.Cancelled() {
+		return utils.ErrCancelled
+	}
+	return nil
+}
+
+// waitIfPaused holds the calling transfer loop while h is paused, telling
+// the peer when the pause starts and ends.
+func waitIfPaused(h *utils.TransferHandle, frames *protocol.FrameWriter) error {
+	if !h.Paused() {
+		return h.Wait()
+	}
+	if err := frames.Write(protocol.FramePause, nil); err != nil {
+		return err
+	}
+	if err := h.Wait(); err != nil {
+		return err
+	}
+	return frames.Write(protocol.FrameResume, nil)
+}
+
+// finishSend sends the trailer and waits for the peer's verdict. On failure
+// it also says which stage failed.
+func finishSend(ps *peerSend, sum [32]byte, readErr error) (SendOp, error) {
+	if err := ps.cancelled(); err != nil {
+		return OpTransfer, err
+	}
+	if readErr != nil {
+		return OpRead, readErr
+	}
+	if ps.err != nil {
+		return OpTransfer, connLost(ps.err)
+	}
+	if ps.comp != nil {
+		tail, err := ps.comp.close()
+		if err != nil {
+			return OpTransfer, err
+		}
+		ps.send(protocol.FrameData, tail)
+	}
+	if ps.err == nil {
+		ps.send(protocol.FrameTrailer, protocol.TrailerFrame(protocol.Trailer{SHA256: sum}))
+	}
+	if ps.err != nil {
+		if cerr := ps.cancelled(); cerr != nil {
+			return OpTransfer, cerr
+		}
+		return OpTransfer, connLost(ps.err)
+	}
+
+	// Wait for the receiver to check the digest before calling it done.
+	ps.conn.SetReadDeadline(time.Now().Add(verifyTimeout))
+	res := <-ps.status
+	if err := ps.cancelled(); err != nil {
+		return OpTransfer, err
+	}
+	if res.err != nil {
+		return OpVerify, fmt.Errorf("no confirmation from peer: %w", unresponsive(res.err))
+	}
+	return OpVerify, res.status.Err()
+}
+
+// cancelled says which side cancelled the transfer, if either did.
+func (ps *peerSend) cancelled() error {
+	switch {
+	case ps.handle.Cancelled():
+		return utils.ErrCancelled
+	case ps.peerCancelled.Load():
+		return utils.ErrCancelledByPeer
+	}
+	return nil
+}
+
+// treeReader reads the files of a manifest back to back, each cut to the
+// size recorded in the manifest.
+type treeReader struct {
+	root    string
+	entries []protocol.ManifestEntry
+	cur     *os.File
+	left    int64 // Bytes still owed from cur
+}
+
+func (t *treeReader) Read(p []byte) (int, error) {
+	for t.cur == nil || t.left == 0 {
+		if t.cur != nil {
+			t.cur.Close()
+			t.cur = nil
+		}
+		if len(t.entries) == 0 {
+			return 0, io.EOF
+		}
+		e := t.entries[0]
+		t.entries = t.entries[1:]
+		if e.IsDir {
+			continue
+		}
+		f, err := os.Open(filepath.Join(t.root, filepath.FromSlash(e.Path)))
+		if err != nil {
+			return 0, err
+		}
+		t.cur, t.left = f, e.Size
+	}
+
+	if int64(len(p)) > t.left {
+		p = p[:t.left]
+	}
+	n, err := t.cur.Read(p)
+	t.left -= int64(n)
+	if err == io.EOF && t.left > 0 {
+		// A file shrank since the manifest was built.
+		return n, fmt.Errorf("%s: %w", t.cur.Name(), io.ErrUnexpectedEOF)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (t *treeReader) Close() error {
+	if t.cur != nil {
+		return t.cur.Close()
+	}
+	return nil
+}
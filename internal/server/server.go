@@ -2,48 +2,130 @@ package server
 
 import (
 	"bufio"
-	"encoding/binary"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"shareIt/internal/protocol"
+	"shareIt/internal/storage"
+	"shareIt/internal/trust"
 	"shareIt/internal/utils"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
 
-const TestFile1 =  "D:/Elden Ring Nightreign [DODI Repack]/data1.doi"
-const TestFile2 = "C:/Users/prana_zhfhs6u/Downloads/parsec-windows.exe"
+// Options holds the per-device settings used by the transfer code.
+type Options struct {
+	NodeID          protocol.NodeID
+	DeviceName      string // Shown to receivers when we offer them a file
+	AppVersion      string // Announced to other devices
+	DownloadDir     string // Where received files are written
+	CollisionPolicy storage.CollisionPolicy
+	Certificate     tls.Certificate // This device's key, presented on every connection
+	Trust           *trust.Store    // Certificates pinned per peer
+	Devices         *trust.Devices  // Devices paired with a code
+	RequirePairing  bool            // Refuse transfers with devices that are not paired
+	Metadata        storage.MetadataPolicy
+	Partials        storage.PartialPolicy // What to do with downloads cut off halfway
+	MaxFileSize     int64                 // Largest single file accepted; 0 for no limit
+	Quota           int64                 // Most the download directory may hold; 0 for no limit
+	StallTimeout    time.Duration         // Fail a transfer blocked on its peer this long; 0 for the default
+	MaxIncoming     int                   // Incoming transfers run at once, the rest queue; 0 for the default
+	MaxPeerConns    int                   // Connections one address may hold open; 0 for the default
+	Interfaces      []string              // Interface names or addresses to use; empty for all
+}
+
+var opts Options
+
+// Configure sets the options used by StartTcpServer and SendFile. It must be
+// called before either of them.
+func Configure(o Options) {
+	opts = o
+}
+
+// localHello is what we introduce ourselves with on every connection.
+func localHello() protocol.Hello {
+	return protocol.Hello{
+		Version:      protocol.ProtocolVersion,
+		NodeID:       opts.NodeID,
+		Capabilities: localCapabilities,
+	}
+}
 
 func StartTcpServer(killSwitch chan os.Signal, port int, p *tea.Program) {
-	listenAddr := fmt.Sprintf("0.0.0.0:%d", port)
-	listener, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		log.Fatal(err)
+	addrs := listenAddrs(port)
+	if len(addrs) == 0 {
+		log.Fatalf("None of the chosen interfaces %q has an IPv4 address to listen on", opts.Interfaces)
+	}
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		listener, err := listen(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer listener.Close()
+		listeners = append(listeners, listener)
+		log.Printf("Listening for transfers on %s", addr)
 	}
-	defer listener.Close()
 
 	var wg sync.WaitGroup
+	var conns sync.Map // Open connections, closed on shutdown
+	var counter connCounter
 
-	go func(){
-		for{
-			conn , err := listener.Accept()
-			if err != nil {
-				log.Println("listener err:", err)
-				return
+	for _, listener := range listeners {
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					log.Println("listener err:", err)
+					return
+				}
+				host := remoteHost(conn)
+				busy, ok := counter.admit(host)
+				if !ok {
+					log.Printf("Dropped connection from %s: %d connections open", conn.RemoteAddr(), maxConnections)
+					conn.Close()
+					continue
+				}
+
+				wg.Add(1)
+				conns.Store(conn, struct{}{})
+				go func() {
+					defer counter.release(host)
+					defer conns.Delete(conn)
+					if busy {
+						defer wg.Done()
+						log.Printf("Turned away %s: too many connections from it", conn.RemoteAddr())
+						turnAway(conn)
+						return
+					}
+					p.Send(utils.LogMsg{Message: fmt.Sprintf("Accepted connection from %s", conn.RemoteAddr())})
+					readLoop(conn, &wg, p)
+				}()
 			}
-			
-			wg.Add(1)
-			p.Send(utils.LogMsg{Message: fmt.Sprintf("Accepted connection from %s", conn.RemoteAddr())})
-			go readLoop(conn, &wg, p)
-		}
-	}()
+		}()
+	}
 	<-killSwitch
 	log.Println("Shutdown signal received, closing listener...")
-	listener.Close()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	// Cut off transfers in flight so their partial files are kept for
+	// resuming or deleted, as configured.
+	conns.Range(func(c, _ any) bool {
+		c.(net.Conn).Close()
+		return true
+	})
 	wg.Wait()
 	log.Println("All connections closed. Server gracefully shut down.")
 }
@@ -51,104 +133,824 @@ func StartTcpServer(killSwitch chan os.Signal, port int, p *tea.Program) {
 func readLoop(conn net.Conn, wg *sync.WaitGroup, p *tea.Program){
 	defer conn.Close()
 	defer wg.Done()
+
+	// Nothing is read as a file until the peer has proven it speaks our protocol.
+	setDeadline(conn, handshakeTimeout)
+	hello, err := protocol.ServerHandshake(conn, protocol.HelloAck{
+		Version:      protocol.ProtocolVersion,
+		NodeID:       opts.NodeID,
+		Capabilities: localCapabilities,
+	})
+	if err != nil {
+		log.Printf("Rejected connection from %s: %v", conn.RemoteAddr(), err)
+		p.Send(utils.LogMsg{Message: fmt.Sprintf("Rejected connection from %s: %v", conn.RemoteAddr(), err)})
+		return
+	}
+	sess, err := authenticate(conn, hello.NodeID, conn.RemoteAddr().String(), false, p)
+	if err != nil {
+		log.Printf("Rejected connection from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	log.Printf("Handshake with %s ok (node %s, v%d, paired: %t)", conn.RemoteAddr(), hello.NodeID, hello.Version, sess.paired)
+
 	for{
 
-		// Read the filename length
-		var filenameLength int64
-		err := binary.Read(conn, binary.LittleEndian, &filenameLength)
+		// A peer may keep the connection for another request, but not forever.
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		kind, err := protocol.ReadRequest(conn)
 		if err != nil {
-			log.Printf("Error reading filename length: %v", err)
+			if err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Printf("Error reading request: %v", err)
+			}
 			return
 		}
+		setDeadline(conn, handshakeTimeout)
+		if kind == protocol.RequestPair {
+			if err := respondPairing(conn, sess, p); err != nil {
+				log.Printf("Pairing with %s failed: %v", conn.RemoteAddr(), err)
+				return
+			}
+			continue
+		}
 
-		// Read the filename
-		filenameBytes := make([]byte, filenameLength)
-		_, err = io.ReadFull(conn, filenameBytes)
+		offer, err := protocol.ReadOffer(conn)
 		if err != nil {
-			log.Printf("Error reading filename: %v", err)
+			log.Printf("Error reading offer: %v", err)
 			return
 		}
-		filename := string(filenameBytes)
-		log.Printf("Received filename header: %s", filename)
+		log.Printf("Received offer for %s (%d bytes) from %s", offer.Name, offer.Size, offer.SenderName)
 
-		//Read the file content size
-		var fileSize int64
-		err = binary.Read(conn,binary.LittleEndian,&fileSize)
-		if err != nil {
-			log.Printf("Error reading file size: %v", err)
+		if err := receiveFile(conn, p, sess, offer); err != nil {
+			log.Printf("Receiving %s from %s failed: %v", offer.Name, conn.RemoteAddr(), err)
 			return
 		}
-		log.Printf("Received file size header: %d bytes", fileSize)
+	}
+}
+
+// receiveFile answers one offer and, if it is accepted, writes the file or
+// directory tree to disk. An error means the connection is no longer usable.
+func receiveFile(conn net.Conn, p *tea.Program, sess *session, offer protocol.Offer) error {
+	var manifest protocol.Manifest
+	if offer.Kind == protocol.KindDirectory {
+		var err error
+		if manifest, err = protocol.ReadManifest(conn); err != nil {
+			return fmt.Errorf("reading manifest: %w", err)
+		}
+	}
 
-		outFile, err := os.Create(filename)
+	// Ask the user before anything touches the disk, unless we do not take
+	// files from this device at all.
+	var dest destination
+	accepted := false
+	reason := protocol.ReasonNotAllowed
+	if err := sess.mayTransfer(); err != nil {
+		log.Printf("Declining %s from %s: %v", offer.Name, conn.RemoteAddr(), err)
+		p.Send(utils.LogMsg{Message: fmt.Sprintf("Declined %s from %s: %v", offer.Name, offer.SenderName, err)})
+	} else {
+		// Wait for a free slot before bothering the user.
+		label, err := storage.SanitizeName(offer.Name)
 		if err != nil {
-			log.Printf("Error creating destination file: %v", err)
-			return
+			label = "?"
+		}
+		if offer.Kind == protocol.KindDirectory {
+			label += "/"
+		}
+		release, err := incoming.acquire(conn, p, label, conn.RemoteAddr().String())
+		switch {
+		case errors.Is(err, errQueueFull):
+			log.Printf("Declining %s from %s: %v", offer.Name, conn.RemoteAddr(), err)
+			reason = protocol.ReasonBusy
+		case err != nil:
+			return fmt.Errorf("waiting for a free slot: %w", err)
+		default:
+			defer release()
+			dest, reason, accepted = acceptOffer(p, offer, manifest, sess.nodeID, conn.RemoteAddr().String())
+			if accepted {
+				defer dest.release()
+			}
+		}
+	}
+	if !opts.Metadata.Allows(sess.paired) {
+		dest.meta = nil
+	}
+	hasher := sha256.New()
+	answer := protocol.Answer{Decision: protocol.DecisionReject, Reason: reason}
+	if accepted {
+		answer = protocol.Answer{Decision: protocol.DecisionAccept, Name: filepath.Base(dest.path)}
+		if dest.offset > 0 {
+			// Prove which bytes we already hold so the sender can skip them.
+			sum, err := hashFilePrefix(hasher, dest.part, dest.offset)
+			if err != nil {
+				log.Printf("Cannot resume %s, starting over: %v", dest.part, err)
+				hasher.Reset()
+			} else {
+				answer.Offset = dest.offset
+				answer.PrefixHash = sum
+			}
 		}
-		defer outFile.Close()
+	}
+	// The user may have taken longer than any deadline set so far.
+	setDeadline(conn, handshakeTimeout)
+	if err := protocol.WriteAnswer(conn, answer); err != nil {
+		return fmt.Errorf("sending answer: %w", err)
+	}
+	if !accepted {
+		log.Printf("Declined %s from %s: %s", offer.Name, offer.SenderName, reason)
+		return nil
+	}
 
-		// Create a progress writer to track the download.
-		progressWriter := utils.NewProgressWriter(fileSize, filename, "Receiving", p)
-		// Create a MultiWriter to write to both the file and the progress bar.
-		destWriter := io.MultiWriter(outFile, progressWriter)
+	start, err := protocol.ReadStart(conn)
+	if err != nil {
+		return fmt.Errorf("reading start: %w", err)
+	}
+	if start.Offset != 0 && start.Offset != answer.Offset {
+		return fmt.Errorf("sender wants to start at byte %d but we hold %d", start.Offset, answer.Offset)
+	}
+	if start.Offset == 0 {
+		// The sender did not take up our resume offer; forget the prefix.
+		hasher.Reset()
+	}
 
-		_, err = io.CopyN(destWriter,conn,fileSize)
-		if err != nil{
-			log.Printf("Error during file copy: %v", err)
+	name := filepath.Base(dest.path)
+	entries := dest.files
+	if offer.Kind == protocol.KindFile {
+		entries = []receiveEntry{{path: dest.part, size: offer.Size, offset: start.Offset}}
+	}
+
+	// Disk errors are held back until the sender has finished streaming, so
+	// we can still tell it what went wrong.
+	sink := &sinkWriter{}
+	if start.Offset == 0 {
+		// Nothing from an earlier attempt is reused; clear out any leftovers.
+		if err := os.RemoveAll(dest.part); err != nil {
+			sink.err = err
 		}
-		p.Send(utils.LogMsg{Message: fmt.Sprintf("Successfully saved file %s", outFile.Name())})
+	}
+	for _, dir := range dest.dirs {
+		if err := os.MkdirAll(dir, 0o755); err != nil && sink.err == nil {
+			sink.err = err
+		}
+	}
+	// Record the download before writing it, so even a crash leaves
+	// something the sender can resume.
+	if offer.Kind == protocol.KindFile && opts.Partials == storage.PartialKeep {
+		if err := storage.SaveResume(dest.part, dest.resume(offer.Size)); err != nil {
+			log.Printf("Could not record partial download %s: %v", dest.part, err)
+		}
+	}
+
+	// From here on the stream is framed, so either side can pause or cancel,
+	// and the watchdog rather than deadlines notices a vanished sender.
+	conn.SetDeadline(time.Time{})
+	addr := conn.RemoteAddr().String()
+	h := utils.NewTransferHandle()
+	frames := protocol.NewFrameWriter(conn)
+	// Like peerSend.cancel, but the connection stays open so drain can let
+	// the cancel reach the sender. The past read deadline wakes a read
+	// waiting on a sender that has gone quiet.
+	cancelSent := make(chan struct{})
+	h.OnCancel(func() {
+		conn.SetWriteDeadline(time.Now().Add(cancelTimeout))
+		frames.Write(protocol.FrameCancel, []byte(utils.ErrCancelled.Error()))
+		conn.SetReadDeadline(time.Now())
+		close(cancelSent)
+	})
+
+	label := name
+	if offer.Kind == protocol.KindDirectory {
+		label = name + "/"
+	}
+	p.Send(utils.TransferStartedMsg{ID: h.ID, Filename: label, Direction: "Receiving", Peer: addr, Handle: h})
+
+	// Create a progress writer to track the download.
+	progressWriter := utils.NewProgressWriter(h.ID, offer.Size, label, "Receiving", addr, p)
+	progressWriter.SetOffset(start.Offset)
+	if start.Offset > 0 {
+		log.Printf("Resuming %s at byte %d of %d", name, start.Offset, offer.Size)
+	}
+	// Write to the file, the hash and the progress bar at once, and count
+	// the bytes off the space held for them.
+	destWriter := io.MultiWriter(sink, hasher, progressWriter, dest.space)
+
+	stall := watch(h, conn)
+	defer stall.stop()
+	data := &dataReader{r: conn, handle: h, frames: frames, program: p, progress: progressWriter, watch: stall}
+	var body io.Reader = data
+	var gz *gzipReader
+	if start.Codec == protocol.CodecGzip {
+		gz = &gzipReader{r: data}
+		body = gz
+		progressWriter.SetCodec(start.Codec.String())
+	}
+	err = receiveEntries(body, entries, sink, destWriter)
+	if err == nil && gz != nil {
+		err = gz.end()
+	}
+	if err == nil {
+		var trailer protocol.Trailer
+		if trailer, err = data.trailer(); err == nil {
+			return verifyReceived(frames, p, h.ID, addr, offer, dest, label, hasher, trailer, sink.err)
+		}
+	}
+
+	// A cancelled transfer is not coming back; throw away what we have.
+	if h.Cancelled() || errors.Is(err, utils.ErrCancelledByPeer) {
+		cause := utils.ErrCancelledByPeer
+		if h.Cancelled() {
+			cause = utils.ErrCancelled
+			// Let the cancel reach the sender before we hang up on it.
+			<-cancelSent
+			drain(conn)
+		}
+		dest.discard()
+		p.Send(utils.TransferDoneMsg{ID: h.ID, Filename: label, Direction: "Receiving", Peer: addr, Err: cause})
+		return cause
+	}
+
+	dest.keepPartial(offer)
+	err = stall.err(err)
+	cause := errors.New("connection lost")
+	if errors.Is(err, ErrPeerUnresponsive) {
+		cause = ErrPeerUnresponsive
+	}
+	p.Send(utils.TransferDoneMsg{ID: h.ID, Filename: label, Direction: "Receiving", Peer: addr, Err: cause})
+	return fmt.Errorf("copying file: %w", err)
+}
+
+// receiveEntry is one file to fill from the data stream.
+type receiveEntry struct {
+	path   string
+	size   int64
+	offset int64 // Bytes already on disk from an earlier attempt
+}
+
+// receiveEntries streams each entry's bytes from r into its file through w,
+// which must write to sink. Disk errors are recorded in sink and the data is
+// drained anyway; a returned error means r failed.
+func receiveEntries(r io.Reader, entries []receiveEntry, sink *sinkWriter, w io.Writer) error {
+	for _, e := range entries {
+		var f *os.File
+		if sink.err == nil {
+			var err error
+			if f, err = openDestination(e.path, e.offset); err != nil {
+				log.Printf("Error opening destination file: %v", err)
+				sink.err = err
+			} else if err := storage.Preallocate(f, e.size); err != nil {
+				log.Printf("Could not preallocate %s: %v", e.path, err)
+			}
+			sink.w = f
+		}
+
+		_, err := io.CopyN(w, r, e.size-e.offset)
+		if f != nil {
+			// A failed flush is a write error too. Sync so the rename that
+			// makes the file visible can never expose unwritten data.
+			if serr := f.Sync(); serr != nil && sink.err == nil {
+				sink.err = serr
+			}
+			if cerr := f.Close(); cerr != nil && sink.err == nil {
+				sink.err = cerr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// verifyReceived compares the sender's digest with ours, tidies up the file
+// accordingly and sends the sender our verdict.
+func verifyReceived(frames *protocol.FrameWriter, p *tea.Program, id utils.TransferID, addr string, offer protocol.Offer, dest destination, label string, hasher hash.Hash, trailer protocol.Trailer, writeErr error) error {
+	var sum [32]byte
+	copy(sum[:], hasher.Sum(nil))
+
+	status := protocol.Status{Code: protocol.StatusOK}
+	switch {
+	case writeErr != nil:
+		status = protocol.Status{Code: protocol.StatusIOError, Message: writeErr.Error()}
+		// Whatever made it to disk is still good for a later resume.
+		dest.keepPartial(offer)
+	case sum != trailer.SHA256:
+		status = protocol.Status{Code: protocol.StatusHashMismatch}
+		dest.discard()
+	default:
+		if err := dest.commit(); err != nil {
+			log.Printf("Could not move %s into place: %v", dest.path, err)
+			status = protocol.Status{Code: protocol.StatusIOError, Message: err.Error()}
+			dest.keepPartial(offer)
+			break
+		}
+		log.Printf("Saved and verified %s", dest.path)
+	}
+
+	p.Send(utils.TransferDoneMsg{ID: id, Filename: label, Direction: "Receiving", Peer: addr, Err: status.Err()})
+	if err := frames.Write(protocol.FrameStatus, protocol.StatusFrame(status)); err != nil {
+		return fmt.Errorf("sending status: %w", err)
 	}
-	
+	return nil
+}
+
+// dataReader presents the Data frames of a transfer as a plain stream,
+// handling control frames as they arrive. The Trailer frame ends it.
+type dataReader struct {
+	r        io.Reader
+	handle   *utils.TransferHandle
+	frames   *protocol.FrameWriter
+	program  *tea.Program
+	progress *utils.ProgressWriter // Counts bytes on the wire
+	watch    *watchdog
+	buf      []byte
+	end      *protocol.Trailer
 }
 
-func SendFile(filePath string,peerAddress string, p *tea.Program){
-	f , err :=os.Open(filePath)
-	if err!= nil{
-		log.Fatal("err opeing a file.",err)
+func (d *dataReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.end != nil {
+			return 0, io.EOF
+		}
+		if err := waitIfPaused(d.handle, d.frames); err != nil {
+			return 0, err
+		}
+		d.watch.begin()
+		f, err := protocol.ReadFrame(d.r)
+		d.watch.end()
+		if err != nil {
+			return 0, err
+		}
+		switch f.Type {
+		case protocol.FrameData:
+			// Reading slower holds the sender back through TCP.
+			if err := throttle(d.handle, len(f.Payload)); err != nil {
+				return 0, err
+			}
+			d.progress.AddWire(len(f.Payload))
+			d.buf = f.Payload
+		case protocol.FrameTrailer:
+			t, err := protocol.ParseTrailer(f.Payload)
+			if err != nil {
+				return 0, err
+			}
+			d.end = &t
+		case protocol.FramePause, protocol.FrameResume:
+			d.watch.setPeerPaused(f.Type == protocol.FramePause)
+			d.program.Send(utils.TransferPausedMsg{ID: d.handle.ID, Paused: f.Type == protocol.FramePause})
+		case protocol.FrameKeepalive:
+		case protocol.FrameCancel:
+			log.Printf("Sender cancelled the transfer: %s", protocol.CancelReason(f.Payload))
+			return 0, utils.ErrCancelledByPeer
+		default:
+			return 0, fmt.Errorf("unexpected %s frame from sender", f.Type)
+		}
 	}
-	defer f.Close()
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
 
-	fileInfo, err := f.Stat()
+// trailer reads up to the Trailer frame, which must follow the last byte
+// of data.
+func (d *dataReader) trailer() (protocol.Trailer, error) {
+	var extra [1]byte
+	n, err := d.Read(extra[:])
+	if n > 0 {
+		return protocol.Trailer{}, errors.New("sender sent more data than it offered")
+	}
+	if err != io.EOF {
+		return protocol.Trailer{}, err
+	}
+	return *d.end, nil
+}
+
+// drain reads and discards whatever the peer still sends until it hangs up,
+// for at most cancelTimeout.
+func drain(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(cancelTimeout))
+	io.Copy(io.Discard, conn)
+}
+
+// sinkWriter writes to w until the first error, then silently discards the
+// rest so the stream can still be read to the end. The error is kept in err.
+type sinkWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (s *sinkWriter) Write(p []byte) (int, error) {
+	if s.err == nil {
+		_, s.err = s.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// openDestination opens path for writing at offset, discarding anything
+// past it. An offset of 0 starts the file from scratch.
+func openDestination(path string, offset int64) (*os.File, error) {
+	if offset == 0 {
+		return os.Create(path)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// hashFilePrefix feeds the first n bytes of the file at path into h and
+// returns their digest.
+func hashFilePrefix(h hash.Hash, path string, n int64) ([32]byte, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Fatal("could not get file info", err)
+		return [32]byte{}, err
+	}
+	defer f.Close()
+	return storage.HashPrefix(h, bufio.NewReader(f), n)
+}
+
+// offerTimeout bounds how long a sender is kept waiting for the user to answer.
+const offerTimeout = 2 * time.Minute
+
+var nextOfferID atomic.Uint64
+
+// destination is where an accepted offer will be written.
+type destination struct {
+	path   string // Final path of the file or top-level directory
+	part   string // Path in the partial directory it is written to until verified
+	name   string // Sanitised name the sender offered, used to match resumes
+	offset int64  // Bytes of path already received in an earlier attempt
+	sender protocol.NodeID
+	space  *reservation // Disk space held for it until it ends
+
+	// Every directory to create, starting with the partial directory, and
+	// for a directory offer every file to fill, in manifest order.
+	dirs  []string
+	files []receiveEntry
+
+	// Sender's permissions and times, applied once everything is verified.
+	// Empty if the metadata policy does not trust this sender.
+	meta []entryMeta
+}
+
+// pathClaims holds the paths accepted downloads write to until they end,
+// so concurrent offers of the same name never share a file.
+type pathClaims struct {
+	sync.Mutex
+	paths map[string]bool
+}
+
+var claims = pathClaims{paths: make(map[string]bool)}
+
+// has reports whether path is claimed. c must be locked.
+func (c *pathClaims) has(path string) bool {
+	return c.paths[path]
+}
+
+// release gives up the paths and the disk space claimed for d.
+func (d destination) release() {
+	claims.Lock()
+	delete(claims.paths, d.path)
+	delete(claims.paths, d.part)
+	claims.Unlock()
+	d.space.release()
+}
+
+// entryMeta is the sender's metadata for one received file or directory.
+type entryMeta struct {
+	path    string
+	mode    uint32
+	modTime time.Time
+}
+
+// commit makes a verified download visible under its final name. The
+// sender's metadata is applied first, while nothing else can see the files.
+func (d destination) commit() error {
+	d.applyMetadata()
+	if err := os.Rename(d.part, d.path); err != nil {
+		return err
 	}
-	fileSize := fileInfo.Size()
-	filename := filepath.Base(filePath)
-	filenameLength := int64(len(filename))
+	storage.ClearResume(d.part)
+	return nil
+}
 
+// discard deletes a download that will never be completed.
+func (d destination) discard() {
+	storage.ClearResume(d.part)
+	if err := os.RemoveAll(d.part); err != nil {
+		log.Printf("Could not remove %s: %v", d.part, err)
+	}
+}
 
+// keepPartial keeps an interrupted single-file download for resuming, if
+// the partial file policy says so, and discards it otherwise.
+func (d destination) keepPartial(offer protocol.Offer) {
+	if offer.Kind != protocol.KindFile || opts.Partials != storage.PartialKeep {
+		d.discard()
+		return
+	}
+	if !storage.Exists(filepath.Dir(d.part), filepath.Base(d.part)) {
+		storage.ClearResume(d.part)
+		return
+	}
+	if err := storage.SaveResume(d.part, d.resume(offer.Size)); err != nil {
+		log.Printf("Could not record partial download %s: %v", d.part, err)
+	}
+}
 
-	conn , err := net.Dial("tcp",peerAddress)
-	if err!=nil{
-		log.Fatal(err)
+// applyMetadata sets the sender's permissions and times, children before
+// their parents so a read-only directory is finished last and writing into
+// it does not bump its time. Failures are logged; the data is still good.
+func (d destination) applyMetadata() {
+	for i := len(d.meta) - 1; i >= 0; i-- {
+		m := d.meta[i]
+		if err := storage.ApplyMetadata(m.path, m.mode, m.modTime); err != nil {
+			log.Printf("Could not keep permissions and times of %s: %v", m.path, err)
+		}
 	}
+}
 
-	//Send the filename length
-	err = binary.Write(conn, binary.LittleEndian, filenameLength)
+// resume describes d as an interrupted download of a size-byte file.
+func (d destination) resume(size int64) storage.ResumeInfo {
+	return storage.ResumeInfo{NodeID: d.sender.String(), Name: d.name, Size: size}
+}
+
+// acceptOffer sanitises the offered name, looks for an interrupted download
+// to resume, applies the collision policy and asks the user. It returns
+// false and the reason to give the sender if the offer should be declined.
+func acceptOffer(p *tea.Program, offer protocol.Offer, manifest protocol.Manifest, sender protocol.NodeID, addr string) (destination, protocol.RejectReason, bool) {
+	// Never trust the sender's name: it decides where bytes land on our disk.
+	name, err := storage.SanitizeName(offer.Name)
 	if err != nil {
-		log.Fatalf("could not write filename length to conn: %v", err)
+		log.Printf("Declining %q from %s: %v", offer.Name, addr, err)
+		return destination{}, protocol.ReasonInvalid, false
+	}
+	dest := destination{name: name, sender: sender}
+	top := entryMeta{mode: offer.Mode, modTime: offer.ModTime}
+
+	var files int
+	var rels []string // Local relative path of each manifest entry
+	if offer.Kind == protocol.KindDirectory {
+		// Check the whole tree up front so a bad entry cannot fail it halfway.
+		tree := storage.NewTreeNames()
+		var total int64
+		for _, e := range manifest.Entries {
+			rel, err := tree.Add(e.Path, e.IsDir)
+			if err != nil {
+				log.Printf("Declining %s from %s: bad manifest entry: %v", name, addr, err)
+				return destination{}, protocol.ReasonInvalid, false
+			}
+			rels = append(rels, rel)
+			if !e.IsDir {
+				files++
+				total += e.Size
+			}
+		}
+		if total != offer.Size {
+			log.Printf("Declining %s from %s: manifest adds up to %d bytes, offer says %d", name, addr, total, offer.Size)
+			return destination{}, protocol.ReasonInvalid, false
+		}
 	}
-	// send filename
-	_, err = conn.Write([]byte(filename))
+	if offer.Size < 0 {
+		log.Printf("Declining %s from %s: negative size %d", name, addr, offer.Size)
+		return destination{}, protocol.ReasonInvalid, false
+	}
+
+	var partial string
+	var offset int64
+	var resumable bool
+	if offer.Kind == protocol.KindFile {
+		partial, offset, resumable = storage.FindResume(opts.DownloadDir, sender.String(), name, offer.Size)
+	}
+	exists := !resumable && storage.Exists(opts.DownloadDir, name)
+	if exists && opts.CollisionPolicy == storage.CollisionSkip {
+		log.Printf("Skipping %s from %s: already exists", name, addr)
+		p.Send(utils.LogMsg{Message: fmt.Sprintf("Skipped %s from %s: file already exists", name, offer.SenderName)})
+		return destination{}, protocol.ReasonExists, false
+	}
+
+	// Nothing the user could say would make room for it.
+	space, reason, err := checkLimits(offer, manifest, offset)
 	if err != nil {
-		log.Fatalf("could not write filename to conn: %v", err)
+		log.Printf("Declining %s from %s: %v", name, addr, err)
+		p.Send(utils.LogMsg{Message: fmt.Sprintf("Declined %s from %s: %v", name, offer.SenderName, err)})
+		return destination{}, reason, false
 	}
-	//send file size
-	err = 	binary.Write(conn, binary.LittleEndian, fileSize)
+	// The space is held from here, so offers arriving while the user makes
+	// up their mind cannot be admitted against it too.
+	accepted := false
+	defer func() {
+		if !accepted {
+			space.release()
+		}
+	}()
+	dest.space = space
+
+	var resumeFrom int64
+	if resumable {
+		resumeFrom = offset
+	}
+	d := askReceiver(p, offer, name, files, exists && opts.CollisionPolicy == storage.CollisionAsk, resumeFrom, addr)
+	if !d.Accept {
+		return destination{}, protocol.ReasonDeclined, false
+	}
+	if d.Name != "" {
+		if name, err = storage.SanitizeName(d.Name); err != nil {
+			log.Printf("Declining %s: invalid name %q: %v", offer.Name, d.Name, err)
+			return destination{}, protocol.ReasonInvalid, false
+		}
+	}
+
+	// Resolve and claim in one go, or two offers of the same name could
+	// both pick the same free path.
+	claims.Lock()
+	dest.path, err = storage.Resolve(opts.DownloadDir, name, opts.CollisionPolicy, d.Overwrite, claims.has)
 	if err != nil {
-		log.Fatalf("could not write file size to conn: %v", err)
+		claims.Unlock()
+		log.Printf("Declining %s: %v", name, err)
+		if errors.Is(err, storage.ErrSkipped) {
+			return destination{}, protocol.ReasonExists, false
+		}
+		return destination{}, protocol.ReasonError, false
+	}
+	dest.part = storage.PartPath(dest.path)
+	if d.Name == "" && resumable && !claims.has(partial) {
+		// Pick up the interrupted download where it stopped.
+		dest.part, dest.offset = partial, offset
+	}
+	claims.paths[dest.path] = true
+	claims.paths[dest.part] = true
+	claims.Unlock()
+	if dest.offset < offset {
+		// The partial is not resumed after all, so the whole file is still
+		// to come, not only what the partial was missing.
+		if reason, err := space.grow(offset - dest.offset); err != nil {
+			dest.release()
+			log.Printf("Declining %s from %s: %v", name, addr, err)
+			p.Send(utils.LogMsg{Message: fmt.Sprintf("Declined %s from %s: %v", name, offer.SenderName, err)})
+			return destination{}, reason, false
+		}
+	}
+	top.path = dest.part
+	dest.meta = []entryMeta{top}
+	// CleanPartials removes the partial directory once it is empty.
+	dest.dirs = []string{filepath.Dir(dest.part)}
+
+	if offer.Kind == protocol.KindDirectory {
+		dest.dirs = append(dest.dirs, dest.part)
+		for i, e := range manifest.Entries {
+			local := filepath.Join(dest.part, rels[i])
+			dest.meta = append(dest.meta, entryMeta{path: local, mode: e.Mode, modTime: e.ModTime})
+			if e.IsDir {
+				dest.dirs = append(dest.dirs, local)
+			} else {
+				dest.dirs = append(dest.dirs, filepath.Dir(local))
+				dest.files = append(dest.files, receiveEntry{path: local, size: e.Size})
+			}
+		}
+	}
+	accepted = true
+	return dest, 0, true
+}
+
+// diskReserve is free space left untouched by any download, so accepting
+// a file never fills the volume to the last byte.
+const diskReserve = 64 << 20
+
+// reserved counts the bytes accepted downloads are still to write. They
+// are not on disk yet, so neither DirSize nor FreeSpace sees them, except
+// where Preallocate has already taken them from the free space; counting
+// those twice errs on the side of refusing.
+var reserved struct {
+	sync.Mutex
+	bytes int64
+}
+
+// reservation is one download's share of reserved. It shrinks as the
+// download writes, and whatever is left is given back when it ends.
+type reservation struct {
+	left int64 // Guarded by reserved
+}
+
+// Write counts len(p) bytes as written to disk.
+func (r *reservation) Write(p []byte) (int, error) {
+	r.take(int64(len(p)))
+	return len(p), nil
+}
+
+// release gives back what is left of r.
+func (r *reservation) release() {
+	r.take(math.MaxInt64)
+}
+
+// take removes up to n bytes from r and from reserved.
+func (r *reservation) take(n int64) {
+	if r == nil {
+		return
+	}
+	reserved.Lock()
+	defer reserved.Unlock()
+	n = min(n, r.left)
+	r.left -= n
+	reserved.bytes -= n
+}
+
+// checkLimits checks an offer against the size limit, the quota and the
+// free disk space, counting what earlier accepted downloads have still to
+// write, and holds the space it needs. offset is how much of the file is
+// already on disk from an interrupted attempt; if that is not resumed
+// after all, grow holds the rest.
+func checkLimits(offer protocol.Offer, manifest protocol.Manifest, offset int64) (*reservation, protocol.RejectReason, error) {
+	if opts.MaxFileSize > 0 {
+		largest := offer.Size
+		if offer.Kind == protocol.KindDirectory {
+			largest = 0
+			for _, e := range manifest.Entries {
+				largest = max(largest, e.Size)
+			}
+		}
+		if largest > opts.MaxFileSize {
+			return nil, protocol.ReasonTooLarge, fmt.Errorf("%s is over the %s limit", utils.HumanBytes(largest), utils.HumanBytes(opts.MaxFileSize))
+		}
 	}
 
-	bufferedReader := bufio.NewReader(f)
+	need := offer.Size - offset
+	reserved.Lock()
+	defer reserved.Unlock()
+	if reason, err := admit(need); err != nil {
+		return nil, reason, err
+	}
+	reserved.bytes += need
+	return &reservation{left: need}, 0, nil
+}
 
-	progressWriter := utils.NewProgressWriter(fileSize, filename, "Sending", p)
+// grow holds n more bytes for r, if the quota and the free disk space
+// allow it.
+func (r *reservation) grow(n int64) (protocol.RejectReason, error) {
+	reserved.Lock()
+	defer reserved.Unlock()
+	if reason, err := admit(n); err != nil {
+		return reason, err
+	}
+	r.left += n
+	reserved.bytes += n
+	return 0, nil
+}
 
-	reader := io.TeeReader(bufferedReader, progressWriter)
+// admit checks that need more bytes fit under the quota and in the free
+// disk space, on top of what is already reserved. reserved must be locked.
+func admit(need int64) (protocol.RejectReason, error) {
+	if opts.Quota > 0 {
+		used := storage.DirSize(opts.DownloadDir) + reserved.bytes
+		if used+need > opts.Quota {
+			return protocol.ReasonQuota, fmt.Errorf("needs %s, only %s of the %s quota left",
+				utils.HumanBytes(need), utils.HumanBytes(max(opts.Quota-used, 0)), utils.HumanBytes(opts.Quota))
+		}
+	}
 
-	_, err = io.Copy(conn, reader)
-	if err!= nil{
-		log.Fatalln("couldnt copy to conn from buffer.",err)
+	free, err := storage.FreeSpace(opts.DownloadDir)
+	if err != nil {
+		// Not knowing is no reason to refuse; the writes will fail if it is full.
+		if !errors.Is(err, errors.ErrUnsupported) {
+			log.Printf("Could not check free space in %s: %v", opts.DownloadDir, err)
+		}
+	} else if uint64(need+reserved.bytes)+diskReserve > free {
+		return protocol.ReasonNoSpace, fmt.Errorf("needs %s, only %s free",
+			utils.HumanBytes(need), utils.HumanBytes(max(int64(free)-reserved.bytes, 0)))
+	}
+	return 0, nil
+}
+
+// askReceiver shows the offer in the TUI and waits for the user's decision.
+// An offer nobody answers in time is declined.
+func askReceiver(p *tea.Program, offer protocol.Offer, name string, files int, exists bool, resumeFrom int64, addr string) utils.OfferDecision {
+	id := nextOfferID.Add(1)
+	reply := make(chan utils.OfferDecision, 1)
+	p.Send(utils.IncomingOfferMsg{
+		ID:         id,
+		Filename:   name,
+		Size:       offer.Size,
+		IsDir:      offer.Kind == protocol.KindDirectory,
+		Files:      files,
+		From:       offer.SenderName,
+		Addr:       addr,
+		Exists:     exists,
+		ResumeFrom: resumeFrom,
+		Reply:      reply,
+	})
+
+	select {
+	case d := <-reply:
+		return d
+	case <-time.After(offerTimeout):
+		log.Printf("Offer for %s from %s timed out", name, addr)
+		p.Send(utils.OfferExpiredMsg{ID: id})
+		return utils.OfferDecision{}
 	}
-	p.Send(utils.LogMsg{Message: fmt.Sprintf("Finished sending %s", filename)})
-}
\ No newline at end of file
+}
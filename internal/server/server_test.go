@@ -0,0 +1,243 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"shareIt/internal/protocol"
+	"shareIt/internal/storage"
+	"shareIt/internal/utils"
+	"slices"
+	"sync"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// withOptions sets opts for one test.
+func withOptions(t *testing.T, o Options) {
+	t.Helper()
+	saved := opts
+	opts = o
+	t.Cleanup(func() { opts = saved })
+}
+
+// offerModel stands in for the UI, handing every offer it is shown to the
+// test to answer and ignoring everything else.
+type offerModel struct{ offers chan<- utils.IncomingOfferMsg }
+
+func (m offerModel) Init() tea.Cmd { return nil }
+func (m offerModel) View() string  { return "" }
+
+func (m offerModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	if offer, ok := msg.(utils.IncomingOfferMsg); ok && m.offers != nil {
+		m.offers <- offer
+	}
+	return m, nil
+}
+
+// runProgram runs a headless program around offerModel for one test.
+func runProgram(t *testing.T, offers chan<- utils.IncomingOfferMsg) *tea.Program {
+	t.Helper()
+	p := tea.NewProgram(offerModel{offers}, tea.WithInput(nil), tea.WithOutput(io.Discard), tea.WithoutRenderer())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run()
+	}()
+	t.Cleanup(func() {
+		p.Kill()
+		<-done
+	})
+	return p
+}
+
+// TestCheckLimitsHoldsSpace checks that two offers arriving together
+// cannot both be admitted against room for one, under the quota and under
+// the free space, and that the room comes back as the first download
+// writes or ends.
+func TestCheckLimitsHoldsSpace(t *testing.T) {
+	free, err := storage.FreeSpace(os.TempDir())
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("free space is not known on this platform")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each offer fits on its own with room to spare; two do not, even if
+	// other processes write a little meanwhile.
+	big := int64(free-diskReserve) * 6 / 10
+
+	for _, tc := range []struct {
+		name   string
+		quota  int64
+		size   int64
+		reason protocol.RejectReason
+	}{
+		{"quota", 100, 60, protocol.ReasonQuota},
+		{"free space", 0, big, protocol.ReasonNoSpace},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withOptions(t, Options{DownloadDir: t.TempDir(), Quota: tc.quota})
+			offer := protocol.Offer{Name: "a.bin", Size: tc.size, Kind: protocol.KindFile}
+
+			var wg sync.WaitGroup
+			spaces := make([]*reservation, 2)
+			reasons := make([]protocol.RejectReason, 2)
+			for i := range spaces {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					spaces[i], reasons[i], _ = checkLimits(offer, protocol.Manifest{}, 0)
+				}()
+			}
+			wg.Wait()
+			if (spaces[0] == nil) == (spaces[1] == nil) {
+				t.Fatalf("admitted %v and %v, want exactly one", spaces[0] != nil, spaces[1] != nil)
+			}
+			first, refused := spaces[0], reasons[1]
+			if first == nil {
+				first, refused = spaces[1], reasons[0]
+			}
+			if refused != tc.reason {
+				t.Errorf("refused with %s, want %s", refused, tc.reason)
+			}
+
+			// Bytes written move from the reservation to the disk.
+			if tc.quota > 0 {
+				if err := os.WriteFile(filepath.Join(opts.DownloadDir, "a.bin"), make([]byte, 50), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				first.Write(make([]byte, 50))
+				if space, _, err := checkLimits(protocol.Offer{Size: 41}, protocol.Manifest{}, 0); err == nil {
+					space.release()
+					t.Error("admitted 41 bytes with 40 left")
+				}
+			}
+
+			first.release()
+			first.release() // Releasing twice gives back nothing more
+			if tc.quota > 0 {
+				offer.Size = 50 // The other 50 are on disk now
+			}
+			space, _, err := checkLimits(offer, protocol.Manifest{}, 0)
+			if err != nil {
+				t.Fatalf("after release: %v", err)
+			}
+			space.release()
+			if reserved.bytes != 0 {
+				t.Errorf("%d bytes still reserved after every release", reserved.bytes)
+			}
+		})
+	}
+}
+
+// TestAcceptOfferClaimsPath checks that two offers of one name accepted
+// together are given different files to write, and that a name comes free
+// again once its download ends.
+func TestAcceptOfferClaimsPath(t *testing.T) {
+	withOptions(t, Options{DownloadDir: t.TempDir(), CollisionPolicy: storage.CollisionRename})
+	offers := make(chan utils.IncomingOfferMsg)
+	p := runProgram(t, offers)
+	offer := protocol.Offer{Name: "a.txt", Size: 10, Kind: protocol.KindFile}
+
+	accept := func() <-chan destination {
+		got := make(chan destination, 1)
+		go func() {
+			dest, reason, ok := acceptOffer(p, offer, protocol.Manifest{}, protocol.NodeID{}, "peer")
+			if !ok {
+				t.Errorf("declined with %s", reason)
+			}
+			got <- dest
+		}()
+		return got
+	}
+	// Both offers are asked about before either is answered, so both look
+	// for a free name while neither file exists yet.
+	first, second := accept(), accept()
+	asked := []utils.IncomingOfferMsg{<-offers, <-offers}
+	for _, o := range asked {
+		o.Reply <- utils.OfferDecision{Accept: true}
+	}
+	a, b := <-first, <-second
+	if a.path == b.path || a.part == b.part {
+		t.Fatalf("both offers write to %s (partial %s)", a.path, a.part)
+	}
+	names := []string{filepath.Base(a.path), filepath.Base(b.path)}
+	if !slices.Contains(names, "a.txt") || !slices.Contains(names, "a (1).txt") {
+		t.Errorf("saved as %q, want a.txt and a (1).txt", names)
+	}
+
+	a.release()
+	b.release()
+	third := accept()
+	(<-offers).Reply <- utils.OfferDecision{Accept: true}
+	c := <-third
+	defer c.release()
+	if filepath.Base(c.path) != "a.txt" {
+		t.Errorf("after both ended, saved as %s, want a.txt", filepath.Base(c.path))
+	}
+}
+
+// TestAcceptOfferDroppedResume checks that an offer admitted for only what
+// its partial was missing is held to the whole file once the user saves
+// it under another name, and the resume is dropped.
+func TestAcceptOfferDroppedResume(t *testing.T) {
+	dir := t.TempDir()
+	// The partial's 6000 bytes count against the quota too, so the 4000
+	// still missing fit and a fresh 10000 do not.
+	withOptions(t, Options{DownloadDir: dir, Quota: 13000})
+	sender := protocol.NodeID{1}
+	part := storage.PartPath(filepath.Join(dir, "a.bin"))
+	if err := os.MkdirAll(filepath.Dir(part), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(part, make([]byte, 6000), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SaveResume(part, storage.ResumeInfo{NodeID: sender.String(), Name: "a.bin", Size: 10000}); err != nil {
+		t.Fatal(err)
+	}
+	offers := make(chan utils.IncomingOfferMsg)
+	p := runProgram(t, offers)
+	offer := protocol.Offer{Name: "a.bin", Size: 10000, Kind: protocol.KindFile}
+
+	for _, tc := range []struct {
+		name     string
+		decision utils.OfferDecision
+		ok       bool
+		reserved int64
+	}{
+		{"resumed", utils.OfferDecision{Accept: true}, true, 4000},
+		{"renamed", utils.OfferDecision{Accept: true, Name: "b.bin"}, false, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := make(chan destination, 1)
+			go func() {
+				dest, reason, ok := acceptOffer(p, offer, protocol.Manifest{}, sender, "peer")
+				if ok != tc.ok {
+					t.Errorf("accepted %t (%s), want %t", ok, reason, tc.ok)
+				} else if !ok && reason != protocol.ReasonQuota {
+					t.Errorf("declined with %s, want %s", reason, protocol.ReasonQuota)
+				}
+				got <- dest
+			}()
+			var dest destination
+			select {
+			case o := <-offers:
+				o.Reply <- tc.decision
+				dest = <-got
+			case dest = <-got:
+				t.Fatal("decided without asking")
+			}
+			if reserved.bytes != tc.reserved {
+				t.Errorf("%d bytes reserved, want %d", reserved.bytes, tc.reserved)
+			}
+			dest.release()
+			if reserved.bytes != 0 {
+				t.Errorf("%d bytes still reserved after release", reserved.bytes)
+			}
+		})
+	}
+}
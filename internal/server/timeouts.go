@@ -0,0 +1,152 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"shareIt/internal/utils"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every blocking read or write on a connection between peers has a deadline,
+// so a peer that vanishes cannot hold a goroutine, an open file or shutdown
+// forever.
+const (
+	// handshakeTimeout bounds each exchange outside the data stream.
+	handshakeTimeout = 15 * time.Second
+	// answerTimeout bounds waiting for the other user, who has offerTimeout
+	// to make up their mind.
+	answerTimeout = offerTimeout + handshakeTimeout
+	// idleTimeout is how long an incoming connection may sit between requests.
+	idleTimeout = 2 * time.Minute
+	// defaultStallTimeout is used when Options.StallTimeout is not set.
+	defaultStallTimeout = 30 * time.Second
+	// verifyTimeout bounds waiting for the receiver's verdict, which can
+	// take a while as it flushes the file to disk first.
+	verifyTimeout = 2 * time.Minute
+)
+
+// keepAlive has TCP probe an idle connection every 15s and give up on it
+// after four unanswered probes.
+var keepAlive = net.KeepAliveConfig{
+	Enable:   true,
+	Idle:     15 * time.Second,
+	Interval: 15 * time.Second,
+	Count:    4,
+}
+
+// ErrPeerUnresponsive fails a transfer that made no progress for the stall
+// timeout while neither side had it paused.
+var ErrPeerUnresponsive = errors.New("peer unresponsive")
+
+// stallTimeout is how long a transfer may go without moving any data.
+func stallTimeout() time.Duration {
+	if opts.StallTimeout > 0 {
+		return opts.StallTimeout
+	}
+	return defaultStallTimeout
+}
+
+// setDeadline gives every read and write on conn d from now to complete.
+func setDeadline(conn net.Conn, d time.Duration) {
+	conn.SetDeadline(time.Now().Add(d))
+}
+
+// unresponsive turns a read or write that timed out into ErrPeerUnresponsive.
+func unresponsive(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return ErrPeerUnresponsive
+	}
+	return err
+}
+
+// watchdog fails a transfer whose reads or writes have been blocked on the
+// peer for the stall timeout, by closing its connection. Time spent paused,
+// by either side, and time spent on our own disk do not count.
+type watchdog struct {
+	last       atomic.Int64 // UnixNano of the last progress
+	blocked    atomic.Bool  // A read or write on the peer is in flight
+	peerPaused atomic.Bool
+	stalled    atomic.Bool
+	quit       chan struct{}
+	quitOnce   sync.Once
+}
+
+// watch starts a watchdog for the transfer h runs over conn. It stops by
+// itself once h is cancelled or the watchdog fires; otherwise call stop.
+func watch(h *utils.TransferHandle, conn net.Conn) *watchdog {
+	w := &watchdog{quit: make(chan struct{})}
+	w.progress()
+	go w.run(h, conn)
+	return w
+}
+
+func (w *watchdog) run(h *utils.TransferHandle, conn net.Conn) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-h.Done():
+			return
+		case <-tick.C:
+		}
+		if !w.blocked.Load() || h.Paused() || w.peerPaused.Load() {
+			w.progress()
+			continue
+		}
+		if time.Since(time.Unix(0, w.last.Load())) > stallTimeout() {
+			w.stalled.Store(true)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// progress records that data or a sign of life just went through.
+func (w *watchdog) progress() {
+	w.last.Store(time.Now().UnixNano())
+}
+
+// begin marks the start of a read or write that waits on the peer.
+func (w *watchdog) begin() {
+	w.progress()
+	w.blocked.Store(true)
+}
+
+// end marks that it returned.
+func (w *watchdog) end() {
+	w.blocked.Store(false)
+	w.progress()
+}
+
+// setPeerPaused records a pause or resume from the peer.
+func (w *watchdog) setPeerPaused(paused bool) {
+	w.peerPaused.Store(paused)
+	w.progress()
+}
+
+// stop ends the watch once the transfer is over.
+func (w *watchdog) stop() {
+	w.quitOnce.Do(func() { close(w.quit) })
+}
+
+// err explains an error from a connection the watchdog closed.
+func (w *watchdog) err(err error) error {
+	if w.stalled.Load() {
+		return ErrPeerUnresponsive
+	}
+	return err
+}
+
+// connLost describes a connection that broke in the middle of a transfer.
+func connLost(err error) error {
+	if err := unresponsive(err); err == ErrPeerUnresponsive {
+		return err
+	}
+	return fmt.Errorf("connection lost: %w", err)
+}
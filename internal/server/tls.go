@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"shareIt/internal/identity"
+	"shareIt/internal/protocol"
+	"shareIt/internal/trust"
+	"shareIt/internal/utils"
+	"sync"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Every peer has a self-signed certificate, so there is no CA to check
+// against. Both sides present one and checkPeer pins it to the peer's node
+// ID instead.
+
+func serverTLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{opts.Certificate},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}
+}
+
+func clientTLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{opts.Certificate},
+		InsecureSkipVerify: true, // Checked by checkPeer
+		MinVersion:         tls.VersionTLS13,
+	}
+}
+
+// localFingerprint is our certificate's fingerprint, as advertised in
+// discovery.
+func localFingerprint() string {
+	if len(opts.Certificate.Certificate) == 0 {
+		return ""
+	}
+	return identity.Fingerprint(opts.Certificate.Certificate[0])
+}
+
+// announcement is what a peer address last announced in discovery.
+type announcement struct {
+	nodeID      string
+	fingerprint string
+}
+
+// announced holds the latest announcement from each peer address.
+var announced sync.Map // Address to announcement
+
+// announcedAddrs returns the discovery addresses of a node, or fallback if
+// it has not announced itself.
+func announcedAddrs(nodeID, fallback string) []string {
+	var addrs []string
+	announced.Range(func(k, v any) bool {
+		if v.(announcement).nodeID == nodeID {
+			addrs = append(addrs, k.(string))
+		}
+		return true
+	})
+	if len(addrs) == 0 {
+		addrs = append(addrs, fallback)
+	}
+	return addrs
+}
+
+// checkPeer makes sure the certificate a peer presented is the one pinned
+// for its node ID, pinning it on first contact, and returns its fingerprint.
+// When we dialled addr ourselves, the certificate must also be the one
+// announced from there. A changed certificate gives trust.ErrKeyChanged
+// along with the new fingerprint.
+func checkPeer(conn net.Conn, id protocol.NodeID, addr string, dialled bool, p *tea.Program) (string, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", errors.New("connection is not encrypted")
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("peer presented no certificate")
+	}
+	fp := identity.Fingerprint(certs[0].Raw)
+
+	if dialled {
+		if a, ok := announced.Load(addr); ok && a.(announcement).fingerprint != fp {
+			return fp, fmt.Errorf("certificate does not match the one %s announces", addr)
+		}
+	}
+	if opts.Trust == nil {
+		return fp, nil
+	}
+	if err := opts.Trust.Check(id.String(), fp); err != nil {
+		if errors.Is(err, trust.ErrKeyChanged) {
+			log.Printf("WARNING: %s (node %s) presented certificate %s, which is not the one pinned for it", addr, id, fp)
+			// Incoming connections come from a random port; flag the peer
+			// under the address it is listed by.
+			for _, a := range announcedAddrs(id.String(), addr) {
+				p.Send(utils.PeerKeyChangedMsg{Addr: a, NodeID: id.String()})
+			}
+			return fp, err
+		}
+		// Failing to save a new pin does not make the peer less trustworthy.
+		log.Printf("Could not pin certificate for %s: %v", id, err)
+	}
+	return fp, nil
+}
+
+// dialPeer opens a TLS connection to a peer.
+func dialPeer(addr string) (*tls.Conn, error) {
+	dialer := &net.Dialer{Timeout: handshakeTimeout, KeepAliveConfig: keepAlive}
+	return tls.DialWithDialer(dialer, "tcp", addr, clientTLSConfig())
+}
+
+// listen opens the TLS listener for incoming transfers.
+func listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAliveConfig: keepAlive}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, serverTLSConfig()), nil
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CollisionPolicy decides what happens when a received file would land on
+// a name that already exists in the download directory.
+type CollisionPolicy string
+
+const (
+	CollisionRename    CollisionPolicy = "rename"    // Save as "name (1).ext"
+	CollisionOverwrite CollisionPolicy = "overwrite" // Replace the existing file
+	CollisionSkip      CollisionPolicy = "skip"      // Decline the transfer
+	CollisionAsk       CollisionPolicy = "ask"       // Let the user pick in the offer prompt
+)
+
+// ParseCollisionPolicy validates a policy name from a flag or config file.
+func ParseCollisionPolicy(s string) (CollisionPolicy, error) {
+	switch p := CollisionPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case CollisionRename, CollisionOverwrite, CollisionSkip, CollisionAsk:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown collision policy %q (want rename, overwrite, skip or ask)", s)
+}
+
+// ErrSkipped is returned by Resolve when the policy says not to take the file.
+var ErrSkipped = errors.New("file already exists")
+
+// maxSuffix bounds the "name (N).ext" search so a full directory cannot
+// stall a transfer forever.
+const maxSuffix = 10000
+
+// Exists reports whether something already occupies name in dir.
+func Exists(dir, name string) bool {
+	_, err := os.Lstat(filepath.Join(dir, name))
+	return err == nil
+}
+
+// Resolve applies policy to a sanitised name and returns the path the file
+// should be written to. overwrite is the user's answer when the policy is
+// CollisionAsk; with any other policy it is ignored. Only regular files are
+// ever overwritten; directories and symlinks always get a new name.
+//
+// inUse, if not nil, reports paths that other downloads are writing to.
+// They count as taken even before they exist and are never overwritten.
+func Resolve(dir, name string, policy CollisionPolicy, overwrite bool, inUse func(path string) bool) (string, error) {
+	path := filepath.Join(dir, name)
+	busy := inUse != nil && inUse(path)
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) && !busy {
+		return path, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	switch policy {
+	case CollisionSkip:
+		return "", ErrSkipped
+	case CollisionOverwrite:
+		overwrite = true
+	case CollisionRename:
+		overwrite = false
+	}
+	if overwrite && !busy && info.Mode().IsRegular() {
+		return path, nil
+	}
+	return uniquePath(dir, name, inUse)
+}
+
+// uniquePath finds the first free "name (N).ext" in dir that is not in use.
+func uniquePath(dir, name string, inUse func(string) bool) (string, error) {
+	for i := 1; i <= maxSuffix; i++ {
+		candidate := filepath.Join(dir, withSuffix(name, i))
+		if inUse != nil && inUse(candidate) {
+			continue
+		}
+		if _, err := os.Lstat(candidate); errors.Is(err, fs.ErrNotExist) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free name for %s in %s", name, dir)
+}
+
+// withSuffix turns "name.ext" into "name (i).ext".
+func withSuffix(name string, i int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		existing  []string // Files already in the directory
+		dirs      []string // Directories already in the directory
+		inUse     []string // Names other downloads are writing to
+		policy    CollisionPolicy
+		overwrite bool
+		want      string
+		err       error
+	}{
+		{name: "free", policy: CollisionRename, want: "a.txt"},
+		{name: "free under skip", policy: CollisionSkip, want: "a.txt"},
+		{name: "rename", existing: []string{"a.txt"}, policy: CollisionRename, want: "a (1).txt"},
+		{name: "rename past taken suffixes", existing: []string{"a.txt", "a (1).txt", "a (2).txt"}, policy: CollisionRename, want: "a (3).txt"},
+		{name: "overwrite", existing: []string{"a.txt"}, policy: CollisionOverwrite, want: "a.txt"},
+		{name: "overwrite never replaces a directory", dirs: []string{"a.txt"}, policy: CollisionOverwrite, want: "a (1).txt"},
+		{name: "skip", existing: []string{"a.txt"}, policy: CollisionSkip, err: ErrSkipped},
+		{name: "ask, user overwrites", existing: []string{"a.txt"}, policy: CollisionAsk, overwrite: true, want: "a.txt"},
+		{name: "ask, user keeps both", existing: []string{"a.txt"}, policy: CollisionAsk, want: "a (1).txt"},
+		{name: "rename ignores overwrite answer", existing: []string{"a.txt"}, policy: CollisionRename, overwrite: true, want: "a (1).txt"},
+		{name: "in use counts as taken", inUse: []string{"a.txt"}, policy: CollisionRename, want: "a (1).txt"},
+		{name: "in use is never overwritten", existing: []string{"a.txt"}, inUse: []string{"a.txt"}, policy: CollisionOverwrite, want: "a (1).txt"},
+		{name: "in use suffix skipped", existing: []string{"a.txt"}, inUse: []string{"a (1).txt"}, policy: CollisionRename, want: "a (2).txt"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, f := range tc.existing {
+				if err := os.WriteFile(filepath.Join(dir, f), []byte("old"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, d := range tc.dirs {
+				if err := os.Mkdir(filepath.Join(dir, d), 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			busy := make(map[string]bool)
+			for _, f := range tc.inUse {
+				busy[filepath.Join(dir, f)] = true
+			}
+			got, err := Resolve(dir, "a.txt", tc.policy, tc.overwrite, func(path string) bool { return busy[path] })
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Resolve error = %v, want %v", err, tc.err)
+			}
+			if tc.err != nil {
+				return
+			}
+			if want := filepath.Join(dir, tc.want); got != want {
+				t.Errorf("Resolve = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestParseCollisionPolicy(t *testing.T) {
+	for in, want := range map[string]CollisionPolicy{
+		"rename": CollisionRename, " Overwrite ": CollisionOverwrite, "SKIP": CollisionSkip, "ask": CollisionAsk,
+	} {
+		if got, err := ParseCollisionPolicy(in); err != nil || got != want {
+			t.Errorf("ParseCollisionPolicy(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseCollisionPolicy("replace"); err == nil {
+		t.Error("ParseCollisionPolicy accepted an unknown policy")
+	}
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// MetadataPolicy decides whose permission bits and modification times are
+// applied to received files. Otherwise files get default permissions and
+// the time they arrived.
+type MetadataPolicy string
+
+const (
+	MetadataAll    MetadataPolicy = "all"    // Keep them for every sender
+	MetadataPaired MetadataPolicy = "paired" // Keep them only for paired devices
+	MetadataNone   MetadataPolicy = "none"   // Never keep them
+)
+
+// ParseMetadataPolicy validates a policy name from a flag or config file.
+func ParseMetadataPolicy(s string) (MetadataPolicy, error) {
+	switch p := MetadataPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case MetadataAll, MetadataPaired, MetadataNone:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown metadata policy %q (want all, paired or none)", s)
+}
+
+// Allows reports whether the policy keeps a sender's metadata.
+func (p MetadataPolicy) Allows(paired bool) bool {
+	return p == MetadataAll || (p == MetadataPaired && paired)
+}
+
+// ApplyMetadata sets the permission bits and modification time of the file
+// or directory at path. Only permission bits are taken from mode, never
+// setuid, setgid or sticky. A zero modTime is left alone.
+func ApplyMetadata(path string, mode uint32, modTime time.Time) error {
+	if err := os.Chmod(path, fs.FileMode(mode)&fs.ModePerm); err != nil {
+		return err
+	}
+	if modTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(path, modTime, modTime)
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// partialDir is the hidden directory, inside the download directory,
+	// that downloads are written to until verified. Being on the same
+	// volume, finishing one is a rename. SanitizeName refuses this name, so
+	// nothing a peer sends can land in it or be mistaken for its contents.
+	partialDir = ".shareit-partial"
+	// partSuffix marks a download that has not been verified yet.
+	partSuffix = ".part"
+)
+
+// PartPath returns the hidden file or directory a download bound for path
+// is written to. It is only renamed to path once it checks out, so a file
+// under its final name is always complete. The caller creates its parent.
+func PartPath(path string) string {
+	return filepath.Join(filepath.Dir(path), partialDir, filepath.Base(path)+partSuffix)
+}
+
+// PartialPolicy decides what happens to a partial download when the
+// connection drops or ShareIt shuts down. Cancelled and corrupt downloads
+// are always deleted, as are partial folders, which cannot be resumed.
+type PartialPolicy string
+
+const (
+	PartialKeep   PartialPolicy = "keep"   // Keep it so the sender can resume it later
+	PartialDelete PartialPolicy = "delete" // Delete it
+)
+
+// ParsePartialPolicy validates a policy name from a flag or config file.
+func ParsePartialPolicy(s string) (PartialPolicy, error) {
+	switch p := PartialPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case PartialKeep, PartialDelete:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown partial file policy %q (want keep or delete)", s)
+}
+
+// CleanPartials removes partial downloads an earlier run left in the
+// download directory dir without tidying up, for example because it
+// crashed. A partial file with a resume record is kept if policy is
+// PartialKeep. Nothing outside the partial directory is touched.
+func CleanPartials(dir string, policy PartialPolicy) error {
+	parts := filepath.Join(dir, partialDir)
+	entries, err := os.ReadDir(parts)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case strings.HasSuffix(name, partSuffix):
+			record := resumePath(parts, name)
+			if _, err := os.Stat(record); err == nil && policy == PartialKeep && !e.IsDir() {
+				continue
+			}
+			os.Remove(record)
+			if err := os.RemoveAll(filepath.Join(parts, name)); err != nil {
+				return err
+			}
+		case strings.HasSuffix(name, partSuffix+resumeSuffix):
+			// A record whose partial file is gone.
+			if !Exists(parts, strings.TrimSuffix(name, resumeSuffix)) {
+				os.Remove(filepath.Join(parts, name))
+			}
+		}
+	}
+	os.Remove(parts) // Only if empty
+	return nil
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCleanPartials(t *testing.T) {
+	// Files a user or a peer may have put in the download directory, named
+	// like ShareIt's working files. CleanPartials must never touch them.
+	received := []string{"a.part", ".a.part", ".a.part.resume.json", "b.part.resume.json"}
+
+	for _, tc := range []struct {
+		name   string
+		policy PartialPolicy
+		setup  func(t *testing.T, dir string)
+		want   []string // Left in the partial directory; nil if it should be gone
+	}{
+		{
+			name:   "nothing to clean",
+			policy: PartialKeep,
+			setup:  func(t *testing.T, dir string) {},
+		},
+		{
+			name:   "resumable partial kept",
+			policy: PartialKeep,
+			setup:  func(t *testing.T, dir string) { writePartial(t, dir, "a.bin", "a.bin", 10, 100) },
+			want:   []string{"a.bin.part", "a.bin.part.resume.json"},
+		},
+		{
+			name:   "resumable partial deleted by policy",
+			policy: PartialDelete,
+			setup:  func(t *testing.T, dir string) { writePartial(t, dir, "a.bin", "a.bin", 10, 100) },
+		},
+		{
+			name:   "partial without a record",
+			policy: PartialKeep,
+			setup:  func(t *testing.T, dir string) { plant(t, dir, partialDir, "a.bin.part", "0123456789") },
+		},
+		{
+			name:   "record without a partial",
+			policy: PartialKeep,
+			setup: func(t *testing.T, dir string) {
+				plant(t, dir, partialDir, "a.bin.part.resume.json", record("a.bin.part"))
+			},
+		},
+		{
+			name:   "partial folder",
+			policy: PartialKeep,
+			setup: func(t *testing.T, dir string) {
+				plant(t, dir, filepath.Join(partialDir, "photos.part", "2024"), "x.jpg", "jpeg")
+			},
+		},
+		{
+			name:   "unknown files left alone",
+			policy: PartialDelete,
+			setup:  func(t *testing.T, dir string) { plant(t, dir, partialDir, "notes.txt", "mine") },
+			want:   []string{"notes.txt"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range received {
+				plant(t, dir, "", name, "received")
+			}
+			tc.setup(t, dir)
+
+			if err := CleanPartials(dir, tc.policy); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range received {
+				if !Exists(dir, name) {
+					t.Errorf("%s was deleted", name)
+				}
+			}
+			var left []string
+			entries, err := os.ReadDir(filepath.Join(dir, partialDir))
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				left = append(left, e.Name())
+			}
+			if !slices.Equal(left, tc.want) {
+				t.Errorf("partial directory holds %q, want %q", left, tc.want)
+			}
+		})
+	}
+}
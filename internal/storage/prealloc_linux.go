@@ -0,0 +1,22 @@
+package storage
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Preallocate reserves size bytes of disk for f up front, so a large
+// download is laid out contiguously and cannot run out of space halfway.
+// The file's apparent size is left alone, which keeps partial downloads
+// resumable from their real length.
+func Preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return nil // Not every filesystem can; it is only an optimisation
+	}
+	return err
+}
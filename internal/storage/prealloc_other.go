@@ -0,0 +1,10 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+// Preallocate does nothing on this platform; the file grows as it is written.
+func Preallocate(f *os.File, size int64) error {
+	return nil
+}
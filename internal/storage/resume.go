@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resumeSuffix marks the sidecar kept next to an interrupted download.
+const resumeSuffix = ".resume.json"
+
+// ResumeInfo describes an interrupted download so the same sender can pick
+// it up again later.
+type ResumeInfo struct {
+	NodeID string `json:"node_id"` // Sender's node ID
+	Name   string `json:"name"`    // Sanitised name the sender offered
+	Size   int64  `json:"size"`    // Full size of the file being sent
+	File   string `json:"file"`    // Base name of the partial file in the partial directory
+}
+
+// resumePath is where the record for the partial file named file in dir
+// is kept.
+func resumePath(dir, file string) string {
+	return filepath.Join(dir, file+resumeSuffix)
+}
+
+// SaveResume records that the file at path is an incomplete copy of info.
+func SaveResume(path string, info ResumeInfo) error {
+	info.File = filepath.Base(path)
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(resumePath(filepath.Dir(path), info.File), data, 0o600)
+}
+
+// ClearResume forgets any interrupted-download record for path. It is best
+// effort: a stale record is ignored by FindResume once the file is complete.
+func ClearResume(path string) {
+	os.Remove(resumePath(filepath.Dir(path), filepath.Base(path)))
+}
+
+// FindResume looks in the download directory dir for an interrupted
+// download of the same file from the same sender. It returns the partial file's path and how many bytes of
+// it are usable, or ok=false if there is nothing to resume. A record only
+// counts if it sits next to the partial file it names, and that file is
+// the partial of name or of a "name (N)" copy of it.
+func FindResume(dir, nodeID, name string, size int64) (path string, offset int64, ok bool) {
+	dir = filepath.Join(dir, partialDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", 0, false
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), resumeSuffix) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		var info ResumeInfo
+		if json.Unmarshal(data, &info) != nil {
+			continue
+		}
+		if info.NodeID != nodeID || info.Name != name || info.Size != size {
+			continue
+		}
+		if info.File != filepath.Base(info.File) || filepath.Base(resumePath(dir, info.File)) != e.Name() || !isPartOf(info.File, name) {
+			continue
+		}
+		path = filepath.Join(dir, filepath.Base(info.File))
+		fi, err := os.Lstat(path)
+		if err != nil || !fi.Mode().IsRegular() || fi.Size() <= 0 || fi.Size() >= size {
+			continue
+		}
+		return path, fi.Size(), true
+	}
+	return "", 0, false
+}
+
+// isPartOf reports whether file is the partial download of name, or of
+// name saved under a collision suffix.
+func isPartOf(file, name string) bool {
+	saved, ok := strings.CutSuffix(file, partSuffix)
+	if !ok {
+		return false
+	}
+	if saved == name {
+		return true
+	}
+	ext := filepath.Ext(name)
+	n, ok := strings.CutPrefix(saved, strings.TrimSuffix(name, ext)+" (")
+	if !ok {
+		return false
+	}
+	n, ok = strings.CutSuffix(n, ")"+ext)
+	if !ok || n == "" {
+		return false
+	}
+	for _, c := range n {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// HashPrefix feeds the first n bytes of r into h, which should be a fresh
+// SHA-256, and returns the digest so far. h can keep hashing the rest of the
+// file afterwards to get the digest of the whole thing.
+func HashPrefix(h hash.Hash, r io.Reader, n int64) ([32]byte, error) {
+	var sum [32]byte
+	if _, err := io.CopyN(h, r, n); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
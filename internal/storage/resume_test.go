@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const sender = "6f1c2a9e-0b7d-4c3e-9a51-2d8f7e6b4c10"
+
+// writePartial leaves a partial download of name in dir, as an interrupted
+// transfer would, and returns its path.
+func writePartial(t *testing.T, dir, saved, name string, have, size int64) string {
+	t.Helper()
+	part := PartPath(filepath.Join(dir, saved))
+	if err := os.MkdirAll(filepath.Dir(part), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(part, make([]byte, have), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveResume(part, ResumeInfo{NodeID: sender, Name: name, Size: size}); err != nil {
+		t.Fatal(err)
+	}
+	return part
+}
+
+// plant writes a file into dir/sub by hand, to check FindResume only
+// trusts records SaveResume could have written.
+func plant(t *testing.T, dir, sub, name string, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, sub, name), []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// record is a resume record for a.bin naming file as its partial.
+func record(file string) string {
+	return `{"node_id":"` + sender + `","name":"a.bin","size":100,"file":"` + file + `"}`
+}
+
+func TestFindResume(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		setup  func(t *testing.T, dir string) string // Returns the partial expected, or ""
+		nodeID string
+		offer  string
+		size   int64
+		offset int64
+	}{
+		{
+			name:  "same file from same sender",
+			setup: func(t *testing.T, dir string) string { return writePartial(t, dir, "a.bin", "a.bin", 10, 100) },
+			offer: "a.bin", size: 100, offset: 10,
+		},
+		{
+			name:  "partial saved under a collision suffix",
+			setup: func(t *testing.T, dir string) string { return writePartial(t, dir, "a (2).bin", "a.bin", 10, 100) },
+			offer: "a.bin", size: 100, offset: 10,
+		},
+		{
+			name:   "other sender",
+			setup:  func(t *testing.T, dir string) string { writePartial(t, dir, "a.bin", "a.bin", 10, 100); return "" },
+			nodeID: "00000000-0000-0000-0000-000000000000",
+			offer:  "a.bin", size: 100,
+		},
+		{
+			name:  "other size",
+			setup: func(t *testing.T, dir string) string { writePartial(t, dir, "a.bin", "a.bin", 10, 100); return "" },
+			offer: "a.bin", size: 101,
+		},
+		{
+			name:  "partial already complete",
+			setup: func(t *testing.T, dir string) string { writePartial(t, dir, "a.bin", "a.bin", 100, 100); return "" },
+			offer: "a.bin", size: 100,
+		},
+		{
+			name: "record pointing at another file",
+			setup: func(t *testing.T, dir string) string {
+				plant(t, dir, partialDir, "victim.txt", "0123456789")
+				plant(t, dir, partialDir, "a.bin.part.resume.json", record("victim.txt"))
+				return ""
+			},
+			offer: "a.bin", size: 100,
+		},
+		{
+			name: "record pointing at another download's partial",
+			setup: func(t *testing.T, dir string) string {
+				writePartial(t, dir, "b.bin", "b.bin", 10, 100)
+				plant(t, dir, partialDir, "b.bin.part.resume.json", record("b.bin.part"))
+				return ""
+			},
+			offer: "a.bin", size: 100,
+		},
+		{
+			name: "record not next to its partial",
+			setup: func(t *testing.T, dir string) string {
+				plant(t, dir, partialDir, "a.bin.part", "0123456789")
+				plant(t, dir, partialDir, "other.resume.json", record("a.bin.part"))
+				return ""
+			},
+			offer: "a.bin", size: 100,
+		},
+		{
+			name: "received files named like a partial and its record",
+			setup: func(t *testing.T, dir string) string {
+				plant(t, dir, "", "a.bin.part", "0123456789")
+				plant(t, dir, "", "a.bin.part.resume.json", record("a.bin.part"))
+				return ""
+			},
+			offer: "a.bin", size: 100,
+		},
+		{
+			name: "record escaping the directory",
+			setup: func(t *testing.T, dir string) string {
+				plant(t, dir, "", "a.bin.part", "0123456789")
+				plant(t, dir, partialDir, "a.bin.part.resume.json", record("../a.bin.part"))
+				return ""
+			},
+			offer: "a.bin", size: 100,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			want := tc.setup(t, dir)
+			nodeID := tc.nodeID
+			if nodeID == "" {
+				nodeID = sender
+			}
+			path, offset, ok := FindResume(dir, nodeID, tc.offer, tc.size)
+			if ok != (want != "") || path != want || offset != tc.offset {
+				t.Errorf("FindResume = %q, %d, %t, want %q, %d", path, offset, ok, want, tc.offset)
+			}
+		})
+	}
+}
+
+func TestIsPartOf(t *testing.T) {
+	for _, tc := range []struct {
+		file, name string
+		want       bool
+	}{
+		{"a.txt.part", "a.txt", true},
+		{"a (3).txt.part", "a.txt", true},
+		{"a (x).txt.part", "a.txt", false},
+		{"a ().txt.part", "a.txt", false},
+		{"b.txt.part", "a.txt", false},
+		{".a.txt.part", "a.txt", false},
+		{"a.txt", "a.txt", false},
+	} {
+		if got := isPartOf(tc.file, tc.name); got != tc.want {
+			t.Errorf("isPartOf(%q, %q) = %t, want %t", tc.file, tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxNameBytes is the longest file name most filesystems accept.
+const maxNameBytes = 255
+
+// ErrInvalidName is returned for names that are empty or nothing but dots
+// once sanitised, and for the name of our partial download directory.
+var ErrInvalidName = errors.New("invalid file name")
+
+// windowsReserved are device names Windows refuses to create as files,
+// regardless of extension or case.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeName turns a single path element received from a peer into a
+// name that is safe to create inside the download directory on any OS.
+//
+// Path separators and characters Windows rejects are replaced with '_',
+// control and bidi-override characters are dropped, the result is NFC
+// normalised, reserved device names are prefixed with '_', and the name is
+// truncated to maxNameBytes while keeping its extension. The name of the
+// directory partial downloads are kept in (see PartPath) is refused, so a
+// peer can never write into it.
+func SanitizeName(name string) (string, error) {
+	name = norm.NFC.String(strings.ToValidUTF8(name, "_"))
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == '/' || r == '\\':
+			b.WriteRune('_')
+		case strings.ContainsRune(`<>:"|?*`, r):
+			b.WriteRune('_')
+		case unicode.IsControl(r), isBidiControl(r):
+			// Dropped: invisible in the UI and can disguise the real extension.
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	// Windows silently strips trailing dots and spaces, which would let two
+	// different names land on the same file.
+	clean := strings.TrimRight(strings.TrimSpace(b.String()), ". ")
+	if clean == "" || strings.Trim(clean, ".") == "" {
+		return "", ErrInvalidName
+	}
+
+	stem := clean
+	if i := strings.IndexByte(stem, '.'); i >= 0 {
+		stem = stem[:i]
+	}
+	if windowsReserved[strings.ToUpper(strings.TrimSpace(stem))] {
+		clean = "_" + clean
+	}
+
+	// Case is ignored, as it is by most desktop filesystems.
+	if strings.EqualFold(clean, partialDir) {
+		return "", ErrInvalidName
+	}
+	return truncateName(clean, maxNameBytes), nil
+}
+
+// isBidiControl reports whether r changes text direction, which can be used
+// to make "exe.txt" display as "txt.exe".
+func isBidiControl(r rune) bool {
+	return (r >= '\u202A' && r <= '\u202E') || (r >= '\u2066' && r <= '\u2069') || r == '\u200E' || r == '\u200F'
+}
+
+// truncateName shortens name to at most max bytes, keeping the extension
+// and never splitting a UTF-8 sequence.
+func truncateName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	ext := ""
+	if i := strings.LastIndexByte(name, '.'); i > 0 && len(name)-i <= 16 {
+		ext = name[i:]
+		name = name[:i]
+	}
+	cut := max - len(ext)
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut] + ext
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	for _, tc := range []struct {
+		name, in, want string
+		err            error
+	}{
+		{"plain", "report.pdf", "report.pdf", nil},
+		{"unicode kept", "café.txt", "café.txt", nil},
+		{"nfc normalised", "cafe\u0301.txt", "caf\u00e9.txt", nil},
+		{"slash", "a/b.txt", "a_b.txt", nil},
+		{"backslash", `..\..\evil.exe`, ".._.._evil.exe", nil},
+		{"windows forbidden", `a<b>c:d"e|f?g*h`, "a_b_c_d_e_f_g_h", nil},
+		{"control dropped", "a\x00b\x1bc.txt", "abc.txt", nil},
+		{"bidi override dropped", "invoice‮fdp.exe", "invoicefdp.exe", nil},
+		{"trailing dots and spaces", "name. . ", "name", nil},
+		{"leading dot kept", ".gitignore", ".gitignore", nil},
+		{"reserved device", "CON", "_CON", nil},
+		{"reserved device with extension", "nul.txt", "_nul.txt", nil},
+		{"reserved device any case", "Com1.log", "_Com1.log", nil},
+		{"not reserved", "CONSOLE.txt", "CONSOLE.txt", nil},
+		{"truncated keeping extension", long + ".txt", long[:251] + ".txt", nil},
+		{"empty", "", "", ErrInvalidName},
+		{"only dots", "..", "", ErrInvalidName},
+		{"only separators", "/", "_", nil},
+		{"only spaces", "   ", "", ErrInvalidName},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := SanitizeName(tc.in)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("SanitizeName(%q) error = %v, want %v", tc.in, err, tc.err)
+			}
+			if got != tc.want {
+				t.Errorf("SanitizeName(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+			if len(got) > maxNameBytes {
+				t.Errorf("SanitizeName(%q) is %d bytes, limit is %d", tc.in, len(got), maxNameBytes)
+			}
+		})
+	}
+}
+
+func TestSanitizeNameRefusesPartialDir(t *testing.T) {
+	for _, in := range []string{partialDir, strings.ToUpper(partialDir), partialDir + ".", " " + partialDir + " "} {
+		if got, err := SanitizeName(in); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("SanitizeName(%q) = %q, %v, want ErrInvalidName", in, got, err)
+		}
+	}
+	if _, err := SanitizeName(partialDir + " (1)"); err != nil {
+		t.Errorf("SanitizeName(%q): %v", partialDir+" (1)", err)
+	}
+}
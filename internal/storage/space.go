@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ParseSize reads a byte count such as "700M" or "4GB". The suffixes are
+// binary. "", "0" and "unlimited" all mean no limit and return 0.
+func ParseSize(s string) (int64, error) {
+	t := strings.ToUpper(strings.TrimSpace(s))
+	if t == "" || t == "0" || t == "UNLIMITED" {
+		return 0, nil
+	}
+	t = strings.TrimSuffix(t, "B")
+	mult := 1.0
+	if n := len(t); n > 0 {
+		if i := strings.IndexByte("KMGT", t[n-1]); i >= 0 {
+			mult = float64(int64(1) << (10 * (i + 1)))
+			t = t[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q (want e.g. 700M or 4GB)", s)
+	}
+	return int64(v * mult), nil
+}
+
+// DirSize adds up the sizes of all regular files under dir, partial
+// downloads included. Entries that cannot be read are skipped.
+func DirSize(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
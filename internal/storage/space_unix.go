@@ -0,0 +1,15 @@
+//go:build unix
+
+package storage
+
+import "golang.org/x/sys/unix"
+
+// FreeSpace returns how many bytes an unprivileged user can still write to
+// the volume holding dir.
+func FreeSpace(dir string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,17 @@
+package storage
+
+import "golang.org/x/sys/windows"
+
+// FreeSpace returns how many bytes the current user can still write to the
+// volume holding dir, taking disk quotas into account.
+func FreeSpace(dir string) (uint64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var avail, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &avail, &total, &free); err != nil {
+		return 0, err
+	}
+	return avail, nil
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestWriteJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "pins.json")
+	for _, v := range []map[string]string{{"a": "1"}, {"b": "2"}} {
+		if err := WriteJSON(path, v); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]string
+		if err := json.Unmarshal(data, &got); err != nil || len(got) != 1 || got["a"] != v["a"] || got["b"] != v["b"] {
+			t.Errorf("read back %s, %v, want %v", data, err, v)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && info.Mode().Perm() != 0o600 {
+		t.Errorf("saved with mode %v, want 0600", info.Mode().Perm())
+	}
+
+	// Something it cannot encode leaves the old file alone.
+	if err := WriteJSON(path, func() {}); err == nil {
+		t.Error("WriteJSON encoded a func")
+	}
+	if data, _ := os.ReadFile(path); len(data) == 0 {
+		t.Error("a failed write emptied the file")
+	}
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// TreeNames maps the '/'-separated paths of a received directory tree onto
+// sanitised local relative paths. Entries that end up with the same name
+// after sanitising, or that differ only in case, get a " (N)" suffix
+// instead of overwriting each other.
+type TreeNames struct {
+	used map[string]bool   // Lower-cased local paths already handed out
+	dirs map[string]string // Remote directory path -> local path
+}
+
+// NewTreeNames returns an empty TreeNames.
+func NewTreeNames() *TreeNames {
+	return &TreeNames{
+		used: make(map[string]bool),
+		dirs: make(map[string]string),
+	}
+}
+
+// Add sanitises the remote path rel and returns the local relative path it
+// should be created at. Parent directories that were not added explicitly
+// are added on the way.
+func (t *TreeNames) Add(rel string, isDir bool) (string, error) {
+	rel = strings.Trim(rel, "/")
+	if rel == "" {
+		return "", ErrInvalidName
+	}
+	if local, ok := t.dirs[rel]; ok && isDir {
+		return local, nil
+	}
+
+	var parent string
+	base := rel
+	if i := strings.LastIndexByte(rel, '/'); i >= 0 {
+		var err error
+		if parent, err = t.Add(rel[:i], true); err != nil {
+			return "", err
+		}
+		base = rel[i+1:]
+	}
+
+	name, err := SanitizeName(base)
+	if err != nil {
+		return "", fmt.Errorf("%q: %w", rel, err)
+	}
+	local := filepath.Join(parent, name)
+	for i := 1; t.used[strings.ToLower(local)]; i++ {
+		if i > maxSuffix {
+			return "", fmt.Errorf("%q: too many entries with the same name", rel)
+		}
+		local = filepath.Join(parent, withSuffix(name, i))
+	}
+
+	t.used[strings.ToLower(local)] = true
+	if isDir {
+		t.dirs[rel] = local
+	}
+	return local, nil
+}
@@ -0,0 +1,73 @@
+package trust
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"shareIt/internal/storage"
+	"sync"
+	"time"
+)
+
+// DevicesFileName is the trusted-devices file's name inside the ShareIt
+// state directory.
+const DevicesFileName = "trusted_devices.json"
+
+// ErrNotPaired is returned when pairing is required and the peer has not
+// been paired with.
+var ErrNotPaired = errors.New("device is not paired")
+
+// ErrPairingFailed means a device we paired with could not prove it still
+// holds the shared key.
+var ErrPairingFailed = errors.New("device failed to prove its pairing")
+
+// Device is a peer the user paired with by entering a code.
+type Device struct {
+	Name        string    `json:"name"`
+	Fingerprint string    `json:"fingerprint"` // Certificate it presented when pairing
+	Key         []byte    `json:"key"`         // Shared key from the pairing exchange
+	PairedAt    time.Time `json:"paired_at"`
+}
+
+// Devices is the set of paired devices, keyed by node ID and kept on disk.
+type Devices struct {
+	path string
+
+	mu      sync.Mutex
+	devices map[string]Device
+}
+
+// LoadDevices reads the trusted devices at path. A missing file is an
+// empty set.
+func LoadDevices(path string) (*Devices, error) {
+	d := &Devices{path: path, devices: make(map[string]Device)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &d.devices); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return d, nil
+}
+
+// Get returns the device paired under nodeID, if any.
+func (d *Devices) Get(nodeID string) (Device, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dev, ok := d.devices[nodeID]
+	return dev, ok
+}
+
+// Add records a newly paired device, replacing any earlier pairing.
+func (d *Devices) Add(nodeID string, dev Device) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.devices[nodeID] = dev
+	return storage.WriteJSON(d.path, d.devices)
+}
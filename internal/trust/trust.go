@@ -0,0 +1,81 @@
+package trust
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"shareIt/internal/storage"
+	"sync"
+)
+
+// FileName is the pinned-keys file's name inside the ShareIt state directory.
+const FileName = "known_peers.json"
+
+// ErrKeyChanged means a peer presented a different certificate from the one
+// pinned on first contact: either it was reinstalled or someone is in the
+// middle.
+var ErrKeyChanged = errors.New("peer's certificate changed since first contact")
+
+// Store pins each peer's certificate fingerprint to its node ID the first
+// time they talk, and keeps the pins on disk.
+type Store struct {
+	path string
+
+	mu   sync.Mutex
+	pins map[string]string // Node ID to certificate fingerprint
+}
+
+// Load reads the pins at path. A missing file is an empty store.
+func Load(path string) (*Store, error) {
+	s := &Store{path: path, pins: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.pins); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Pinned returns the fingerprint pinned for nodeID, if any.
+func (s *Store) Pinned(nodeID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fp, ok := s.pins[nodeID]
+	return fp, ok
+}
+
+// Check compares a peer's fingerprint with its pin, pinning it if the peer
+// is new. It returns ErrKeyChanged on a mismatch.
+func (s *Store) Check(nodeID, fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pinned, ok := s.pins[nodeID]; ok {
+		if pinned != fingerprint {
+			return ErrKeyChanged
+		}
+		return nil
+	}
+	s.pins[nodeID] = fingerprint
+	return s.save()
+}
+
+// Repin replaces the fingerprint pinned for nodeID. It is only called once
+// the user has vouched for the new certificate by pairing.
+func (s *Store) Repin(nodeID, fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pins[nodeID] = fingerprint
+	return s.save()
+}
+
+// save writes the pins out. The caller holds s.mu.
+func (s *Store) save() error {
+	return storage.WriteJSON(s.path, s.pins)
+}
@@ -0,0 +1,120 @@
+package tui
+
+import (
+	"fmt"
+	"shareIt/internal/utils"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var offerStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("214")).Bold(true)
+
+// updateOffer handles keys while an incoming offer is waiting for a decision.
+func (m *mainModel) updateOffer(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	offer := m.offers[0]
+
+	if m.renaming {
+		switch msg.String() {
+		case "enter":
+			name := strings.TrimSpace(m.renameInput.Value())
+			if name == "" {
+				return m, nil
+			}
+			m.answerOffer(utils.OfferDecision{Accept: true, Name: name})
+		case "esc":
+			m.renaming = false
+			m.renameInput.Blur()
+		default:
+			var cmd tea.Cmd
+			m.renameInput, cmd = m.renameInput.Update(msg)
+			m.updateTransfersView()
+			return m, cmd
+		}
+		m.updateTransfersView()
+		return m, nil
+	}
+
+	switch msg.String() {
+	case "a", "y":
+		m.answerOffer(utils.OfferDecision{Accept: true})
+	case "o":
+		if offer.Exists {
+			m.answerOffer(utils.OfferDecision{Accept: true, Overwrite: true})
+		}
+	case "r", "x":
+		m.answerOffer(utils.OfferDecision{Accept: false})
+	case "n":
+		m.renaming = true
+		m.renameInput.SetValue(offer.Filename)
+		m.renameInput.CursorEnd()
+		m.updateTransfersView()
+		return m, m.renameInput.Focus()
+	}
+	m.updateTransfersView()
+	return m, nil
+}
+
+// answerOffer sends the decision for the oldest pending offer back to the
+// server and moves on to the next one.
+func (m *mainModel) answerOffer(d utils.OfferDecision) {
+	// Reply is buffered, so this never blocks even if the offer just expired.
+	m.offers[0].Reply <- d
+	m.dropOffer(m.offers[0].ID)
+}
+
+// dropOffer removes an offer from the queue, restoring the previous focus
+// once nothing is left to answer.
+func (m *mainModel) dropOffer(id uint64) {
+	for i, o := range m.offers {
+		if o.ID == id {
+			if i == 0 {
+				m.renaming = false
+				m.renameInput.Blur()
+				m.renameInput.Reset()
+			}
+			m.offers = append(m.offers[:i], m.offers[i+1:]...)
+			break
+		}
+	}
+	if len(m.offers) == 0 {
+		m.setFocus(m.offerFocus)
+	}
+}
+
+// offerPrompt renders the modal for the oldest pending offer.
+func (m *mainModel) offerPrompt() string {
+	offer := m.offers[0]
+	var s strings.Builder
+	what := "file"
+	if offer.IsDir {
+		what = "folder"
+	}
+	s.WriteString(offerStyle.Render(fmt.Sprintf("Incoming %s from %s (%s)", what, offer.From, offer.Addr)) + "\n")
+	if offer.IsDir {
+		s.WriteString(fmt.Sprintf("  %s/ (folder, %d files, %s)\n", offer.Filename, offer.Files, utils.HumanBytes(offer.Size)))
+	} else {
+		s.WriteString(fmt.Sprintf("  %s (%s)\n", offer.Filename, utils.HumanBytes(offer.Size)))
+	}
+	if offer.Exists && !m.renaming {
+		s.WriteString("  A file with this name already exists.\n")
+	}
+	if offer.ResumeFrom > 0 && !m.renaming {
+		s.WriteString(fmt.Sprintf("  Partial download found, resumes at %.0f%%.\n", float64(offer.ResumeFrom)*100/float64(offer.Size)))
+	}
+	switch {
+	case m.renaming:
+		s.WriteString(m.renameInput.View() + "\n")
+		s.WriteString("[enter] save  [esc] back")
+	case offer.Exists:
+		s.WriteString("[a] keep both  [o] overwrite  [r] reject  [n] rename")
+	default:
+		s.WriteString("[a] accept  [r] reject  [n] rename")
+	}
+	if waiting := len(m.offers) - 1; waiting > 0 {
+		s.WriteString(fmt.Sprintf("  (%d more waiting)", waiting))
+	}
+	s.WriteString("\n")
+	return s.String()
+}
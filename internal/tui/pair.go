@@ -0,0 +1,109 @@
+package tui
+
+import (
+	"fmt"
+	"log"
+	"shareIt/internal/server"
+	"shareIt/internal/utils"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// startPairing pairs with the peer under the cursor. The code to read out
+// appears in PEERS once the peer is reached.
+func (m *mainModel) startPairing() {
+	if len(m.peerList) == 0 || m.program == nil {
+		return
+	}
+	peer := m.peerInfo[m.peerList[m.selectedPeer]]
+	addr := peer.Addr
+	log.Printf("Pairing with %s", addr)
+	m.pairStatus = fmt.Sprintf("Contacting %s to pair...", addr)
+	go server.PairWith(peer.NodeID, addr, m.program)
+	m.updatePeersView()
+}
+
+// updatePairing handles keys while a pairing request waits for its code.
+func (m *mainModel) updatePairing(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "enter":
+		code := strings.TrimSpace(m.pairInput.Value())
+		if code == "" {
+			return m, nil
+		}
+		m.answerPairing(code)
+	case "esc":
+		m.answerPairing("")
+	default:
+		var cmd tea.Cmd
+		m.pairInput, cmd = m.pairInput.Update(msg)
+		m.updatePeersView()
+		return m, cmd
+	}
+	m.updatePeersView()
+	return m, nil
+}
+
+// answerPairing sends the typed code for the oldest pairing request, or ""
+// to decline it, and moves on to the next one.
+func (m *mainModel) answerPairing(code string) {
+	// Reply is buffered, so this never blocks even if the request just expired.
+	m.pairRequests[0].Reply <- code
+	m.dropPairing(m.pairRequests[0].ID)
+}
+
+// dropPairing removes a pairing request, restoring the previous focus once
+// nothing is left to answer.
+func (m *mainModel) dropPairing(id uint64) {
+	for i, r := range m.pairRequests {
+		if r.ID == id {
+			if i == 0 {
+				m.pairInput.Reset()
+			}
+			m.pairRequests = append(m.pairRequests[:i], m.pairRequests[i+1:]...)
+			break
+		}
+	}
+	if len(m.pairRequests) == 0 {
+		m.pairInput.Blur()
+		m.setFocus(m.pairFocus)
+	}
+}
+
+// pairingPrompt renders the modal for the oldest pairing request.
+func (m *mainModel) pairingPrompt() string {
+	r := m.pairRequests[0]
+	var s strings.Builder
+	s.WriteString(offerStyle.Render(fmt.Sprintf("%s (%s) wants to pair", r.From, r.Addr)) + "\n")
+	s.WriteString("  Type the code shown on their screen.\n")
+	s.WriteString(m.pairInput.View() + "\n")
+	s.WriteString("[enter] pair  [esc] decline")
+	if waiting := len(m.pairRequests) - 1; waiting > 0 {
+		s.WriteString(fmt.Sprintf("  (%d more waiting)", waiting))
+	}
+	s.WriteString("\n")
+	return s.String()
+}
+
+// pairingDone shows how a pairing attempt ended.
+func (m *mainModel) pairingDone(msg utils.PairingDoneMsg) {
+	if msg.Err != nil {
+		m.pairStatus = failedStyle.Render(fmt.Sprintf("Pairing with %s failed: %v", msg.Addr, msg.Err))
+		return
+	}
+	// A fresh pairing vouches for whatever key the peer has now.
+	if id, ok := m.peerAt(msg.Addr); ok {
+		delete(m.keyChanged, id)
+	}
+	m.pairStatus = verifiedStyle.Render(fmt.Sprintf("Paired with %s (%s)", msg.Name, msg.Addr))
+}
+
+// groupCode splits a pairing code in two so it is easier to read out.
+func groupCode(code string) string {
+	if len(code) < 6 {
+		return code
+	}
+	half := len(code) / 2
+	return code[:half] + " " + code[half:]
+}
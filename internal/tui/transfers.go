@@ -0,0 +1,421 @@
+package tui
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"shareIt/internal/server"
+	"shareIt/internal/utils"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+var selectedRowStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("62")).Bold(true)
+
+// transferRow is one line in UPLOADS or DOWNLOADS: one file or folder to or
+// from one peer.
+type transferRow struct {
+	direction     string // "Sending" or "Receiving"
+	filename      string
+	peer          string
+	path          string                // Local source of a failed send, for retrying
+	handle        *utils.TransferHandle // Nil once the transfer has finished
+	started       bool                  // Some data has moved
+	queued        int                   // Place in the receiver's queue, 0 if not waiting in it
+	progress      float64
+	rate          string
+	wireRate      string // Set when the transfer is compressed
+	codec         string
+	resumedAt     float64
+	pausedByPeer  bool
+	declined      bool
+	declineReason string
+	done          bool
+	err           error
+}
+
+// String renders the row without selection marks.
+func (r *transferRow) String() string {
+	head := fmt.Sprintf("%s: %s %s %s", r.direction, r.filename, peerArrow(r.direction), r.peer)
+	switch {
+	case r.declined && r.declineReason != "":
+		return failedStyle.Render(fmt.Sprintf("%s: %s refused by %s: %s", r.direction, r.filename, r.peer, r.declineReason))
+	case r.declined:
+		return fmt.Sprintf("%s: %s declined by %s", r.direction, r.filename, r.peer)
+	case r.done && r.path != "":
+		return failedStyle.Render(fmt.Sprintf("%s failed: %v (ctrl+r to retry)", head, r.err))
+	case r.done && r.err != nil:
+		return failedStyle.Render(fmt.Sprintf("%s failed: %v", head, r.err))
+	case r.done:
+		return verifiedStyle.Render(head + " 100% verified")
+	case r.queued > 0 && r.direction == "Sending":
+		head += fmt.Sprintf(" queued by peer (#%d)", r.queued)
+	case r.queued > 0:
+		head += fmt.Sprintf(" queued (#%d)", r.queued)
+	case !r.started && r.direction == "Sending":
+		head += " waiting for answer"
+	case !r.started:
+		head += " starting"
+	default:
+		rate := r.rate
+		if r.codec != "" {
+			rate += fmt.Sprintf(", %s on the wire with %s", r.wireRate, r.codec)
+		}
+		if c := r.cap(); c > 0 {
+			rate += ", cap " + formatRate(c)
+		}
+		head += fmt.Sprintf(" %.2f%% (%s)", r.progress, rate)
+		if r.resumedAt > 0 {
+			head += fmt.Sprintf(" resumed at %.0f%%", r.resumedAt)
+		}
+	}
+	if r.handle != nil && r.handle.Paused() {
+		head += " [paused]"
+	} else if r.pausedByPeer {
+		head += " [paused by peer]"
+	}
+	return head
+}
+
+// cap is the tighter of the global limit and the transfer's own, 0 if
+// neither is set.
+func (r *transferRow) cap() int64 {
+	c := server.MaxRate()
+	if r.handle != nil {
+		if own := r.handle.Limit().Rate(); own > 0 && (c == 0 || own < c) {
+			c = own
+		}
+	}
+	return c
+}
+
+// ratePresets are the limits ctrl+g and ctrl+t step through; 0 is unlimited.
+var ratePresets = []int64{0, 256 << 10, 1 << 20, 5 << 20, 10 << 20, 50 << 20}
+
+// nextRate returns the preset after cur, wrapping round to unlimited.
+func nextRate(cur int64) int64 {
+	for _, r := range ratePresets {
+		if r > cur {
+			return r
+		}
+	}
+	return 0
+}
+
+func formatRate(r int64) string {
+	if r == 0 {
+		return "unlimited"
+	}
+	return utils.HumanBytes(r) + "/s"
+}
+
+// cycleGlobalRate steps the limit on all transfers together.
+func (m *mainModel) cycleGlobalRate() {
+	rate := nextRate(server.MaxRate())
+	server.SetMaxRate(rate)
+	log.Printf("Global rate limit set to %s", formatRate(rate))
+	m.updateRateTitles()
+	m.updateTransfersView()
+}
+
+// cycleSelectedRate steps the selected transfer's own limit.
+func (m *mainModel) cycleSelectedRate() {
+	r := m.selectedTransfer()
+	if r == nil || r.handle == nil {
+		return
+	}
+	r.handle.Limit().SetRate(nextRate(r.handle.Limit().Rate()))
+	m.updateTransfersView()
+}
+
+// updateRateTitles shows the global limit in the transfer panes' titles.
+func (m *mainModel) updateRateTitles() {
+	m.uploads.title, m.downloads.title = "UPLOADS", "DOWNLOADS"
+	if rate := server.MaxRate(); rate > 0 {
+		suffix := " (max " + formatRate(rate) + " total)"
+		m.uploads.title += suffix
+		m.downloads.title += suffix
+	}
+}
+
+// addTransfer starts a row for a new transfer.
+func (m *mainModel) addTransfer(msg utils.TransferStartedMsg) {
+	m.transfers[msg.ID] = &transferRow{
+		direction: msg.Direction,
+		filename:  msg.Filename,
+		peer:      msg.Peer,
+		handle:    msg.Handle,
+	}
+	if msg.Direction == "Sending" {
+		m.uploadRows = append(m.uploadRows, msg.ID)
+	} else {
+		m.downloadRows = append(m.downloadRows, msg.ID)
+	}
+}
+
+// queueTransfer shows where an offer stands in the receiver's queue. A
+// download waiting its turn gets a row of its own, which goes once it leaves
+// the queue; the transfer that follows starts a new one.
+func (m *mainModel) queueTransfer(msg utils.TransferQueuedMsg) {
+	r, ok := m.transfers[msg.ID]
+	switch {
+	case ok && msg.Position == 0 && msg.Direction == "Receiving":
+		m.removeTransfer(msg.ID)
+	case ok:
+		r.queued = msg.Position
+	case msg.Position > 0 && msg.Direction == "Receiving":
+		m.transfers[msg.ID] = &transferRow{direction: msg.Direction, filename: msg.Filename, peer: msg.Peer, queued: msg.Position}
+		m.downloadRows = append(m.downloadRows, msg.ID)
+	}
+}
+
+// removeTransfer drops a download's row, keeping the cursor in range.
+func (m *mainModel) removeTransfer(id utils.TransferID) {
+	delete(m.transfers, id)
+	if i := slices.Index(m.downloadRows, id); i >= 0 {
+		m.downloadRows = slices.Delete(m.downloadRows, i, i+1)
+		if m.downloadCursor > 0 && m.downloadCursor >= len(m.downloadRows) {
+			m.downloadCursor--
+		}
+	}
+}
+
+// failTransfer marks a send as failed, adding its row if the send never got
+// as far as starting one.
+func (m *mainModel) failTransfer(msg utils.TransferFailedMsg) {
+	r, ok := m.transfers[msg.ID]
+	if !ok {
+		r = &transferRow{direction: "Sending", filename: msg.Filename, peer: msg.Peer}
+		m.transfers[msg.ID] = r
+		m.uploadRows = append(m.uploadRows, msg.ID)
+	}
+	r.done = true
+	r.err = msg.Err
+	r.path = msg.Path
+	r.handle = nil
+}
+
+// retrySelected queues a failed upload again for the same peer. The failed
+// row makes way for the new attempt's.
+func (m *mainModel) retrySelected() {
+	if m.focus != uploads_focus || m.uploadCursor >= len(m.uploadRows) {
+		return
+	}
+	id := m.uploadRows[m.uploadCursor]
+	r := m.transfers[id]
+	if r.path == "" || m.queue == nil {
+		return
+	}
+	delete(m.transfers, id)
+	m.uploadRows = slices.Delete(m.uploadRows, m.uploadCursor, m.uploadCursor+1)
+	if m.uploadCursor > 0 && m.uploadCursor >= len(m.uploadRows) {
+		m.uploadCursor--
+	}
+	// Failed rows name the address tried, or the node ID of a peer that had
+	// gone before the send started.
+	peer, ok := m.peerAt(r.peer)
+	if !ok {
+		peer = r.peer
+	}
+	log.Printf("Retrying %s to %s", r.path, r.peer)
+	m.queue.Add(r.path, []string{peer})
+	m.refreshQueue()
+	m.updateTransfersView()
+}
+
+// selectedTransfer returns the row under the cursor in the focused pane.
+func (m *mainModel) selectedTransfer() *transferRow {
+	switch m.focus {
+	case uploads_focus:
+		if m.uploadCursor < len(m.uploadRows) {
+			return m.transfers[m.uploadRows[m.uploadCursor]]
+		}
+	case downloads_focus:
+		if m.downloadCursor < len(m.downloadRows) {
+			return m.transfers[m.downloadRows[m.downloadCursor]]
+		}
+	}
+	return nil
+}
+
+// selectedQueued returns the waiting send under the cursor in UPLOADS,
+// whose rows follow the transfers'.
+func (m *mainModel) selectedQueued() (server.QueuedSend, bool) {
+	i := m.uploadCursor - len(m.uploadRows)
+	if m.focus != uploads_focus || i < 0 || i >= len(m.waiting) {
+		return server.QueuedSend{}, false
+	}
+	return m.waiting[i], true
+}
+
+// moveTransferCursor moves the cursor in the focused pane by delta rows,
+// wrapping around at either end.
+func (m *mainModel) moveTransferCursor(delta int) {
+	n, cursor := len(m.uploadRows)+len(m.waiting), &m.uploadCursor
+	if m.focus == downloads_focus {
+		n, cursor = len(m.downloadRows), &m.downloadCursor
+	}
+	if n == 0 {
+		return
+	}
+	*cursor = (*cursor + delta + n) % n
+	m.updateTransfersView()
+}
+
+// refreshQueue rereads the sends waiting in the queue, keeping the UPLOADS
+// cursor in range.
+func (m *mainModel) refreshQueue() {
+	if m.queue == nil {
+		return
+	}
+	m.waiting = m.queue.Waiting()
+	if n := len(m.uploadRows) + len(m.waiting); m.uploadCursor >= n {
+		m.uploadCursor = max(n-1, 0)
+	}
+}
+
+// moveSelectedQueued moves the selected waiting send delta places in the
+// queue, keeping the cursor on it.
+func (m *mainModel) moveSelectedQueued(delta int) {
+	s, ok := m.selectedQueued()
+	if !ok {
+		return
+	}
+	m.queue.Move(s.ID, delta)
+	m.refreshQueue()
+	m.followQueued(s.ID)
+	m.updateTransfersView()
+}
+
+// bumpSelectedQueued makes the selected waiting send the next to start.
+func (m *mainModel) bumpSelectedQueued() {
+	s, ok := m.selectedQueued()
+	if !ok {
+		return
+	}
+	m.queue.Bump(s.ID)
+	m.refreshQueue()
+	m.followQueued(s.ID)
+	m.updateTransfersView()
+}
+
+// followQueued puts the UPLOADS cursor on the waiting send with id.
+func (m *mainModel) followQueued(id utils.TransferID) {
+	if i := slices.IndexFunc(m.waiting, func(s server.QueuedSend) bool { return s.ID == id }); i >= 0 {
+		m.uploadCursor = len(m.uploadRows) + i
+	}
+}
+
+// togglePauseSelected pauses or resumes the selected transfer.
+func (m *mainModel) togglePauseSelected() {
+	r := m.selectedTransfer()
+	if r == nil || r.handle == nil {
+		return
+	}
+	if r.handle.Paused() {
+		r.handle.Resume()
+	} else {
+		r.handle.Pause()
+	}
+	m.updateTransfersView()
+}
+
+// cancelSelected cancels the selected transfer, or takes the selected send
+// out of the queue. A cancelled transfer's row turns red once the transfer
+// code has wound it down.
+func (m *mainModel) cancelSelected() {
+	if s, ok := m.selectedQueued(); ok {
+		m.queue.Remove(s.ID)
+		m.refreshQueue()
+		m.updateTransfersView()
+		return
+	}
+	r := m.selectedTransfer()
+	if r == nil || r.handle == nil {
+		return
+	}
+	// Telling the peer may block on the network.
+	go r.handle.Cancel()
+}
+
+// renderTransfers renders one line per row.
+func (m *mainModel) renderTransfers(rows []utils.TransferID) []string {
+	lines := make([]string, 0, len(rows))
+	for _, id := range rows {
+		lines = append(lines, m.transfers[id].String())
+	}
+	return lines
+}
+
+// renderQueue renders one line per send waiting in the queue.
+func (m *mainModel) renderQueue() []string {
+	lines := make([]string, 0, len(m.waiting))
+	for i, s := range m.waiting {
+		peers := make([]string, len(s.Peers))
+		for j, id := range s.Peers {
+			peers[j] = m.peerLabel(id)
+		}
+		lines = append(lines, fmt.Sprintf("Sending: %s -> %s queued (#%d)", filepath.Base(s.Path), strings.Join(peers, ", "), i+1))
+	}
+	return lines
+}
+
+// peerLabel names the peer nodeID for display: by its device name if it
+// gave one, else where it is, else by node ID if it has gone.
+func (m *mainModel) peerLabel(nodeID string) string {
+	info, ok := m.peerInfo[nodeID]
+	switch {
+	case !ok:
+		return nodeID
+	case info.Name != "":
+		return info.Name
+	}
+	return info.Addr
+}
+
+// markCursor indents lines, with a cursor mark on the selected one when the
+// pane is focused.
+func markCursor(lines []string, cursor int, focused bool) []string {
+	for i, line := range lines {
+		if focused && i == cursor {
+			lines[i] = selectedRowStyle.Render("> ") + line
+		} else {
+			lines[i] = "  " + line
+		}
+	}
+	return lines
+}
+
+// updateTransfersView re-renders the UPLOADS and DOWNLOADS panes, with the
+// send queue at the bottom of UPLOADS and any pending offer prompt at the
+// top of DOWNLOADS.
+func (m *mainModel) updateTransfersView() {
+	uploads := append(m.renderTransfers(m.uploadRows), m.renderQueue()...)
+	uploads = markCursor(uploads, m.uploadCursor, m.focus == uploads_focus)
+	downloads := markCursor(m.renderTransfers(m.downloadRows), m.downloadCursor, m.focus == downloads_focus)
+
+	if len(uploads) == 0 {
+		m.uploads.viewport.SetContent(uploadsHelp)
+	} else {
+		m.uploads.viewport.SetContent(strings.Join(uploads, "\n"))
+	}
+
+	if len(m.offers) > 0 {
+		downloads = append([]string{m.offerPrompt()}, downloads...)
+	}
+	if len(downloads) == 0 {
+		m.downloads.viewport.SetContent("Waiting for incoming files...")
+	} else {
+		m.downloads.viewport.SetContent(strings.Join(downloads, "\n"))
+	}
+}
+
+// peerArrow points from the file towards where it is going.
+func peerArrow(direction string) string {
+	if direction == "Sending" {
+		return "->"
+	}
+	return "<-"
+}
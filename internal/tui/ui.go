@@ -6,6 +6,7 @@ import (
 	"os"
 	"shareIt/internal/server"
 	"shareIt/internal/utils"
+	"slices"
 	"strings"
 
 	"github.com/charmbracelet/bubbles/textinput"
@@ -34,8 +35,18 @@ var (
 	unfocusedStyle = lipgloss.NewStyle().
 			BorderStyle(lipgloss.RoundedBorder()).
 			BorderForeground(lipgloss.Color("240")) // A dim gray
+
+	// Styling for finished transfer rows.
+	verifiedStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("42"))  // Green
+	failedStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("196")) // Red
+
+	// Styling for the details under each peer.
+	detailStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("244")) // Gray
 )
 
+// uploadsHelp is shown in UPLOADS until the first transfer starts.
+const uploadsHelp = "Enter a file or folder path and press Enter to send to the selected peer.\nMark several peers with space to send to all of them.\nUse up/down to pick a transfer, ctrl+p to pause or resume it,\nctrl+x to cancel it and ctrl+r to retry it if it failed.\nctrl+t steps its speed limit, ctrl+g the limit on all transfers.\nWaiting sends move with shift+up/down; ctrl+b makes one the next to go."
+
 // mainModel is the top-level model for our application.
 type mainModel struct {
 	peers        sectionModel
@@ -45,10 +56,30 @@ type mainModel struct {
 	focus        int // To track which pane is focused
 	width        int
 	height       int
-	peerList     []string
-	selectedPeer int               // Index of the currently selected peer
-	transferLog  map[string]string // Map to store transfer progress strings
-	program      *tea.Program      // To send messages from spawned goroutines
+	peerList     []string              // Node IDs of the discovered peers, in display order
+	peerInfo     map[string]utils.Peer // What each peer announced, by node ID
+	selectedPeer int                   // Index of the currently selected peer
+	checkedPeers map[string]bool       // Peers marked with space for a multi-peer send, by node ID
+	keyChanged   map[string]bool       // Node IDs whose certificate no longer matches its pin
+	program      *tea.Program          // To send messages from spawned goroutines
+	queue        *server.SendQueue
+
+	transfers      map[utils.TransferID]*transferRow
+	uploadRows     []utils.TransferID  // Rows in UPLOADS, oldest first
+	downloadRows   []utils.TransferID  // Rows in DOWNLOADS, oldest first
+	waiting        []server.QueuedSend // Sends in the queue, shown after uploadRows
+	uploadCursor   int
+	downloadCursor int
+
+	offers      []utils.IncomingOfferMsg // Incoming files waiting for a decision, oldest first
+	offerFocus  int                      // Pane to return to once all offers are answered
+	renaming    bool                     // Whether the rename prompt is open for offers[0]
+	renameInput textinput.Model
+
+	pairRequests []utils.PairingRequestMsg // Devices waiting for us to type their code, oldest first
+	pairFocus    int                       // Pane to return to once all requests are answered
+	pairInput    textinput.Model
+	pairStatus   string // Progress or outcome of the latest pairing, shown under PEERS
 }
 
 // sectionModel represents one of the three panes in the UI.
@@ -62,6 +93,12 @@ func (m *mainModel) SetProgram(p *tea.Program) {
 	m.program = p
 }
 
+// SetSendQueue gives the model the queue new sends go through.
+func (m *mainModel) SetSendQueue(q *server.SendQueue) {
+	m.queue = q
+	m.refreshQueue()
+}
+
 // newSection creates a new section with a given title.
 func newSection(title string) sectionModel {
 	vp := viewport.New(0, 0)
@@ -114,6 +151,14 @@ func InitialModel() *mainModel {
 	ti.CharLimit = 256
 	ti.Width = 20
 
+	ri := textinput.New()
+	ri.Prompt = "Save as: "
+	ri.CharLimit = 255
+
+	pi := textinput.New()
+	pi.Prompt = "Code: "
+	pi.CharLimit = 16
+
 	m := mainModel{
 		peers:        newSection("PEERS"),
 		uploads:      newSection("UPLOADS"),
@@ -121,10 +166,16 @@ func InitialModel() *mainModel {
 		input:        ti,
 		focus:        uploads_focus,
 		selectedPeer: 0,
-		transferLog:  make(map[string]string),
+		checkedPeers: make(map[string]bool),
+		keyChanged:   make(map[string]bool),
+		peerInfo:     make(map[string]utils.Peer),
+		transfers:    make(map[utils.TransferID]*transferRow),
+		renameInput:  ri,
+		pairInput:    pi,
 	}
 	m.uploads.focused = true
-	m.uploads.viewport.SetContent("Enter a file path and press Enter to send to the selected peer.")
+	m.updateRateTitles()
+	m.uploads.viewport.SetContent(uploadsHelp)
 	m.downloads.viewport.SetContent("Waiting for incoming files...")
 	return &m
 }
@@ -153,38 +204,142 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.uploads.setSize(rightColWidth, topRowHeight-1)
 		m.downloads.setSize(m.width, bottomRowHeight)
 		m.input.Width = rightColWidth - focusedStyle.GetHorizontalFrameSize() - 2
+		m.renameInput.Width = m.width - focusedStyle.GetHorizontalFrameSize() - len(m.renameInput.Prompt) - 2
 
 	case utils.PeersUpdatedMsg:
-		m.peerList = msg.Peers
-		if m.selectedPeer >= len(m.peerList) {
+		// Keep the cursor on the same device, even if it moved to another
+		// address or others came and went around it.
+		var selected string
+		if m.selectedPeer < len(m.peerList) {
+			selected = m.peerList[m.selectedPeer]
+		}
+		m.peerList = m.peerList[:0]
+		clear(m.peerInfo)
+		for _, peer := range msg.Peers {
+			m.peerList = append(m.peerList, peer.NodeID)
+			m.peerInfo[peer.NodeID] = peer
+		}
+		if i := slices.Index(m.peerList, selected); i >= 0 {
+			m.selectedPeer = i
+		} else if m.selectedPeer >= len(m.peerList) {
 			m.selectedPeer = 0 // Reset selection if it's out of bounds
 		}
+		// Forget marks on peers that have gone away.
+		for peer := range m.checkedPeers {
+			if !slices.Contains(m.peerList, peer) {
+				delete(m.checkedPeers, peer)
+			}
+		}
+		m.updatePeersView()
+
+	case utils.DiscoveryStatusMsg:
+		m.peers.title = "PEERS (via " + strings.Join(msg.Mechanisms, ", ") + ")"
+
+	case utils.PairingCodeMsg:
+		m.pairStatus = offerStyle.Render(fmt.Sprintf("Pairing with %s: type %s on that device", msg.Addr, groupCode(msg.Code)))
+		m.updatePeersView()
+
+	case utils.PairingRequestMsg:
+		if len(m.pairRequests) == 0 {
+			m.pairFocus = m.focus
+			m.setFocus(peers_focus)
+		}
+		m.pairRequests = append(m.pairRequests, msg)
+		m.updatePeersView()
+		cmds = append(cmds, m.pairInput.Focus())
+
+	case utils.PairingExpiredMsg:
+		m.dropPairing(msg.ID)
+		m.updatePeersView()
+
+	case utils.PairingDoneMsg:
+		m.pairingDone(msg)
+		m.updatePeersView()
+
+	case utils.PeerKeyChangedMsg:
+		m.keyChanged[msg.NodeID] = true
 		m.updatePeersView()
 
+	case utils.TransferStartedMsg:
+		m.addTransfer(msg)
+		m.updateTransfersView()
+
 	case utils.FileTransferMsg:
-		key := fmt.Sprintf("%s-%s", msg.Direction, msg.Filename)
-		m.transferLog[key] = fmt.Sprintf("%s: %s %.2f%% (%s)", msg.Direction, msg.Filename, msg.Progress, msg.Rate)
+		if r, ok := m.transfers[msg.ID]; ok {
+			r.started = true
+			r.progress = msg.Progress
+			r.rate = msg.Rate
+			r.wireRate = msg.WireRate
+			r.codec = msg.Codec
+			r.resumedAt = msg.ResumedAt
+		}
+		m.updateTransfersView()
 
-		var uploads, downloads []string
-		for k, v := range m.transferLog {
-			if strings.HasPrefix(k, "Sending") {
-				uploads = append(uploads, v)
-			} else {
-				downloads = append(downloads, v)
-			}
+	case utils.TransferPausedMsg:
+		if r, ok := m.transfers[msg.ID]; ok {
+			r.pausedByPeer = msg.Paused
+		}
+		m.updateTransfersView()
+
+	case utils.TransferDoneMsg:
+		if r, ok := m.transfers[msg.ID]; ok {
+			r.done = true
+			r.err = msg.Err
+			r.handle = nil
 		}
-		m.uploads.viewport.SetContent(strings.Join(uploads, "\n"))
-		m.downloads.viewport.SetContent(strings.Join(downloads, "\n"))
+		m.updateTransfersView()
+
+	case utils.TransferFailedMsg:
+		m.failTransfer(msg)
+		m.updateTransfersView()
+
+	case utils.SendQueueMsg:
+		m.refreshQueue()
+		m.updateTransfersView()
+
+	case utils.TransferQueuedMsg:
+		m.queueTransfer(msg)
+		m.updateTransfersView()
+
+	case utils.TransferDeclinedMsg:
+		if r, ok := m.transfers[msg.ID]; ok {
+			r.declined = true
+			r.declineReason = msg.Reason
+			r.handle = nil
+		}
+		m.updateTransfersView()
+
+	case utils.IncomingOfferMsg:
+		if len(m.offers) == 0 {
+			m.offerFocus = m.focus
+			m.setFocus(downloads_focus)
+		}
+		m.offers = append(m.offers, msg)
+		m.updateTransfersView()
+
+	case utils.OfferExpiredMsg:
+		m.dropOffer(msg.ID)
+		m.updateTransfersView()
 
 	case utils.LogMsg:
 		log.Println("TUI Log:", msg.Message)
 
 	case tea.KeyMsg:
+		// A pending pairing request or offer is modal: it gets every key
+		// except the hard quit.
+		if len(m.pairRequests) > 0 && msg.String() != "ctrl+c" {
+			return m.updatePairing(msg)
+		}
+		if len(m.offers) > 0 && msg.String() != "ctrl+c" {
+			return m.updateOffer(msg)
+		}
+
 		switch msg.String() {
 		case "q", "ctrl+c", "esc":
 			return m, tea.Quit
 
-		// Handle navigation in the peers list
+		// Handle navigation in the peers list and the transfer rows. In
+		// UPLOADS, k and j are typed into the path input instead.
 		case "up", "k":
 			if m.focus == peers_focus && len(m.peerList) > 0 {
 				m.selectedPeer--
@@ -192,6 +347,8 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					m.selectedPeer = len(m.peerList) - 1
 				}
 				m.updatePeersView()
+			} else if m.focus == downloads_focus || msg.String() == "up" && m.focus == uploads_focus {
+				m.moveTransferCursor(-1)
 			}
 		case "down", "j":
 			if m.focus == peers_focus && len(m.peerList) > 0 {
@@ -200,18 +357,53 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					m.selectedPeer = 0
 				}
 				m.updatePeersView()
+			} else if m.focus == downloads_focus || msg.String() == "down" && m.focus == uploads_focus {
+				m.moveTransferCursor(1)
+			}
+		case "p":
+			// Pair with the peer under the cursor.
+			if m.focus == peers_focus {
+				m.startPairing()
+			}
+		case "ctrl+p":
+			m.togglePauseSelected()
+			return m, nil
+		case "ctrl+x":
+			m.cancelSelected()
+			return m, nil
+		case "ctrl+r":
+			m.retrySelected()
+			return m, nil
+		case "ctrl+g":
+			m.cycleGlobalRate()
+			return m, nil
+		case "ctrl+t":
+			m.cycleSelectedRate()
+			return m, nil
+		case "shift+up":
+			m.moveSelectedQueued(-1)
+			return m, nil
+		case "shift+down":
+			m.moveSelectedQueued(1)
+			return m, nil
+		case "ctrl+b":
+			m.bumpSelectedQueued()
+			return m, nil
+		case " ":
+			// Mark or unmark the peer under the cursor for a multi-peer send.
+			if m.focus == peers_focus && len(m.peerList) > 0 {
+				peer := m.peerList[m.selectedPeer]
+				if m.checkedPeers[peer] {
+					delete(m.checkedPeers, peer)
+				} else {
+					m.checkedPeers[peer] = true
+				}
+				m.updatePeersView()
 			}
 
 		case "tab":
-			m.focus = (m.focus + 1) % 3
-			m.peers.focused = m.focus == peers_focus
-			m.uploads.focused = m.focus == uploads_focus
-			m.downloads.focused = m.focus == downloads_focus
-			if m.focus == uploads_focus {
-				m.input.Focus()
-			} else {
-				m.input.Blur()
-			}
+			m.setFocus((m.focus + 1) % 3)
+			m.updateTransfersView()
 			return m, nil
 
 		case "enter":
@@ -222,14 +414,16 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					return m, nil
 				}
 
-				if len(m.peerList) > 0 && m.selectedPeer < len(m.peerList) {
-					// Send the file to the currently selected peer.
-					peerAddr := m.peerList[m.selectedPeer]
-					log.Printf("Initiating send of %s to %s", filePath, peerAddr)
-					if m.program != nil {
-						go server.SendFile(filePath, peerAddr, m.program)
+				if targets := m.sendTargets(); len(targets) > 0 {
+					// Send the file to every marked peer, or the selected one,
+					// once the queue gets to it.
+					log.Printf("Queueing %s for %s", filePath, strings.Join(targets, ", "))
+					if m.queue != nil {
+						m.queue.Add(filePath, targets)
+						m.refreshQueue()
+						m.updateTransfersView()
 					} else {
-						log.Println("TUI program not initialized, cannot send file.")
+						log.Println("Send queue not initialized, cannot send file.")
 					}
 				} else {
 					log.Println("No peers found to send file to.")
@@ -254,27 +448,126 @@ func (m *mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		cmds = append(cmds, cmd)
 	}
 
+	// Keep the rename and pairing prompts' cursors blinking.
+	if len(m.pairRequests) > 0 {
+		m.pairInput, cmd = m.pairInput.Update(msg)
+		cmds = append(cmds, cmd)
+		m.updatePeersView()
+	}
+	if m.renaming {
+		m.renameInput, cmd = m.renameInput.Update(msg)
+		cmds = append(cmds, cmd)
+		m.updateTransfersView()
+	}
+
 	return m, tea.Batch(cmds...)
 }
 
+// setFocus moves the focus to the given pane.
+func (m *mainModel) setFocus(focus int) {
+	m.focus = focus
+	m.peers.focused = m.focus == peers_focus
+	m.uploads.focused = m.focus == uploads_focus
+	m.downloads.focused = m.focus == downloads_focus
+	if m.focus == uploads_focus {
+		m.input.Focus()
+	} else {
+		m.input.Blur()
+	}
+}
+
+// sendTargets returns the node IDs of the peers marked with space, in list
+// order, or just the peer under the cursor if none are marked.
+func (m *mainModel) sendTargets() []string {
+	var targets []string
+	for _, peer := range m.peerList {
+		if m.checkedPeers[peer] {
+			targets = append(targets, peer)
+		}
+	}
+	if len(targets) == 0 && m.selectedPeer < len(m.peerList) {
+		targets = append(targets, m.peerList[m.selectedPeer])
+	}
+	return targets
+}
+
+// peerAt returns the node ID of the peer announcing from addr.
+func (m *mainModel) peerAt(addr string) (string, bool) {
+	for id, info := range m.peerInfo {
+		if slices.Contains(info.Addrs, addr) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
 // updatePeersView is a helper function to render the list of peers with a selection indicator.
 func (m *mainModel) updatePeersView() {
+	var s strings.Builder
+	if len(m.pairRequests) > 0 {
+		s.WriteString(m.pairingPrompt() + "\n")
+	}
 	if len(m.peerList) > 0 {
-		var s strings.Builder
 		selectedStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("62")).Bold(true)
 
 		for i, peer := range m.peerList {
+			mark := "[ ] "
+			if m.checkedPeers[peer] {
+				mark = "[x] "
+			}
+			info := m.peerInfo[peer]
+			label := info.Addr
+			if info.Name != "" {
+				label = info.Name + " " + info.Addr
+			}
+			var note string
+			if m.keyChanged[peer] {
+				note = " " + failedStyle.Render("! key changed, not trusted")
+			} else if name, ok := server.PairedName(info.Addr); ok {
+				note = " " + verifiedStyle.Render("paired: "+name)
+			}
 			if i == m.selectedPeer {
-				s.WriteString(selectedStyle.Render("> "+peer) + "\n")
+				s.WriteString(selectedStyle.Render("> "+mark+label) + note + "\n")
 			} else {
-				s.WriteString("  " + peer + "\n")
+				s.WriteString("  " + mark + label + note + "\n")
 			}
+			s.WriteString("      " + peerDetails(info) + "\n")
 		}
-		m.peers.viewport.SetContent(s.String())
 	} else {
 		m.selectedPeer = 0
-		m.peers.viewport.SetContent("Scanning for peers...")
+		s.WriteString("Scanning for peers...\n")
 	}
+	if m.pairStatus != "" {
+		s.WriteString("\n" + m.pairStatus + "\n")
+	}
+	if len(m.peerList) > 0 && len(m.pairRequests) == 0 {
+		s.WriteString("\n[space] mark  [p] pair")
+	}
+	m.peers.viewport.SetContent(s.String())
+}
+
+// peerDetails summarises what a peer announced about itself.
+func peerDetails(info utils.Peer) string {
+	var parts []string
+	for _, part := range []string{info.Username, info.OS} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if info.AppVersion != "" {
+		parts = append(parts, "v"+strings.TrimPrefix(info.AppVersion, "v"))
+	}
+	if info.Features != "" && info.Features != "none" {
+		parts = append(parts, info.Features)
+	}
+	if len(info.Addrs) > 1 {
+		parts = append(parts, "also at "+strings.Join(info.Addrs[1:], ", "))
+	}
+	details := detailStyle.Render(strings.Join(parts, " · "))
+	if !info.Compatible {
+		details += " " + failedStyle.Render("incompatible version")
+	}
+	return details
 }
 
 // View now uses a pointer receiver for consistency.
@@ -301,4 +594,3 @@ func (m *mainModel) View() string {
 		m.downloads.View(),
 	)
 }
-
@@ -11,16 +11,36 @@ const progressUpdateThreshold = 150 * time.Millisecond
 
 
 // NewProgressWriter creates a new ProgressWriter.
-func NewProgressWriter(total int64, filename, direction string, p *tea.Program) *ProgressWriter {
+func NewProgressWriter(id TransferID, total int64, filename, direction, peer string, p *tea.Program) *ProgressWriter {
 	return &ProgressWriter{
+		id:        id,
 		total:     total,
 		startTime: time.Now(),
 		filename:  filename,
 		direction: direction,
+		peer:      peer,
 		program:   p,
 	}
 }
 
+// SetOffset marks the first offset bytes as already transferred, for a
+// transfer resumed after an interruption.
+func (pw *ProgressWriter) SetOffset(offset int64) {
+	pw.written = offset
+	pw.resumedAt = offset
+}
+
+// SetCodec marks the transfer as compressed with codec, so the wire rate
+// is reported next to the rate of file bytes.
+func (pw *ProgressWriter) SetCodec(codec string) {
+	pw.codec = codec
+}
+
+// AddWire counts n compressed bytes sent or received.
+func (pw *ProgressWriter) AddWire(n int) {
+	pw.wire += int64(n)
+}
+
 // Write implements the io.Writer interface for ProgressWriter.
 // It is called for each chunk of data that is transferred.
 func (pw *ProgressWriter) Write(p []byte) (int, error) {
@@ -37,26 +57,54 @@ func (pw *ProgressWriter) Write(p []byte) (int, error) {
 	// Calculate progress and transfer rate.
 	percentage := float64(pw.written) * 100 / float64(pw.total)
 	elapsed := time.Since(pw.startTime).Seconds()
-	var rate float64
-	if elapsed > 0 {
-		rate = float64(pw.written) / elapsed / 1024 // Rate in KB/s
-	}
-
-	// Determine the unit (KB/s or MB/s).
-	rateStr := fmt.Sprintf("%.2f KB/s", rate)
-	if rate > 1024 {
-		rateStr = fmt.Sprintf("%.2f MB/s", rate/1024)
+	rateStr := formatRate(pw.written-pw.resumedAt, elapsed)
+	var wireStr string
+	if pw.codec != "" {
+		wireStr = formatRate(pw.wire, elapsed)
 	}
 
 	// Send a message to the TUI to update the progress display.
 	if pw.program != nil {
 		pw.program.Send(FileTransferMsg{
+			ID:        pw.id,
 			Filename:  pw.filename,
 			Progress:  percentage,
 			Rate:      rateStr,
 			Direction: pw.direction,
+			Peer:      pw.peer,
+			ResumedAt: float64(pw.resumedAt) * 100 / float64(pw.total),
+			Codec:     pw.codec,
+			WireRate:  wireStr,
 		})
 	}
 
 	return n, nil
-}
\ No newline at end of file
+}
+
+// formatRate formats n bytes over elapsed seconds as KB/s or MB/s.
+func formatRate(n int64, elapsed float64) string {
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(n) / elapsed / 1024 // Rate in KB/s
+	}
+
+	// Determine the unit (KB/s or MB/s).
+	if rate > 1024 {
+		return fmt.Sprintf("%.2f MB/s", rate/1024)
+	}
+	return fmt.Sprintf("%.2f KB/s", rate)
+}
+
+// HumanBytes formats a byte count for display, e.g. "12.3 MB".
+func HumanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
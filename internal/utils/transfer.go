@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"errors"
+	"shareIt/internal/ratelimit"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrCancelled ends a transfer the local user cancelled.
+var ErrCancelled = errors.New("cancelled")
+
+// ErrCancelledByPeer ends a transfer the other side cancelled.
+var ErrCancelledByPeer = errors.New("cancelled by peer")
+
+// TransferID identifies one transfer: one file or folder to or from one peer.
+type TransferID uint64
+
+var nextTransferID atomic.Uint64
+
+// NewTransferID returns an ID no other transfer in this process has.
+func NewTransferID() TransferID {
+	return TransferID(nextTransferID.Add(1))
+}
+
+// TransferHandle lets the UI pause, resume and cancel a transfer running in
+// another goroutine. The transfer code calls Wait between chunks.
+type TransferHandle struct {
+	ID TransferID
+
+	mu        sync.Mutex
+	paused    bool
+	unpaused  chan struct{} // Closed when the current pause ends
+	cancelled chan struct{} // Closed by Cancel
+	onCancel  func()
+	limit     *ratelimit.Limiter // This transfer's own cap, on top of the global one
+}
+
+// NewTransferHandle returns a running handle with a fresh ID.
+func NewTransferHandle() *TransferHandle {
+	return &TransferHandle{
+		ID:        NewTransferID(),
+		cancelled: make(chan struct{}),
+		limit:     ratelimit.New(0),
+	}
+}
+
+// Limit is the transfer's own rate limit, unlimited until set.
+func (h *TransferHandle) Limit() *ratelimit.Limiter {
+	return h.limit
+}
+
+// Done is closed once h is cancelled.
+func (h *TransferHandle) Done() <-chan struct{} {
+	return h.cancelled
+}
+
+// OnCancel sets what Cancel does besides waking Wait, normally telling the
+// peer. It replaces any earlier function. If h is already cancelled, f runs
+// straight away.
+func (h *TransferHandle) OnCancel(f func()) {
+	h.mu.Lock()
+	h.onCancel = f
+	h.mu.Unlock()
+	if h.Cancelled() {
+		f()
+	}
+}
+
+// Pause holds the transfer at its next Wait.
+func (h *TransferHandle) Pause() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.paused && !h.Cancelled() {
+		h.paused = true
+		h.unpaused = make(chan struct{})
+	}
+}
+
+// Resume releases a paused transfer.
+func (h *TransferHandle) Resume() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.paused {
+		h.paused = false
+		close(h.unpaused)
+	}
+}
+
+// Paused reports whether h is paused.
+func (h *TransferHandle) Paused() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.paused
+}
+
+// Cancel stops the transfer for good. It may block while the peer is told.
+func (h *TransferHandle) Cancel() {
+	h.mu.Lock()
+	if h.Cancelled() {
+		h.mu.Unlock()
+		return
+	}
+	close(h.cancelled)
+	if h.paused {
+		h.paused = false
+		close(h.unpaused)
+	}
+	onCancel := h.onCancel
+	h.mu.Unlock()
+
+	if onCancel != nil {
+		onCancel()
+	}
+}
+
+// Cancelled reports whether Cancel has been called.
+func (h *TransferHandle) Cancelled() bool {
+	select {
+	case <-h.cancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait blocks while h is paused. It returns ErrCancelled once h has been
+// cancelled.
+func (h *TransferHandle) Wait() error {
+	h.mu.Lock()
+	paused, unpaused := h.paused, h.unpaused
+	h.mu.Unlock()
+	if paused {
+		select {
+		case <-unpaused:
+		case <-h.cancelled:
+		}
+	}
+	if h.Cancelled() {
+		return ErrCancelled
+	}
+	return nil
+}
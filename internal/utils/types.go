@@ -6,16 +6,87 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 )
 
+// PeersUpdatedMsg lists the devices currently announcing themselves, sorted
+// by name.
 type PeersUpdatedMsg struct {
-	Peers []string
+	Peers []Peer
+}
+
+// DiscoveryStatusMsg lists the ways peers are being found, e.g. "multicast"
+// or "broadcast". It is sent again whenever one more starts.
+type DiscoveryStatusMsg struct {
+	Mechanisms []string
+}
+
+// Peer is a device found by discovery. It is known by its node ID, and may
+// be announcing itself from several addresses at once, e.g. over both Wi-Fi
+// and Ethernet.
+type Peer struct {
+	NodeID string
+	Addr   string   // Where to connect: the first of Addrs
+	Addrs  []string // Every address it announces from, most recently heard first
+	PeerDetails
+}
+
+// PeerDetails is what a peer says about itself, with anything unprintable
+// removed.
+type PeerDetails struct {
+	Name       string // Device name
+	Username   string
+	OS         string
+	AppVersion string
+	Features   string // Optional protocol features, e.g. "gzip"
+	Compatible bool   // Speaks our protocol version
+}
+
+// PeerKeyChangedMsg warns that a peer presented a different certificate
+// from the one pinned for it. Connections to it are refused.
+type PeerKeyChangedMsg struct {
+	Addr   string
+	NodeID string
+}
+
+// PairingCodeMsg shows the code the user must type in on the device at Addr
+// to finish pairing with it.
+type PairingCodeMsg struct {
+	Addr string
+	Code string
+}
+
+// PairingRequestMsg asks the user for the code shown on a device that wants
+// to pair. Exactly one code must be sent on Reply; "" declines.
+type PairingRequestMsg struct {
+	ID    uint64
+	From  string // The other device's name
+	Addr  string
+	Reply chan<- string
+}
+
+// PairingExpiredMsg withdraws a pairing request the user did not answer in
+// time.
+type PairingExpiredMsg struct {
+	ID uint64
+}
+
+// PairingDoneMsg reports the end of a pairing attempt with the device at
+// Addr. Err is nil if the two are now paired.
+type PairingDoneMsg struct {
+	Addr string
+	Name string
+	Err  error
 }
 
 // FileTransferMsg is sent by the progress writer during a file transfer.
 type FileTransferMsg struct {
+	ID        TransferID
 	Filename  string
 	Progress  float64
 	Rate      string
-	Direction string // "Sending" or "Receiving"
+	Direction string  // "Sending" or "Receiving"
+	Peer      string  // The other side's address
+	ResumedAt float64 // Percentage the transfer resumed from, 0 if it started fresh
+	Codec     string  // Compression on the wire, empty if none
+	WireRate  string  // Rate of compressed bytes on the wire, empty if uncompressed
 }
 
 // LogMsg is a generic message for logging information to the UI.
@@ -23,12 +94,105 @@ type LogMsg struct {
 	Message string
 }
 
+// IncomingOfferMsg asks the user whether to accept a file a peer wants to
+// send. Exactly one decision must be sent on Reply.
+type IncomingOfferMsg struct {
+	ID         uint64
+	Filename   string
+	Size       int64
+	IsDir      bool   // The offer is a whole directory tree
+	Files      int    // Number of files in an offered directory
+	From       string // The sender's device name
+	Addr       string
+	Exists     bool  // A file by this name exists and the user may choose to overwrite it
+	ResumeFrom int64 // Bytes already held from an interrupted transfer, 0 if none
+	Reply      chan<- OfferDecision
+}
+
+// OfferDecision is the user's answer to an IncomingOfferMsg.
+type OfferDecision struct {
+	Accept    bool
+	Name      string // Optional new name to save the file under
+	Overwrite bool   // Replace an existing file instead of saving alongside it
+}
+
+// OfferExpiredMsg withdraws an offer the user did not answer in time.
+type OfferExpiredMsg struct {
+	ID uint64
+}
+
+// TransferStartedMsg announces a new transfer row. Handle controls the
+// transfer until its TransferDoneMsg arrives.
+type TransferStartedMsg struct {
+	ID        TransferID
+	Filename  string
+	Direction string // "Sending" or "Receiving"
+	Peer      string
+	Handle    *TransferHandle
+}
+
+// TransferPausedMsg tells the UI that the peer paused or resumed a transfer.
+type TransferPausedMsg struct {
+	ID     TransferID
+	Paused bool
+}
+
+// TransferQueuedMsg says where an offer stands in the receiver's queue of
+// transfers waiting for a free slot, 1 being next. Position 0 means it has
+// left the queue: a waiting download's row goes away, and an upload goes
+// back to waiting for the receiver's answer.
+type TransferQueuedMsg struct {
+	ID        TransferID
+	Filename  string
+	Direction string // "Sending" or "Receiving"
+	Peer      string
+	Position  int
+}
+
+// SendQueueMsg tells the UI that outgoing sends were queued or started. The
+// UI reads the queue itself.
+type SendQueueMsg struct{}
+
+// TransferDeclinedMsg tells the sender's UI that the peer declined a file.
+type TransferDeclinedMsg struct {
+	ID       TransferID
+	Filename string
+	Peer     string
+	Reason   string // Why the peer refused it without asking, e.g. "not enough disk space"; empty if the user said no
+}
+
+// TransferFailedMsg reports a send that did not complete. Path is the local
+// file or folder, so the user can retry it.
+type TransferFailedMsg struct {
+	ID       TransferID
+	Filename string
+	Path     string
+	Peer     string
+	Err      error
+}
+
+// TransferDoneMsg reports the end of a transfer. Err is nil if the receiver
+// verified the file's SHA-256, otherwise it says what went wrong. A send
+// that fails ends with a TransferFailedMsg instead.
+type TransferDoneMsg struct {
+	ID        TransferID
+	Filename  string
+	Direction string // "Sending" or "Receiving"
+	Peer      string
+	Err       error
+}
+
 type ProgressWriter struct {
+	id         TransferID
 	total      int64
 	written    int64
+	resumedAt  int64 // Offset the transfer resumed from
+	codec      string
+	wire       int64 // Compressed bytes moved, when codec is set
 	startTime  time.Time
 	lastUpdate time.Time
 	filename   string
 	direction  string
+	peer       string
 	program    *tea.Program
 }
@@ -1,21 +1,48 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"shareIt/internal/config"
+	"shareIt/internal/identity"
+	"shareIt/internal/protocol"
+	"shareIt/internal/ratelimit"
 	"shareIt/internal/server"
+	"shareIt/internal/storage"
+	"shareIt/internal/trust"
 	"shareIt/internal/tui"
+	"strings"
 	"syscall"
 	"time"
 		"flag"
 	tea "github.com/charmbracelet/bubbletea"
 )
 
+// version is reported to other devices. Release builds set it with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
 func main() {	
 
 	port := flag.Int("port", 8000, "The port for the TCP file server.")
+	configPath := flag.String("config", "", "Path to the config file (default: <user config dir>/shareit/config.json).")
+	downloadDir := flag.String("download-dir", "", "Directory received files are saved in.")
+	onCollision := flag.String("on-collision", "", "What to do when a received file already exists: rename, overwrite, skip or ask.")
+	maxRate := flag.String("max-rate", "", "Cap on all transfers together, e.g. 500K or 10MB/s (0 for unlimited).")
+	partialFiles := flag.String("partial-files", "", "What to do with downloads cut off halfway: keep (to resume later) or delete.")
+	maxFileSize := flag.String("max-file-size", "", "Refuse received files larger than this, e.g. 4G (0 for no limit).")
+	quota := flag.String("quota", "", "Refuse files once the download directory would hold more than this, e.g. 100G (0 for no limit).")
+	stallTimeout := flag.String("stall-timeout", "", "Fail a transfer that makes no progress for this long, e.g. 30s.")
+	maxIncoming := flag.Int("max-incoming", 0, "How many incoming transfers may run at once; more wait in a queue.")
+	maxPeerConns := flag.Int("max-peer-connections", 0, "How many connections one address may have open at once.")
+	maxActiveSends := flag.Int("max-active-sends", 0, "How many queued sends may run at once.")
+	discovery := flag.String("discovery", "", "How to find peers: multicast, mdns (DNS-SD) or both.")
+	var interfaces string
+	flag.StringVar(&interfaces, "interface", "", "Comma-separated network interfaces (by name or IPv4 address) to find peers on and listen for connections on; all by default.")
+	flag.StringVar(&interfaces, "bind", "", "Same as -interface.")
+	preserveMetadata := flag.String("preserve-metadata", "", "Whose file permissions and modification times to keep: all, paired or none.")
 	flag.Parse()
 	tcpPort := *port 
 
@@ -25,16 +52,126 @@ func main() {
 	}
 	defer f.Close()
 
-	myIP, err := server.GetOutboundIP()
+	log.Printf("Starting ShareIt on port %d", tcpPort)
+
+	stateDir, err := identity.Dir()
+	if err != nil {
+		log.Fatalf("Could not locate config directory: %v", err)
+	}
+	nodeID, err := identity.LoadNodeID(stateDir)
+	if err != nil {
+		log.Fatalf("Could not load node ID: %v", err)
+	}
+	log.Printf("Node ID: %s", nodeID)
+	cert, err := identity.LoadCertificate(stateDir, nodeID.String())
+	if err != nil {
+		log.Fatalf("Could not load device certificate: %v", err)
+	}
+	log.Printf("Certificate fingerprint: %s", identity.Fingerprint(cert.Certificate[0]))
+	pins, err := trust.Load(filepath.Join(stateDir, trust.FileName))
+	if err != nil {
+		log.Fatalf("Could not load known peers: %v", err)
+	}
+	devices, err := trust.LoadDevices(filepath.Join(stateDir, trust.DevicesFileName))
+	if err != nil {
+		log.Fatalf("Could not load trusted devices: %v", err)
+	}
+
+	if *configPath == "" {
+		*configPath = filepath.Join(stateDir, config.FileName)
+	}
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Could not load config: %v", err)
+	}
+	// Flags win over the config file.
+	if *downloadDir != "" {
+		cfg.DownloadDir = *downloadDir
+	}
+	if *onCollision != "" {
+		cfg.CollisionPolicy = storage.CollisionPolicy(*onCollision)
+	}
+	if *maxRate != "" {
+		cfg.MaxRate = *maxRate
+	}
+	if *partialFiles != "" {
+		cfg.Partials = storage.PartialPolicy(*partialFiles)
+	}
+	if *maxFileSize != "" {
+		cfg.MaxFileSize = *maxFileSize
+	}
+	if *quota != "" {
+		cfg.Quota = *quota
+	}
+	if *stallTimeout != "" {
+		cfg.StallTimeout = *stallTimeout
+	}
+	if *maxIncoming != 0 {
+		cfg.MaxIncoming = *maxIncoming
+	}
+	if *maxPeerConns != 0 {
+		cfg.MaxPeerConns = *maxPeerConns
+	}
+	if *maxActiveSends != 0 {
+		cfg.MaxActiveSends = *maxActiveSends
+	}
+	if *preserveMetadata != "" {
+		cfg.Metadata = storage.MetadataPolicy(*preserveMetadata)
+	}
+	if *discovery != "" {
+		cfg.Discovery = protocol.DiscoveryMode(*discovery)
+	}
+	if interfaces != "" {
+		cfg.Interfaces = strings.Split(interfaces, ",")
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid settings: %v", err)
+	}
+	if err := os.MkdirAll(cfg.DownloadDir, 0o755); err != nil {
+		log.Fatalf("Could not create download directory: %v", err)
+	}
+	if err := storage.CleanPartials(cfg.DownloadDir, cfg.Partials); err != nil {
+		log.Printf("Could not clean up partial downloads: %v", err)
+	}
+	log.Printf("Saving received files to %s (on collision: %s)", cfg.DownloadDir, cfg.CollisionPolicy)
+
+	deviceName, err := os.Hostname()
 	if err != nil {
-		log.Printf("Could not get local IP, discovery may be unreliable: %v", err)
-		myIP = "127.0.0.1" // Fallback
+		deviceName = "ShareIt " + nodeID.String()[:8]
 	}
-	myAddr := fmt.Sprintf("%s:%d", myIP, tcpPort)
-	log.Printf("Starting ShareIt. My address is: %s", myAddr)
+	// Checked by Validate
+	maxFileSizeBytes, _ := storage.ParseSize(cfg.MaxFileSize)
+	quotaBytes, _ := storage.ParseSize(cfg.Quota)
+	stall, _ := time.ParseDuration(cfg.StallTimeout)
+	server.Configure(server.Options{
+		NodeID:          nodeID,
+		DeviceName:      deviceName,
+		AppVersion:      version,
+		DownloadDir:     cfg.DownloadDir,
+		CollisionPolicy: cfg.CollisionPolicy,
+		Certificate:     cert,
+		Trust:           pins,
+		Devices:         devices,
+		RequirePairing:  cfg.RequirePairing,
+		Metadata:        cfg.Metadata,
+		Partials:        cfg.Partials,
+		MaxFileSize:     maxFileSizeBytes,
+		Quota:           quotaBytes,
+		StallTimeout:    stall,
+		MaxIncoming:     cfg.MaxIncoming,
+		MaxPeerConns:    cfg.MaxPeerConns,
+		Interfaces:      cfg.Interfaces,
+	})
+	rate, _ := ratelimit.ParseRate(cfg.MaxRate) // Checked by Validate
+	server.SetMaxRate(rate)
 
 
 
+	queue, err := server.LoadSendQueue(filepath.Join(stateDir, server.QueueFileName), cfg.MaxActiveSends)
+	if err != nil {
+		log.Fatalf("Could not load send queue: %v", err)
+	}
+
 	// Create the TUI model first.
 	model := tui.InitialModel()
 	// Then create the program with the model.
@@ -43,20 +180,21 @@ func main() {
 	// THE FIX: Inject the program reference into the model using a method.
 	// This avoids the deadlock by not sending a message before the program is running.
 	model.SetProgram(p)
+	model.SetSendQueue(queue)
 
 	// --- Start Backend Services in Goroutines ---
 
-	// Start the discovery service to announce our presence.
-	go server.AnnounceService(myAddr)
-
-	// Start listening for peers and send updates to the TUI.
-	go server.ListenForPeers(p,myAddr)
+	// Announce our presence and send the peers we find to the TUI.
+	server.StartDiscovery(p, tcpPort, cfg.Discovery)
 
 	// --- Start the TCP Server (with graceful shutdown) ---
 	shutdownSig := make(chan os.Signal, 1)
 	signal.Notify(shutdownSig, os.Interrupt, syscall.SIGTERM)
 	go server.StartTcpServer(shutdownSig, tcpPort, p)
 
+	// Pick up sends left in the queue by the last run.
+	queue.Start(p)
+
 	// --- Run the TUI ---
 	// This is a blocking call and will run until the user quits.
 	if _, err := p.Run(); err != nil {
@@ -65,6 +203,7 @@ func main() {
 
 	// TUI has quit, so we can signal the server to shut down.
 	log.Println("TUI has quit. Sending shutdown signal to server.")
+	server.StopDiscovery()
 	shutdownSig <- syscall.SIGTERM
 	// Give the server a moment to shut down before the program exits.
 	time.Sleep(1 * time.Second)